@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+var (
+	// ErrInvalidCredentials is returned when the credentials do not prove any identity
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+	// ErrUnsupportedScheme is returned for the credentials of a scheme the authenticator does not know
+	ErrUnsupportedScheme = errors.New("Unsupported authentication scheme")
+)
+
+// Credentials are what a client proves who it is with
+type Credentials struct {
+	Scheme   protocol.AuthScheme
+	Username string
+	Secret   string
+}
+
+// Authenticator checks the credentials of the clients, own backends can be plugged into the server by implementing it
+type Authenticator interface {
+	// Authenticate returns the identity the credentials prove, or ErrInvalidCredentials
+	Authenticate(credentials Credentials) (string, error)
+}
+
+// Schemes authenticates the credentials with the authenticator of their scheme, so a server can accept several schemes
+type Schemes map[protocol.AuthScheme]Authenticator
+
+// Authenticate passes the credentials to the authenticator of their scheme
+func (t Schemes) Authenticate(credentials Credentials) (string, error) {
+	authenticator, ok := t[credentials.Scheme]
+	if !ok {
+		return "", ErrUnsupportedScheme
+	}
+	return authenticator.Authenticate(credentials)
+}
+
+// readPairs passes the colon separated pairs of the file to add, empty lines and the lines starting with # are skipped.
+// The format is the expected pair in the error of a bad line.
+func readPairs(path string, format string, add func(key string, value string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.Index(line, ":")
+		if separator <= 0 {
+			return fmt.Errorf("%s:%d: expected %s", path, lineNumber, format)
+		}
+		add(line[:separator], line[separator+1:])
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokenAuthenticatorShouldReturnIdentityOfToken(t *testing.T) {
+	authenticator := NewTokenAuthenticator(map[string]string{"token-a": "alice", "token-b": "bob"})
+
+	identity, err := authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemeToken, Secret: "token-b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", identity)
+
+	_, err = authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemeToken, Secret: "token-c"})
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// a token is not a password
+	_, err = authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemePassword, Username: "anything", Secret: "token-b"})
+	assert.Equal(t, ErrUnsupportedScheme, err)
+}
+
+func TestTokenAuthenticatorShouldLoadTokensFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "tokens")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("# services\n\nci:token:with:colons\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	authenticator, err := LoadTokenFile(file.Name())
+	require.NoError(t, err)
+
+	identity, err := authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemeToken, Secret: "token:with:colons"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", identity)
+
+	require.NoError(t, ioutil.WriteFile(file.Name(), []byte("token-without-identity\n"), 0600))
+	_, err = LoadTokenFile(file.Name())
+	assert.EqualError(t, err, file.Name()+":1: expected identity:token")
+}
+
+func TestPasswordAuthenticatorShouldCheckPasswordsFromFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	file, err := ioutil.TempFile("", "passwords")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("# users\n\nalice:" + string(hash) + "\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	authenticator, err := LoadPasswordFile(file.Name())
+	require.NoError(t, err)
+
+	identity, err := authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", identity)
+
+	_, err = authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "wrong"})
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	_, err = authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemePassword, Username: "bob", Secret: "secret"})
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	_, err = authenticator.Authenticate(Credentials{Scheme: protocol.AuthSchemeToken, Username: "alice", Secret: "secret"})
+	assert.Equal(t, ErrUnsupportedScheme, err)
+}
+
+func TestSchemesShouldPassCredentialsToTheAuthenticatorOfTheirScheme(t *testing.T) {
+	fakeAuthenticator := new(MockAuthenticator)
+	schemes := Schemes{protocol.AuthSchemeToken: fakeAuthenticator}
+
+	credentials := Credentials{Scheme: protocol.AuthSchemeToken, Secret: "token"}
+	fakeAuthenticator.On("Authenticate", credentials).Return("alice", nil).Once()
+
+	identity, err := schemes.Authenticate(credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", identity)
+
+	_, err = schemes.Authenticate(Credentials{Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "secret"})
+	assert.Equal(t, ErrUnsupportedScheme, err)
+	fakeAuthenticator.AssertExpectations(t)
+}
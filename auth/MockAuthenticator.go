@@ -0,0 +1,14 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/mock"
+)
+
+type MockAuthenticator struct {
+	mock.Mock
+}
+
+func (m *MockAuthenticator) Authenticate(credentials Credentials) (string, error) {
+	args := m.Called(credentials)
+	return args.String(0), args.Error(1)
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"github.com/Applifier/golang-backend-assignment/protocol"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAuthenticator authenticates the clients with a username and password checked against bcrypt hashes,
+// the identity is the username
+type PasswordAuthenticator struct {
+	hashes map[string][]byte
+}
+
+// NewPasswordAuthenticator creates an authenticator for the users, hashes maps every username to the bcrypt hash of its password
+func NewPasswordAuthenticator(hashes map[string][]byte) *PasswordAuthenticator {
+	return &PasswordAuthenticator{hashes: hashes}
+}
+
+// LoadPasswordFile creates an authenticator for the users in the file. Every line of the file is a username and
+// the bcrypt hash of its password separated by a colon, empty lines and the lines starting with # are skipped.
+func LoadPasswordFile(path string) (*PasswordAuthenticator, error) {
+	hashes := make(map[string][]byte)
+	err := readPairs(path, "username:hash", func(username string, hash string) {
+		hashes[username] = []byte(hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewPasswordAuthenticator(hashes), nil
+}
+
+// Authenticate returns the username of the credentials if the password matches its hash,
+// only the credentials of the password scheme are accepted
+func (t *PasswordAuthenticator) Authenticate(credentials Credentials) (string, error) {
+	if credentials.Scheme != protocol.AuthSchemePassword {
+		return "", ErrUnsupportedScheme
+	}
+
+	hash, ok := t.hashes[credentials.Username]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(credentials.Secret)) != nil {
+		return "", ErrInvalidCredentials
+	}
+	return credentials.Username, nil
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// TokenAuthenticator authenticates the clients with static tokens, every token proves an identity
+type TokenAuthenticator struct {
+	// tokens are kept hashed, so comparing them takes the same time whatever the token is
+	tokens map[[sha256.Size]byte]string
+}
+
+// NewTokenAuthenticator creates an authenticator accepting the tokens, tokens maps every token to its identity
+func NewTokenAuthenticator(tokens map[string]string) *TokenAuthenticator {
+	authenticator := &TokenAuthenticator{tokens: make(map[[sha256.Size]byte]string, len(tokens))}
+	for token, identity := range tokens {
+		authenticator.tokens[sha256.Sum256([]byte(token))] = identity
+	}
+	return authenticator
+}
+
+// LoadTokenFile creates an authenticator accepting the tokens in the file. Every line of the file is an identity and
+// its token separated by a colon, empty lines and the lines starting with # are skipped.
+func LoadTokenFile(path string) (*TokenAuthenticator, error) {
+	tokens := make(map[string]string)
+	err := readPairs(path, "identity:token", func(identity string, token string) {
+		tokens[token] = identity
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenAuthenticator(tokens), nil
+}
+
+// Authenticate returns the identity of the token in the secret of the credentials,
+// only the credentials of the token scheme are accepted
+func (t *TokenAuthenticator) Authenticate(credentials Credentials) (string, error) {
+	if credentials.Scheme != protocol.AuthSchemeToken {
+		return "", ErrUnsupportedScheme
+	}
+
+	hash := sha256.Sum256([]byte(credentials.Secret))
+	for token, identity := range t.tokens {
+		if subtle.ConstantTimeCompare(hash[:], token[:]) == 1 {
+			return identity, nil
+		}
+	}
+	return "", ErrInvalidCredentials
+}
@@ -7,19 +7,40 @@ import (
 	"github.com/Applifier/golang-backend-assignment/protocol"
 )
 
+// errorChannelSize is how many rejections of a command type are kept until they are read
+const errorChannelSize = 16
+
+// deliveryChannelSize is how many messages of each type are kept until they are read, the reader does not wait
+// for an application which does not read them
+const deliveryChannelSize = 64
+
+// ErrDeliveryQueueFull is returned by Add when the application does not read the messages of the type in time,
+// the message is dropped so the reader of the connection never waits for the application
+var ErrDeliveryQueueFull = errors.New("delivery queue full")
+
 type CommandChannels struct {
-	incoming    chan protocol.MessageFromClient
 	whoami      chan protocol.WhoAmICommand
 	listClients chan protocol.ListClientsCommand
+	// deliveries keep the direct, room and topic messages by command type until they are read
+	deliveries map[protocol.CommandType]chan interface{}
+	errors     map[protocol.CommandType]chan protocol.ErrorCommand
 }
 
 type CommandChannelsProducer struct{}
 
 func (t *CommandChannelsProducer) Produce() *CommandChannels {
 	return &CommandChannels{
-		incoming:    make(chan protocol.MessageFromClient),
 		whoami:      make(chan protocol.WhoAmICommand),
 		listClients: make(chan protocol.ListClientsCommand),
+		deliveries: map[protocol.CommandType]chan interface{}{
+			protocol.CommandTypeMessageFromClient: make(chan interface{}, deliveryChannelSize),
+			protocol.CommandTypeRoomMessage:       make(chan interface{}, deliveryChannelSize),
+			protocol.CommandTypeTopicMessage:      make(chan interface{}, deliveryChannelSize),
+		},
+		errors: map[protocol.CommandType]chan protocol.ErrorCommand{
+			protocol.CommandTypeWhoAmI:      make(chan protocol.ErrorCommand, errorChannelSize),
+			protocol.CommandTypeListClients: make(chan protocol.ErrorCommand, errorChannelSize),
+		},
 	}
 }
 
@@ -30,7 +51,13 @@ func (t *CommandChannels) Add(data interface{}) error {
 	case protocol.ListClientsCommand:
 		t.listClients <- v
 	case protocol.MessageFromClient:
-		t.incoming <- v
+		return t.deliver(protocol.CommandTypeMessageFromClient, v)
+	case protocol.RoomMessageCommand:
+		return t.deliver(protocol.CommandTypeRoomMessage, v)
+	case protocol.TopicMessageCommand:
+		return t.deliver(protocol.CommandTypeTopicMessage, v)
+	case protocol.ErrorCommand:
+		t.addError(v)
 	default:
 		log.Printf("Unknown command: %v", v)
 		return errors.New("Unknown command")
@@ -38,14 +65,49 @@ func (t *CommandChannels) Add(data interface{}) error {
 	return nil
 }
 
+// deliver keeps the message until the application reads it, it never blocks the reader
+func (t *CommandChannels) deliver(commandType protocol.CommandType, message interface{}) error {
+	select {
+	case t.deliveries[commandType] <- message:
+		return nil
+	default:
+		return ErrDeliveryQueueFull
+	}
+}
+
+// addError passes the rejection to the channel of the rejected command type, it never blocks the reader
+func (t *CommandChannels) addError(command protocol.ErrorCommand) {
+	errorChannel, ok := t.errors[command.RefCommandType]
+	if !ok {
+		log.Printf("Server error: %v", command)
+		return
+	}
+
+	select {
+	case errorChannel <- command:
+	default:
+		log.Printf("Too many unread server errors, dropping: %v", command)
+	}
+}
+
 func (t *CommandChannels) Get(commandType protocol.CommandType) (interface{}, error) {
 	switch commandType {
 	case protocol.CommandTypeWhoAmI:
-		return <-t.whoami, nil
+		select {
+		case command := <-t.whoami:
+			return command, nil
+		case rejection := <-t.errors[commandType]:
+			return nil, rejection
+		}
 	case protocol.CommandTypeListClients:
-		return <-t.listClients, nil
-	case protocol.CommandTypeMessageFromClient:
-		return <-t.incoming, nil
+		select {
+		case command := <-t.listClients:
+			return command, nil
+		case rejection := <-t.errors[commandType]:
+			return nil, rejection
+		}
+	case protocol.CommandTypeMessageFromClient, protocol.CommandTypeRoomMessage, protocol.CommandTypeTopicMessage:
+		return <-t.deliveries[commandType], nil
 	}
 	return nil, errors.New("invalid command type")
 }
@@ -1,19 +1,51 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net"
+	"log"
 	"time"
 
+	"github.com/Applifier/golang-backend-assignment/datastream"
 	"github.com/Applifier/golang-backend-assignment/internal/client"
 )
 
 func main() {
+	address := flag.String("address", ":2525", "address of the server, host:port, tcp://host:port or unix:///path/to/socket")
+	useTLS := flag.Bool("tls", false, "connect to the server with TLS")
+	tlsServerName := flag.String("tls-server-name", "localhost", "name the server certificate is verified for")
+	tlsCA := flag.String("tls-ca", "", "CA file the server certificate is verified with, the system CAs are used if it is not set")
+	tlsCert := flag.String("tls-cert", "", "certificate file of the client, for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "key file of the client certificate")
+	token := flag.String("token", "", "token to authenticate with, for servers which require authentication")
+	username := flag.String("username", "", "username to authenticate with, for servers which require authentication")
+	password := flag.String("password", "", "password of the username")
+	flag.Parse()
+
 	fmt.Println("Hello from client!")
 
-	client := client.New()
-	tcpAddress, _ := net.ResolveTCPAddr("tcp", ":2525")
-	go client.Connect(tcpAddress)
+	var options []client.Option
+	if *useTLS {
+		config, err := datastream.NewClientTlsConfig(*tlsServerName, *tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Cannot load TLS config: %v", err)
+		}
+		options = append(options, client.WithDataStreamerProducer(&datastream.TlsDataStreamProducer{Config: config}))
+	}
+
+	if *token != "" {
+		options = append(options, client.WithToken(*token))
+	} else if *username != "" {
+		options = append(options, client.WithPassword(*username, *password))
+	}
+
+	endpoint, err := datastream.ParseEndpoint(*address)
+	if err != nil {
+		log.Fatalf("Cannot parse address: %v", err)
+	}
+
+	client := client.New(options...)
+	go client.Connect(endpoint)
 	time.Sleep(5 * time.Second)
 	client.WhoAmI()
 }
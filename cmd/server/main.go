@@ -1,15 +1,129 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Applifier/golang-backend-assignment/auth"
+	"github.com/Applifier/golang-backend-assignment/datastream"
 	"github.com/Applifier/golang-backend-assignment/internal/server"
+	"github.com/Applifier/golang-backend-assignment/mailbox"
+	"github.com/Applifier/golang-backend-assignment/protocol"
 )
 
 func main() {
+	address := flag.String("address", ":2525", "address to listen on, host:port, tcp://host:port or unix:///path/to/socket")
+	socketMode := flag.String("socket-mode", "0660", "permissions of the unix socket file")
+	tlsCert := flag.String("tls-cert", "", "certificate file of the server, the server speaks TLS if it is set")
+	tlsKey := flag.String("tls-key", "", "key file of the server certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file the client certificates must be signed by, for mutual TLS")
+	webSocketAddress := flag.String("websocket-address", "", "address the WebSocket gateway for the browsers listens on, disabled if it is not set")
+	webSocketPath := flag.String("websocket-path", "/chat", "path the WebSocket gateway upgrades")
+	webSocketOrigins := flag.String("websocket-origins", "", "comma separated origins the browsers are let in from, the host of the gateway if it is not set")
+	webSocketTls := flag.Bool("websocket-tls", false, "serve the WebSocket gateway over wss with the -tls-cert certificate, for pages served over https")
+	httpAddress := flag.String("http-address", "", "address the HTTP API listens on, disabled if it is not set")
+	authPasswords := flag.String("auth-passwords", "", "file of the users the clients can authenticate as, username:bcrypt-hash per line")
+	authTokens := flag.String("auth-tokens", "", "file of the tokens the clients can authenticate with, identity:token per line")
+	identityNicks := flag.Bool("identity-nicks", false, "make the identities the clients authenticate as their nicks")
+	mailboxRetention := flag.Duration("mailbox-retention", 0, "how long the messages to offline nicks are kept, needs -identity-nicks and an auth file, disabled if it is not set")
+	flag.Parse()
+
 	fmt.Println("Hello from server!")
-	server := server.New()
-	tcpAddress, _ := net.ResolveTCPAddr("tcp", ":2525")
-	server.Start(tcpAddress)
+	var options []server.Option
+
+	endpoint, err := datastream.ParseEndpoint(*address)
+	if err != nil {
+		log.Fatalf("Cannot parse address: %v", err)
+	}
+
+	if *tlsCert != "" {
+		config, err := datastream.NewServerTlsConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("Cannot load TLS config: %v", err)
+		}
+		options = append(options, server.WithDataStreamerProducer(&datastream.TlsDataStreamProducer{Config: config}))
+	} else if _, ok := endpoint.(*net.UnixAddr); ok {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil {
+			log.Fatalf("Cannot parse socket mode: %v", err)
+		}
+		options = append(options, server.WithDataStreamerProducer(&datastream.UnixDataStreamProducer{Mode: os.FileMode(mode)}))
+	}
+
+	if *webSocketAddress != "" {
+		gatewayEndpoint, err := datastream.ParseEndpoint(*webSocketAddress)
+		if err != nil {
+			log.Fatalf("Cannot parse WebSocket address: %v", err)
+		}
+		gateway := &datastream.WebSocketDataStreamProducer{Path: *webSocketPath}
+		if *webSocketOrigins != "" {
+			gateway.AllowedOrigins = strings.Split(*webSocketOrigins, ",")
+		}
+		if *webSocketTls {
+			// browsers have no client certificates, so the client CA is not used
+			gateway.TlsConfig, err = datastream.NewServerTlsConfig(*tlsCert, *tlsKey, "")
+			if err != nil {
+				log.Fatalf("Cannot load WebSocket TLS config: %v", err)
+			}
+		}
+		options = append(options, server.WithGateway(gatewayEndpoint, gateway))
+	}
+
+	// the clients must authenticate if any scheme is configured
+	schemes := auth.Schemes{}
+	if *authPasswords != "" {
+		authenticator, err := auth.LoadPasswordFile(*authPasswords)
+		if err != nil {
+			log.Fatalf("Cannot load password file: %v", err)
+		}
+		schemes[protocol.AuthSchemePassword] = authenticator
+	}
+	if *authTokens != "" {
+		authenticator, err := auth.LoadTokenFile(*authTokens)
+		if err != nil {
+			log.Fatalf("Cannot load token file: %v", err)
+		}
+		schemes[protocol.AuthSchemeToken] = authenticator
+	}
+	if len(schemes) > 0 {
+		options = append(options, server.WithAuthenticator(schemes))
+	}
+	if *identityNicks {
+		options = append(options, server.WithIdentityNicks())
+	}
+	if *mailboxRetention > 0 {
+		mailbox := mailbox.NewMemoryMailbox(mailbox.Limits{Retention: *mailboxRetention, MaxMessages: 100, MaxBytes: 1 << 20})
+		options = append(options, server.WithMailbox(mailbox))
+	}
+
+	if *httpAddress != "" {
+		httpEndpoint, err := datastream.ParseEndpoint(*httpAddress)
+		if err != nil {
+			log.Fatalf("Cannot parse HTTP address: %v", err)
+		}
+		options = append(options, server.WithHTTPAPI(httpEndpoint))
+	}
+
+	server := server.New(options...)
+	if err := server.Start(endpoint); err != nil {
+		log.Fatalf("Cannot start server: %v", err)
+	}
+
+	// let the clients receive their messages before going away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
 }
@@ -2,6 +2,7 @@ package datastream
 
 import (
 	"bufio"
+	"context"
 	"net"
 )
 
@@ -52,8 +53,8 @@ func (dataStream *TcpDataStream) Accept() (IDataStreamer, error) {
 
 }
 
-func (dataStream *TcpDataStream) CreateConnection(serverAddr *net.TCPAddr) (IDataStreamer, error) {
-	conn, err := net.Dial("tcp", serverAddr.String())
+func (dataStream *TcpDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
+	conn, err := net.Dial(serverAddr.Network(), serverAddr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -66,8 +67,21 @@ func (dataStream *TcpDataStream) CreateConnection(serverAddr *net.TCPAddr) (IDat
 	}, nil
 }
 
-func (dataStream *TcpDataStream) CreateListener(serverAddr *net.TCPAddr) (IDataStreamer, error) {
-	listener, err := net.Listen("tcp", serverAddr.String())
+func (dataStream *TcpDataStream) CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, serverAddr.Network(), serverAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return &TcpDataStream{
+		conn:   conn,
+		writer: bufio.NewWriter(conn),
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+func (dataStream *TcpDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
+	listener, err := net.Listen(serverAddr.Network(), serverAddr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -75,3 +89,8 @@ func (dataStream *TcpDataStream) CreateListener(serverAddr *net.TCPAddr) (IDataS
 		listener: listener,
 	}, nil
 }
+
+// Addr returns the address the listener is bound to
+func (dataStream *TcpDataStream) Addr() net.Addr {
+	return dataStream.listener.Addr()
+}
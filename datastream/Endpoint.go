@@ -0,0 +1,32 @@
+package datastream
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrInvalidEndpoint is returned when the scheme of an endpoint is neither tcp nor unix, or it has no address
+var ErrInvalidEndpoint = errors.New("invalid endpoint")
+
+// ParseEndpoint parses a tcp://host:port or unix:///path/to/socket endpoint. An endpoint without a scheme is a TCP
+// address, like ":2525". The path of a unix endpoint is relative if it has two slashes only, as in unix://chat.sock.
+func ParseEndpoint(endpoint string) (net.Addr, error) {
+	scheme := "tcp"
+	address := endpoint
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		scheme = endpoint[:i]
+		address = endpoint[i+len("://"):]
+	}
+
+	switch scheme {
+	case "tcp":
+		return net.ResolveTCPAddr("tcp", address)
+	case "unix":
+		if address == "" {
+			return nil, ErrInvalidEndpoint
+		}
+		return &net.UnixAddr{Name: address, Net: "unix"}, nil
+	}
+	return nil, ErrInvalidEndpoint
+}
@@ -0,0 +1,31 @@
+package datastream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEndpointShouldReturnTheAddressOfTheScheme(t *testing.T) {
+	addr, err := ParseEndpoint("tcp://127.0.0.1:2525")
+	assert.NoError(t, err)
+	assert.Equal(t, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525}, addr)
+
+	addr, err = ParseEndpoint(":2525")
+	assert.NoError(t, err)
+	assert.Equal(t, &net.TCPAddr{Port: 2525}, addr)
+
+	addr, err = ParseEndpoint("unix:///run/chat.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, &net.UnixAddr{Name: "/run/chat.sock", Net: "unix"}, addr)
+
+	addr, err = ParseEndpoint("unix://chat.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, &net.UnixAddr{Name: "chat.sock", Net: "unix"}, addr)
+
+	_, err = ParseEndpoint("unix://")
+	assert.Equal(t, ErrInvalidEndpoint, err)
+	_, err = ParseEndpoint("udp://:2525")
+	assert.Equal(t, ErrInvalidEndpoint, err)
+}
@@ -1,12 +1,15 @@
 package datastream
 
 import (
+	"context"
 	"net"
 )
 
+// IDataStreamer connects to and listens on addresses of any network the implementation supports,
+// e.g. *net.TCPAddr or *net.UnixAddr as returned by ParseEndpoint
 type IDataStreamer interface {
-	CreateConnection(serverAddr *net.TCPAddr) (IDataStreamer, error)
-	CreateListener(serverAddr *net.TCPAddr) (IDataStreamer, error)
+	CreateConnection(serverAddr net.Addr) (IDataStreamer, error)
+	CreateListener(serverAddr net.Addr) (IDataStreamer, error)
 	Accept() (IDataStreamer, error)
 	CloseConnection() error
 	CloseListener() error
@@ -18,3 +21,14 @@ type IDataStreamer interface {
 type IDataStreamerProducer interface {
 	Produce() IDataStreamer
 }
+
+// IContextDataStreamer is implemented by the data streamers which can stop connecting when the context is done
+type IContextDataStreamer interface {
+	CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error)
+}
+
+// IAddrDataStreamer is implemented by the listeners which can tell the address they are bound to,
+// e.g. the port the system picked for port 0
+type IAddrDataStreamer interface {
+	Addr() net.Addr
+}
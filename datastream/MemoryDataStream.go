@@ -0,0 +1,210 @@
+package datastream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrConnectionRefused is returned when nothing listens on the address of the memory network
+	ErrConnectionRefused = errors.New("connection refused")
+	// ErrAddressInUse is returned when something already listens on the address
+	ErrAddressInUse = errors.New("address already in use")
+	// ErrListenerClosed is returned by Accept once the listener is closed
+	ErrListenerClosed = errors.New("listener closed")
+)
+
+// MemoryNetwork connects the memory data streamers of a process, servers listen on it and clients connect through it
+// without any sockets. Addresses of different networks do not collide.
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*MemoryDataStream
+}
+
+// NewMemoryNetwork creates a network nothing listens on yet
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*MemoryDataStream)}
+}
+
+// MemoryDataStream is the in-process implementation of IDataStreamer, both directions of a connection are buffered
+// pipes so writing never waits for the peer to read
+type MemoryDataStream struct {
+	network *MemoryNetwork
+
+	// listener
+	address   string
+	accepted  chan *MemoryDataStream
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// connection
+	inbound  *bufferedPipe
+	outbound *bufferedPipe
+	writer   *bufio.Writer
+	reader   *bufio.Reader
+}
+
+// MemoryDataStreamProducer produces data streamers listening on and connecting through the network
+type MemoryDataStreamProducer struct {
+	Network *MemoryNetwork
+}
+
+func (t *MemoryDataStreamProducer) Produce() IDataStreamer {
+	return &MemoryDataStream{network: t.Network}
+}
+
+func (dataStream *MemoryDataStream) ReadByte() (byte, error) {
+	return dataStream.reader.ReadByte()
+}
+
+// CloseConnection closes both directions, the peer reads what is already written and then io.EOF
+func (dataStream *MemoryDataStream) CloseConnection() error {
+	dataStream.inbound.close()
+	dataStream.outbound.close()
+	return nil
+}
+
+// CloseListener stops accepting connections and frees the address
+func (dataStream *MemoryDataStream) CloseListener() error {
+	dataStream.closeOnce.Do(func() {
+		close(dataStream.closed)
+
+		dataStream.network.mutex.Lock()
+		delete(dataStream.network.listeners, dataStream.address)
+		dataStream.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (dataStream *MemoryDataStream) Write(data []byte) (nn int, err error) {
+	return dataStream.writer.Write(data)
+}
+
+func (dataStream *MemoryDataStream) Flush() error {
+	return dataStream.writer.Flush()
+}
+
+func (dataStream *MemoryDataStream) Accept() (IDataStreamer, error) {
+	select {
+	case conn := <-dataStream.accepted:
+		return conn, nil
+	case <-dataStream.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (dataStream *MemoryDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
+	return dataStream.CreateConnectionContext(context.Background(), serverAddr)
+}
+
+// CreateConnectionContext connects to the listener on the address, and waits for it to accept the connection
+// until the context is done
+func (dataStream *MemoryDataStream) CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error) {
+	dataStream.network.mutex.Lock()
+	listener, ok := dataStream.network.listeners[serverAddr.String()]
+	dataStream.network.mutex.Unlock()
+	if !ok {
+		return nil, ErrConnectionRefused
+	}
+
+	toServer := newBufferedPipe()
+	toClient := newBufferedPipe()
+	clientConn := dataStream.newConnection(toClient, toServer)
+	serverConn := dataStream.newConnection(toServer, toClient)
+
+	select {
+	case listener.accepted <- serverConn:
+		return clientConn, nil
+	case <-listener.closed:
+		return nil, ErrConnectionRefused
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (dataStream *MemoryDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
+	listener := &MemoryDataStream{
+		network:  dataStream.network,
+		address:  serverAddr.String(),
+		accepted: make(chan *MemoryDataStream),
+		closed:   make(chan struct{}),
+	}
+
+	dataStream.network.mutex.Lock()
+	defer dataStream.network.mutex.Unlock()
+	if _, ok := dataStream.network.listeners[listener.address]; ok {
+		return nil, ErrAddressInUse
+	}
+	dataStream.network.listeners[listener.address] = listener
+	return listener, nil
+}
+
+func (dataStream *MemoryDataStream) newConnection(inbound *bufferedPipe, outbound *bufferedPipe) *MemoryDataStream {
+	return &MemoryDataStream{
+		network:  dataStream.network,
+		inbound:  inbound,
+		outbound: outbound,
+		writer:   bufio.NewWriter(outbound),
+		reader:   bufio.NewReader(inbound),
+	}
+}
+
+// bufferedPipe is one direction of a memory connection. Writes are kept until they are read, reads wait for writes.
+type bufferedPipe struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	buffer []byte
+	closed bool
+}
+
+func newBufferedPipe() *bufferedPipe {
+	pipe := &bufferedPipe{}
+	pipe.cond = sync.NewCond(&pipe.mutex)
+	return pipe
+}
+
+// Read waits for written data, it returns io.EOF once the pipe is closed and everything written is read
+func (t *bufferedPipe) Read(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.buffer) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if len(t.buffer) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(data, t.buffer)
+	t.buffer = t.buffer[n:]
+	if len(t.buffer) == 0 {
+		// the next write starts a new array instead of growing the one already read
+		t.buffer = nil
+	}
+	return n, nil
+}
+
+// Write keeps the data for the reader, it fails with io.ErrClosedPipe once the pipe is closed
+func (t *bufferedPipe) Write(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, io.ErrClosedPipe
+	}
+	t.buffer = append(t.buffer, data...)
+	t.cond.Broadcast()
+	return len(data), nil
+}
+
+func (t *bufferedPipe) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	t.cond.Broadcast()
+}
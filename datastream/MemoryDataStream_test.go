@@ -0,0 +1,72 @@
+package datastream
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDataStreamShouldConnectToTheListener(t *testing.T) {
+	producer := &MemoryDataStreamProducer{Network: NewMemoryNetwork()}
+	serverAddr := &net.TCPAddr{Port: 1}
+
+	listener, err := producer.Produce().CreateListener(serverAddr)
+	require.NoError(t, err)
+	defer listener.CloseListener()
+
+	_, err = producer.Produce().CreateListener(serverAddr)
+	assert.Equal(t, ErrAddressInUse, err)
+	_, err = producer.Produce().CreateConnection(&net.TCPAddr{Port: 2})
+	assert.Equal(t, ErrConnectionRefused, err)
+
+	accepted := make(chan IDataStreamer)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	clientConn, err := producer.Produce().CreateConnection(serverAddr)
+	require.NoError(t, err)
+	serverConn := <-accepted
+
+	// the client writes before the server reads anything
+	_, err = clientConn.Write([]byte{1, 2})
+	assert.NoError(t, err)
+	assert.NoError(t, clientConn.Flush())
+	assert.NoError(t, clientConn.CloseConnection())
+
+	for _, expected := range []byte{1, 2} {
+		b, err := serverConn.ReadByte()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b)
+	}
+	_, err = serverConn.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = serverConn.Write([]byte{3})
+	assert.NoError(t, err)
+	assert.Equal(t, io.ErrClosedPipe, serverConn.Flush())
+}
+
+func TestMemoryDataStreamShouldStopAcceptingWhenTheListenerIsClosed(t *testing.T) {
+	producer := &MemoryDataStreamProducer{Network: NewMemoryNetwork()}
+	serverAddr := &net.TCPAddr{Port: 1}
+
+	listener, err := producer.Produce().CreateListener(serverAddr)
+	require.NoError(t, err)
+	assert.NoError(t, listener.CloseListener())
+
+	_, err = listener.Accept()
+	assert.Equal(t, ErrListenerClosed, err)
+	_, err = producer.Produce().CreateConnection(serverAddr)
+	assert.Equal(t, ErrConnectionRefused, err)
+
+	// the address is free again
+	listener, err = producer.Produce().CreateListener(serverAddr)
+	assert.NoError(t, err)
+	assert.NoError(t, listener.CloseListener())
+}
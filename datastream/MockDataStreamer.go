@@ -10,12 +10,12 @@ type MockTcpDataStream struct {
 	mock.Mock
 }
 
-func (m *MockTcpDataStream) CreateConnection(serverAddr *net.TCPAddr) (IDataStreamer, error) {
+func (m *MockTcpDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
 	args := m.Called(serverAddr)
 	return args.Get(0).(IDataStreamer), args.Error(1)
 }
 
-func (m *MockTcpDataStream) CreateListener(serverAddr *net.TCPAddr) (IDataStreamer, error) {
+func (m *MockTcpDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
 	args := m.Called(serverAddr)
 	return args.Get(0).(IDataStreamer), args.Error(1)
 }
@@ -49,3 +49,12 @@ func (m *MockTcpDataStream) Flush() error {
 	args := m.Called()
 	return args.Error(0)
 }
+
+type MockDataStreamerProducer struct {
+	mock.Mock
+}
+
+func (m *MockDataStreamerProducer) Produce() IDataStreamer {
+	args := m.Called()
+	return args.Get(0).(IDataStreamer)
+}
@@ -0,0 +1,210 @@
+package datastream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+// errNoCertificates is returned when a CA file has no certificates in it
+var errNoCertificates = errors.New("no certificates in CA file")
+
+// TlsDataStream is the TLS implementation of IDataStreamer, connections are encrypted with the config of its producer
+type TlsDataStream struct {
+	config   *tls.Config
+	conn     *tls.Conn
+	listener net.Listener
+	writer   *bufio.Writer
+	reader   *bufio.Reader
+}
+
+// TlsDataStreamProducer produces TLS data streamers with the config. Servers need a certificate in the config,
+// and verify the certificates of the clients if ClientAuth asks for it. Clients need the ServerName to verify the server.
+type TlsDataStreamProducer struct {
+	Config *tls.Config
+}
+
+// IPeerIdentity is implemented by the data streamers which know who the peer of the connection is
+type IPeerIdentity interface {
+	// PeerIdentity returns the identity of the verified peer, it is empty if the peer did not prove one
+	PeerIdentity() (string, error)
+}
+
+func (t *TlsDataStreamProducer) Produce() IDataStreamer {
+	return &TlsDataStream{config: t.Config}
+}
+
+// NewServerTlsConfig loads the certificate of the server. If a client CA file is given, the clients must present
+// certificates signed by one of its CAs.
+func NewServerTlsConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTlsConfig creates the config verifying the server by the name. The server is verified with the CAs of the
+// system unless a CA file is given, and the client presents the certificate if a certificate file is given.
+func NewClientTlsConfig(serverName string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+
+	var err error
+	if caFile != "" {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errNoCertificates
+	}
+	return pool, nil
+}
+
+func (dataStream *TlsDataStream) ReadByte() (byte, error) {
+	return dataStream.reader.ReadByte()
+}
+
+func (dataStream *TlsDataStream) CloseConnection() error {
+	return dataStream.conn.Close()
+}
+
+func (dataStream *TlsDataStream) CloseListener() error {
+	return dataStream.listener.Close()
+}
+
+// Addr returns the address the listener is bound to
+func (dataStream *TlsDataStream) Addr() net.Addr {
+	return dataStream.listener.Addr()
+}
+
+func (dataStream *TlsDataStream) Write(data []byte) (nn int, err error) {
+	return dataStream.writer.Write(data)
+}
+
+func (dataStream *TlsDataStream) Flush() error {
+	return dataStream.writer.Flush()
+}
+
+// Accept returns the next connection, the TLS handshake is done by its first read or write
+// so a slow client does not hold up the others
+func (dataStream *TlsDataStream) Accept() (IDataStreamer, error) {
+	conn, err := dataStream.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return dataStream.newConnection(conn.(*tls.Conn)), nil
+}
+
+func (dataStream *TlsDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
+	return dataStream.CreateConnectionContext(context.Background(), serverAddr)
+}
+
+// CreateConnectionContext connects to the server and does the TLS handshake, it gives up when the context is done
+func (dataStream *TlsDataStream) CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error) {
+	dialer := net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, serverAddr.Network(), serverAddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(rawConn, dataStream.config)
+	if err := handshakeContext(ctx, conn); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return dataStream.newConnection(conn), nil
+}
+
+// handshakeContext does the TLS handshake, closing the connection stops it when the context is done
+func handshakeContext(ctx context.Context, conn *tls.Conn) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Handshake()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (dataStream *TlsDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
+	listener, err := tls.Listen(serverAddr.Network(), serverAddr.String(), dataStream.config)
+	if err != nil {
+		return nil, err
+	}
+	return &TlsDataStream{
+		config:   dataStream.config,
+		listener: listener,
+	}, nil
+}
+
+func (dataStream *TlsDataStream) newConnection(conn *tls.Conn) *TlsDataStream {
+	return &TlsDataStream{
+		config: dataStream.config,
+		conn:   conn,
+		writer: bufio.NewWriter(conn),
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// PeerIdentity returns the common name of the verified certificate of the peer, or its first DNS name or email address
+// if it has no common name. It is empty if the peer presented no certificate which could be verified.
+func (dataStream *TlsDataStream) PeerIdentity() (string, error) {
+	if err := dataStream.conn.Handshake(); err != nil {
+		return "", err
+	}
+
+	state := dataStream.conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+
+	certificate := state.VerifiedChains[0][0]
+	switch {
+	case certificate.Subject.CommonName != "":
+		return certificate.Subject.CommonName, nil
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0], nil
+	case len(certificate.EmailAddresses) > 0:
+		return certificate.EmailAddresses[0], nil
+	}
+	return "", nil
+}
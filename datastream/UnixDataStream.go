@@ -0,0 +1,101 @@
+package datastream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ErrNotSocket is returned when the path of a unix listener is taken by a file which is not a socket
+var ErrNotSocket = errors.New("file exists and is not a socket")
+
+// UnixDataStream is the Unix domain socket implementation of IDataStreamer, for clients on the same host as the server.
+// Connections are handled like TCP connections, only the listener differs.
+type UnixDataStream struct {
+	TcpDataStream
+	mode os.FileMode
+}
+
+// UnixDataStreamProducer produces Unix domain socket data streamers. The socket file of a listener gets the Mode,
+// e.g. 0660 to let the group of the server connect. The umask decides the permissions if the Mode is zero.
+type UnixDataStreamProducer struct {
+	Mode os.FileMode
+}
+
+func (t *UnixDataStreamProducer) Produce() IDataStreamer {
+	return &UnixDataStream{mode: t.Mode}
+}
+
+func (dataStream *UnixDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
+	return dataStream.TcpDataStream.CreateConnection(unixAddr(serverAddr))
+}
+
+func (dataStream *UnixDataStream) CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error) {
+	return dataStream.TcpDataStream.CreateConnectionContext(ctx, unixAddr(serverAddr))
+}
+
+// CreateListener listens on the socket file at the path of the address. The file left by a server which stopped
+// without closing its listener is removed first, the file is removed again when the listener is closed.
+func (dataStream *UnixDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
+	path := serverAddr.String()
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket is created with the umask, clients which are not allowed may connect until it is changed
+	if dataStream.mode != 0 {
+		if err := os.Chmod(path, dataStream.mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return &UnixDataStream{
+		TcpDataStream: TcpDataStream{listener: listener},
+		mode:          dataStream.mode,
+	}, nil
+}
+
+// removeStaleSocket removes the socket file at the path if nothing accepts connections on it anymore. A socket with
+// a server behind it and a file which is not a socket are kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return ErrNotSocket
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return ErrAddressInUse
+	}
+	if !isConnectionRefused(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func isConnectionRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	syscallErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && syscallErr.Err == syscall.ECONNREFUSED
+}
+
+func unixAddr(serverAddr net.Addr) *net.UnixAddr {
+	return &net.UnixAddr{Name: serverAddr.String(), Net: "unix"}
+}
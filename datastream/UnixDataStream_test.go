@@ -0,0 +1,77 @@
+package datastream
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixDataStreamShouldListenWithTheModeAndConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serverAddr := &net.UnixAddr{Name: filepath.Join(dir, "chat.sock"), Net: "unix"}
+	producer := &UnixDataStreamProducer{Mode: 0660}
+
+	listener, err := producer.Produce().CreateListener(serverAddr)
+	require.NoError(t, err)
+
+	info, err := os.Stat(serverAddr.Name)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	accepted := make(chan IDataStreamer)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	clientConn, err := producer.Produce().CreateConnection(serverAddr)
+	require.NoError(t, err)
+	defer clientConn.CloseConnection()
+	serverConn := <-accepted
+	defer serverConn.CloseConnection()
+
+	_, err = clientConn.Write([]byte{1})
+	assert.NoError(t, err)
+	assert.NoError(t, clientConn.Flush())
+	b, err := serverConn.ReadByte()
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), b)
+
+	// a second server must not take the socket of a running one
+	_, err = producer.Produce().CreateListener(serverAddr)
+	assert.Equal(t, ErrAddressInUse, err)
+
+	assert.NoError(t, listener.CloseListener())
+	_, err = os.Stat(serverAddr.Name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixDataStreamShouldRemoveStaleSocketOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serverAddr := &net.UnixAddr{Name: filepath.Join(dir, "chat.sock"), Net: "unix"}
+	producer := &UnixDataStreamProducer{}
+
+	// a crashed server leaves its socket file behind
+	stale, err := net.ListenUnix("unix", serverAddr)
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, err := producer.Produce().CreateListener(serverAddr)
+	require.NoError(t, err)
+	require.NoError(t, listener.CloseListener())
+
+	require.NoError(t, ioutil.WriteFile(serverAddr.Name, []byte("data"), 0600))
+	_, err = producer.Produce().CreateListener(serverAddr)
+	assert.Equal(t, ErrNotSocket, err)
+}
@@ -0,0 +1,207 @@
+package datastream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// errTextMessage is returned when the peer sends a text message, the frames are only carried in binary messages
+var errTextMessage = errors.New("text message instead of binary")
+
+// WebSocketDataStream is the WebSocket implementation of IDataStreamer, so browsers can connect. The listener is an HTTP
+// server upgrading the requests to its path, and the frames of the protocol are carried in binary messages.
+// A message carries one or more whole frames, the ones flushed together.
+type WebSocketDataStream struct {
+	path           string
+	allowedOrigins []string
+	tlsConfig      *tls.Config
+
+	// listener
+	httpServer *http.Server
+	addr       net.Addr
+	accepted   chan *WebSocketDataStream
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	// connection
+	conn    *websocket.Conn
+	message io.Reader
+	buffer  bytes.Buffer
+	data    [1]byte
+}
+
+// WebSocketDataStreamProducer produces WebSocket data streamers upgrading and connecting on the Path, "/" if it is
+// empty. Browsers are only let in from the AllowedOrigins, or from the host of the server if there are none.
+// With a TlsConfig the listener serves HTTPS and the connections use wss, so pages served over https can connect.
+// Listeners need a certificate in the config, and clients verify the server with it like TlsDataStreamProducer.
+type WebSocketDataStreamProducer struct {
+	Path           string
+	AllowedOrigins []string
+	TlsConfig      *tls.Config
+}
+
+func (t *WebSocketDataStreamProducer) Produce() IDataStreamer {
+	path := t.Path
+	if path == "" {
+		path = "/"
+	}
+	return &WebSocketDataStream{path: path, allowedOrigins: t.AllowedOrigins, tlsConfig: t.TlsConfig}
+}
+
+// ReadByte reads the messages one after the other as if they were a stream
+func (dataStream *WebSocketDataStream) ReadByte() (byte, error) {
+	for {
+		if dataStream.message == nil {
+			messageType, message, err := dataStream.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, errTextMessage
+			}
+			dataStream.message = message
+		}
+
+		n, err := dataStream.message.Read(dataStream.data[:])
+		if n == 1 {
+			return dataStream.data[0], nil
+		}
+		if err == io.EOF {
+			dataStream.message = nil
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (dataStream *WebSocketDataStream) CloseConnection() error {
+	return dataStream.conn.Close()
+}
+
+// CloseListener stops the HTTP server, the upgraded connections stay open
+func (dataStream *WebSocketDataStream) CloseListener() error {
+	var err error
+	dataStream.closeOnce.Do(func() {
+		close(dataStream.closed)
+		err = dataStream.httpServer.Close()
+	})
+	return err
+}
+
+// Addr returns the address the HTTP server is bound to
+func (dataStream *WebSocketDataStream) Addr() net.Addr {
+	return dataStream.addr
+}
+
+// Write keeps the data until Flush sends it in one message
+func (dataStream *WebSocketDataStream) Write(data []byte) (nn int, err error) {
+	return dataStream.buffer.Write(data)
+}
+
+func (dataStream *WebSocketDataStream) Flush() error {
+	if dataStream.buffer.Len() == 0 {
+		return nil
+	}
+	defer dataStream.buffer.Reset()
+	return dataStream.conn.WriteMessage(websocket.BinaryMessage, dataStream.buffer.Bytes())
+}
+
+func (dataStream *WebSocketDataStream) Accept() (IDataStreamer, error) {
+	select {
+	case conn := <-dataStream.accepted:
+		return conn, nil
+	case <-dataStream.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (dataStream *WebSocketDataStream) CreateConnection(serverAddr net.Addr) (IDataStreamer, error) {
+	return dataStream.CreateConnectionContext(context.Background(), serverAddr)
+}
+
+// CreateConnectionContext connects to the path on the server and upgrades the connection, it gives up when
+// the context is done
+func (dataStream *WebSocketDataStream) CreateConnectionContext(ctx context.Context, serverAddr net.Addr) (IDataStreamer, error) {
+	endpoint := url.URL{Scheme: "ws", Host: serverAddr.String(), Path: dataStream.path}
+	dialer := *websocket.DefaultDialer
+	if dataStream.tlsConfig != nil {
+		endpoint.Scheme = "wss"
+		dialer.TLSClientConfig = dataStream.tlsConfig
+	}
+
+	conn, _, err := dialer.DialContext(ctx, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketDataStream{path: dataStream.path, conn: conn}, nil
+}
+
+// CreateListener starts the HTTP server on the address, or the HTTPS server if there is a TLS config
+func (dataStream *WebSocketDataStream) CreateListener(serverAddr net.Addr) (IDataStreamer, error) {
+	listener, err := net.Listen(serverAddr.Network(), serverAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	if dataStream.tlsConfig != nil {
+		listener = tls.NewListener(listener, dataStream.tlsConfig)
+	}
+
+	webSocketListener := &WebSocketDataStream{
+		path:           dataStream.path,
+		allowedOrigins: dataStream.allowedOrigins,
+		addr:           listener.Addr(),
+		accepted:       make(chan *WebSocketDataStream),
+		closed:         make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(dataStream.path, webSocketListener)
+	webSocketListener.httpServer = &http.Server{Handler: mux}
+
+	go webSocketListener.httpServer.Serve(listener)
+	return webSocketListener, nil
+}
+
+// ServeHTTP upgrades the request and hands the connection over to Accept
+func (dataStream *WebSocketDataStream) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	upgrader := websocket.Upgrader{}
+	if len(dataStream.allowedOrigins) > 0 {
+		upgrader.CheckOrigin = dataStream.checkOrigin
+	}
+
+	// the upgrader answers the requests it refuses
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		return
+	}
+
+	select {
+	case dataStream.accepted <- &WebSocketDataStream{path: dataStream.path, conn: conn}:
+	case <-dataStream.closed:
+		conn.Close()
+	}
+}
+
+// checkOrigin lets in the browsers of the allowed origins, and the clients which are not browsers and send no origin
+func (dataStream *WebSocketDataStream) checkOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range dataStream.allowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
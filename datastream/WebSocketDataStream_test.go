@@ -0,0 +1,141 @@
+package datastream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localAddr lets the system pick a free port for the HTTP server of the listener, the tests read it back from the listener
+var localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func TestWebSocketDataStreamShouldCarryTheStreamInBinaryMessages(t *testing.T) {
+	producer := &WebSocketDataStreamProducer{Path: "/chat"}
+
+	listener, err := producer.Produce().CreateListener(localAddr)
+	require.NoError(t, err)
+	defer listener.CloseListener()
+	serverAddr := listener.(IAddrDataStreamer).Addr()
+
+	accepted := make(chan IDataStreamer)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	clientConn, err := producer.Produce().CreateConnection(serverAddr)
+	require.NoError(t, err)
+	defer clientConn.CloseConnection()
+	serverConn := <-accepted
+	defer serverConn.CloseConnection()
+
+	// nothing is sent until it is flushed, then the messages are read as one stream
+	_, err = clientConn.Write([]byte{1, 2})
+	assert.NoError(t, err)
+	assert.NoError(t, clientConn.Flush())
+	_, err = clientConn.Write([]byte{3})
+	assert.NoError(t, err)
+	assert.NoError(t, clientConn.Flush())
+
+	for _, expected := range []byte{1, 2, 3} {
+		b, err := serverConn.ReadByte()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b)
+	}
+
+	require.NoError(t, clientConn.(*WebSocketDataStream).conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, err = serverConn.ReadByte()
+	assert.Equal(t, errTextMessage, err)
+}
+
+func TestWebSocketDataStreamShouldRefuseOtherOrigins(t *testing.T) {
+	producer := &WebSocketDataStreamProducer{Path: "/chat", AllowedOrigins: []string{"https://dashboard.example.com"}}
+
+	listener, err := producer.Produce().CreateListener(localAddr)
+	require.NoError(t, err)
+	defer listener.CloseListener()
+	go listener.Accept()
+	serverAddr := listener.(IAddrDataStreamer).Addr()
+
+	endpoint := "ws://" + serverAddr.String() + "/chat"
+	_, response, err := websocket.DefaultDialer.Dial(endpoint, http.Header{"Origin": {"https://evil.example.com"}})
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint, http.Header{"Origin": {"https://dashboard.example.com"}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestWebSocketDataStreamShouldUseWssWithTlsConfig(t *testing.T) {
+	certificate := createLocalCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate.Leaf)
+	producer := &WebSocketDataStreamProducer{Path: "/chat", TlsConfig: &tls.Config{Certificates: []tls.Certificate{certificate}}}
+
+	listener, err := producer.Produce().CreateListener(localAddr)
+	require.NoError(t, err)
+	defer listener.CloseListener()
+	serverAddr := listener.(IAddrDataStreamer).Addr()
+
+	accepted := make(chan IDataStreamer)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	// plain ws is not served
+	_, err = (&WebSocketDataStreamProducer{Path: "/chat"}).Produce().CreateConnection(serverAddr)
+	assert.Error(t, err)
+
+	clientProducer := &WebSocketDataStreamProducer{Path: "/chat", TlsConfig: &tls.Config{RootCAs: roots}}
+	clientConn, err := clientProducer.Produce().CreateConnection(serverAddr)
+	require.NoError(t, err)
+	defer clientConn.CloseConnection()
+	serverConn := <-accepted
+	defer serverConn.CloseConnection()
+
+	_, err = clientConn.Write([]byte{1})
+	assert.NoError(t, err)
+	assert.NoError(t, clientConn.Flush())
+	b, err := serverConn.ReadByte()
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), b)
+}
+
+// createLocalCertificate creates a self signed certificate for 127.0.0.1
+func createLocalCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	github.com/aws/aws-sdk-go v1.28.13
+	github.com/gorilla/websocket v1.4.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
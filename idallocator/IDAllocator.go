@@ -0,0 +1,72 @@
+package idallocator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// MonotonicIDAllocator gives increasing ids starting from 1 and never reuses them.
+// The zero value is ready to use.
+type MonotonicIDAllocator struct {
+	mutex  sync.Mutex
+	lastID uint64
+}
+
+// Allocate returns the next id
+func (t *MonotonicIDAllocator) Allocate() (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.lastID == math.MaxUint64 {
+		return 0, ErrIDsExhausted
+	}
+
+	t.lastID = t.lastID + 1
+	return t.lastID, nil
+}
+
+// Release does nothing, released ids are not given again
+func (t *MonotonicIDAllocator) Release(id uint64) {
+}
+
+// RandomIDAllocator gives random 64 bit ids, so the ids do not tell how many clients connected before.
+// The zero value is ready to use.
+type RandomIDAllocator struct {
+	mutex   sync.Mutex
+	liveIDs map[uint64]struct{}
+}
+
+// Allocate returns a random id which is not used by a live client
+func (t *RandomIDAllocator) Allocate() (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.liveIDs == nil {
+		t.liveIDs = make(map[uint64]struct{})
+	}
+
+	idBytes := make([]byte, 8)
+	for {
+		_, err := rand.Read(idBytes)
+		if err != nil {
+			return 0, err
+		}
+
+		// collisions are very unlikely, but a live id should never be given twice
+		id := binary.LittleEndian.Uint64(idBytes)
+		if _, ok := t.liveIDs[id]; id != 0 && !ok {
+			t.liveIDs[id] = struct{}{}
+			return id, nil
+		}
+	}
+}
+
+// Release makes the id free to be given again
+func (t *RandomIDAllocator) Release(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.liveIDs, id)
+}
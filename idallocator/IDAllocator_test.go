@@ -0,0 +1,76 @@
+package idallocator
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonotonicIDAllocatorShouldNotReuseReleasedIDs(t *testing.T) {
+	allocator := MonotonicIDAllocator{}
+
+	first, err := allocator.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), first)
+
+	allocator.Release(first)
+
+	second, err := allocator.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), second)
+}
+
+func TestMonotonicIDAllocatorShouldReturnErrorWhenExhausted(t *testing.T) {
+	allocator := MonotonicIDAllocator{lastID: math.MaxUint64 - 1}
+
+	id, err := allocator.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), id)
+
+	id, err = allocator.Allocate()
+	assert.Equal(t, ErrIDsExhausted, err)
+	assert.Equal(t, uint64(0), id)
+}
+
+func TestRandomIDAllocatorShouldTrackLiveIDs(t *testing.T) {
+	allocator := RandomIDAllocator{}
+
+	id, err := allocator.Allocate()
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint64(0), id)
+	assert.Contains(t, allocator.liveIDs, id)
+
+	allocator.Release(id)
+	assert.NotContains(t, allocator.liveIDs, id)
+}
+
+func TestAllocatorsShouldNotGiveTheSameIDConcurrently(t *testing.T) {
+	allocators := []IIDAllocator{&MonotonicIDAllocator{}, &RandomIDAllocator{}}
+
+	for _, allocator := range allocators {
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		ids := make(map[uint64]bool)
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					id, err := allocator.Allocate()
+					assert.Nil(t, err)
+
+					mutex.Lock()
+					assert.False(t, ids[id])
+					ids[id] = true
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, ids, 1000)
+	}
+}
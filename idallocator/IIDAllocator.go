@@ -0,0 +1,15 @@
+package idallocator
+
+import (
+	"errors"
+)
+
+// ErrIDsExhausted is returned when the allocator has no free id left
+var ErrIDsExhausted = errors.New("Client ids exhausted")
+
+// IIDAllocator gives ids to the connected clients, an id is never given to two live clients.
+// Zero is never allocated since it means no client.
+type IIDAllocator interface {
+	Allocate() (uint64, error)
+	Release(id uint64)
+}
@@ -0,0 +1,18 @@
+package idallocator
+
+import (
+	"github.com/stretchr/testify/mock"
+)
+
+type MockIDAllocator struct {
+	mock.Mock
+}
+
+func (m *MockIDAllocator) Allocate() (uint64, error) {
+	args := m.Called()
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *MockIDAllocator) Release(id uint64) {
+	m.Called(id)
+}
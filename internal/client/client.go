@@ -1,9 +1,15 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Applifier/golang-backend-assignment/channels"
 
@@ -14,13 +20,52 @@ import (
 
 // Client structure
 type Client struct {
-	dataStream      datastream.IDataStreamer
-	commandChannels channels.ICommandChannels
-	protocolParser  protocol.IProtocolParser
+	dataStream             datastream.IDataStreamer
+	commandChannels        channels.ICommandChannels
+	protocolParser         protocol.IProtocolParser
+	protocolParserProducer protocol.IProtocolParserProducer
+	version                uint16
+	capabilities           protocol.Capability
+	pending                pendingRequests
+	writeMutex             sync.Mutex
+	serverAddr             net.Addr
+	reconnectPolicy        *ReconnectPolicy
+	stateHandler           func(ConnectionState)
+	nickChangeHandler      func(protocol.NickChangedCommand)
+	presenceHandler        func(protocol.PresenceCommand)
+	droppedMessageHandler  func(message interface{})
+	credentials            *protocol.AuthCommand
+	identity               string
+	streamMutex            sync.Mutex
+	closed                 bool
+	closing                chan struct{}
+	heartbeatInterval      time.Duration
+	maxMissedHeartbeats    int
+	missedHeartbeats       int32
+}
+
+var (
+	// ErrUnexpectedResponse is returned when the server answers a request with a wrong command
+	ErrUnexpectedResponse = errors.New("unexpected response")
+	// ErrConnectionClosed is returned to the requests which cannot be answered since the connection is closed
+	ErrConnectionClosed = errors.New("connection closed")
+	// ErrClientClosed is returned when the client is closed while reconnecting
+	ErrClientClosed = errors.New("client closed")
+)
+
+// UndeliveredError is returned by SendMsg when the message could not be passed to some of the recipients,
+// because they are not connected or too slow to take it
+type UndeliveredError struct {
+	MessageID  uint64
+	Recipients []uint64
+}
+
+func (t UndeliveredError) Error() string {
+	return fmt.Sprintf("message %d not delivered to %v", t.MessageID, t.Recipients)
 }
 
 // New is to create new client and return
-func New() *Client {
+func New(options ...Option) *Client {
 	dataStreamerProducer := datastream.TcpDataStreamProducer{}
 	dataStreamer := dataStreamerProducer.Produce()
 
@@ -29,31 +74,206 @@ func New() *Client {
 
 	commandChannelsProducer := channels.CommandChannelsProducer{}
 	commandChannels := commandChannelsProducer.Produce()
-	return &Client{
-		dataStream:      dataStreamer,
-		commandChannels: commandChannels,
-		protocolParser:  protocolParser,
+	cli := &Client{
+		dataStream:             dataStreamer,
+		commandChannels:        commandChannels,
+		protocolParser:         protocolParser,
+		protocolParserProducer: &protocolParserProducer,
+		closing:                make(chan struct{}),
 	}
+
+	for _, option := range options {
+		option(cli)
+	}
+	return cli
 }
 
 // Connect function is to connect to server given serverAddr parameter
-func (cli *Client) Connect(serverAddr *net.TCPAddr) error {
-	tcpDataStreamer, err := cli.dataStream.CreateConnection(serverAddr)
+func (cli *Client) Connect(serverAddr net.Addr) error {
+	return cli.ConnectContext(context.Background(), serverAddr)
+}
+
+// ConnectContext connects to the server like Connect, but gives up when the context is done
+func (cli *Client) ConnectContext(ctx context.Context, serverAddr net.Addr) error {
+	tcpDataStreamer, err := cli.createConnection(ctx, serverAddr)
+	if err != nil {
+		return err
+	}
+	cli.serverAddr = serverAddr
 	cli.dataStream = tcpDataStreamer
 
+	err = cli.handshakeContext(ctx)
 	if err != nil {
 		return err
 	}
 
+	cli.setState(StateConnected)
 	go cli.Start()
 	return nil
 
 }
 
-// Start function is to Start Reading from tcp connection and send the data to related channels
+// createConnection connects to the server with the context if the data streamer supports it
+func (cli *Client) createConnection(ctx context.Context, serverAddr net.Addr) (datastream.IDataStreamer, error) {
+	if contextDataStreamer, ok := cli.dataStream.(datastream.IContextDataStreamer); ok {
+		return contextDataStreamer.CreateConnectionContext(ctx, serverAddr)
+	}
+	return cli.dataStream.CreateConnection(serverAddr)
+}
+
+// handshakeContext runs the handshake and closes the connection if it fails or the context is done
+func (cli *Client) handshakeContext(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.handshake(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			cli.stream().CloseConnection()
+		}
+		return err
+	case <-ctx.Done():
+		// closing the connection stops the handshake waiting for the server
+		cli.stream().CloseConnection()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// handshake sends hello to the server and reads the stream until the welcome comes back,
+// then authenticates if the client has credentials
+func (cli *Client) handshake(ctx context.Context) error {
+	hello := protocol.HelloCommand{Version: protocol.ProtocolVersion, Capabilities: cli.offeredCapabilities()}
+	err := cli.sendMessageToServer(ctx, hello.ToByteArray())
+	if err != nil {
+		return err
+	}
+
+	command, err := cli.readCommand()
+	if err != nil {
+		return err
+	}
+
+	welcome, ok := command.(protocol.WelcomeCommand)
+	if !ok {
+		return protocol.ErrHandshakeRequired
+	}
+	if welcome.Version < protocol.MinProtocolVersion {
+		return protocol.ErrUnsupportedVersion
+	}
+
+	cli.version = welcome.Version
+	cli.capabilities = welcome.Capabilities
+
+	if cli.credentials == nil {
+		return nil
+	}
+	return cli.authenticate(ctx)
+}
+
+// authenticate sends the credentials to the server and reads the stream until the identity comes back
+func (cli *Client) authenticate(ctx context.Context) error {
+	err := cli.sendMessageToServer(ctx, cli.credentials.ToByteArray())
+	if err != nil {
+		return err
+	}
+
+	command, err := cli.readCommand()
+	if err != nil {
+		return err
+	}
+
+	authenticated, ok := command.(protocol.AuthCommand)
+	if !ok {
+		return ErrUnexpectedResponse
+	}
+	cli.identity = authenticated.Identity
+	return nil
+}
+
+// readCommand reads the stream until a command is parsed, rejections of the server are returned as protocol.ErrorCommand.
+// It is only used before Start reads the stream.
+func (cli *Client) readCommand() (interface{}, error) {
+	dataStream := cli.stream()
+	for {
+		data, err := dataStream.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		command, err := cli.protocolParser.ParseStreamedData(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if rejection, ok := command.(protocol.ErrorCommand); ok {
+			return nil, rejection
+		}
+		if command != nil {
+			return command, nil
+		}
+	}
+}
+
+// offeredCapabilities are the capabilities sent in hello, presence events are only asked for if somebody handles them
+func (cli *Client) offeredCapabilities() protocol.Capability {
+	if cli.presenceHandler == nil {
+		return protocol.SupportedCapabilities &^ protocol.CapabilityPresence
+	}
+	return protocol.SupportedCapabilities
+}
+
+// ProtocolVersion returns the protocol version negotiated with the server
+func (cli *Client) ProtocolVersion() uint16 {
+	return cli.version
+}
+
+// Capabilities returns the capabilities negotiated with the server
+func (cli *Client) Capabilities() protocol.Capability {
+	return cli.capabilities
+}
+
+// Identity returns the identity the server authenticated the client as, it is empty if the client has no credentials
+func (cli *Client) Identity() string {
+	return cli.identity
+}
+
+// Start function is to Start Reading from tcp connection and send the data to related channels.
+// If the client has a reconnect policy, it connects to the server again when the connection is lost
+// and keeps reading until the client is closed or the policy gives up.
 func (cli *Client) Start() {
 	for {
-		data, err := cli.dataStream.ReadByte()
+		stopHeartbeat := make(chan struct{})
+		if cli.heartbeatInterval > 0 && cli.capabilities.Has(protocol.CapabilityHeartbeat) {
+			go cli.heartbeat(cli.stream(), stopHeartbeat)
+		}
+
+		cli.read()
+		close(stopHeartbeat)
+
+		// nobody will answer the waiting requests once we stop reading
+		cli.pending.failAll(ErrConnectionClosed)
+		cli.setState(StateDisconnected)
+
+		if cli.reconnectPolicy == nil || cli.isClosed() {
+			return
+		}
+
+		err := cli.reconnect()
+		if err != nil {
+			log.Printf("Cannot reconnect: %v", err)
+			return
+		}
+	}
+}
+
+// read reads the current connection until it is closed
+func (cli *Client) read() {
+	dataStream := cli.stream()
+	for {
+		data, err := dataStream.ReadByte()
 
 		// server is closed, we should close the connection
 		if err == io.EOF {
@@ -65,24 +285,205 @@ func (cli *Client) Start() {
 			break
 		}
 
+		// anything coming from the server shows the connection is alive
+		atomic.StoreInt32(&cli.missedHeartbeats, 0)
+
 		// parse the streamed data to make it meaningful
 		command, err := cli.protocolParser.ParseStreamedData(data)
 
+		// the parser skips the rest of oversized, malformed and unknown frames, so we go on reading like the server
+		// does and a newer server does not disconnect us. The caller waiting for the frame gets the error instead.
+		switch skipped := err.(type) {
+		case protocol.FrameError:
+			log.Printf("Skipped frame from server: %v", err)
+			cli.pending.resolve(skipped.RequestID, err)
+			continue
+		case protocol.UnknownCommandError:
+			log.Printf("Skipped frame from server: %v", err)
+			cli.pending.resolve(skipped.RequestID, err)
+			continue
+		}
+
 		if err != nil {
 			log.Printf("Parse error %v", err)
 			break
 		}
 
+		switch v := command.(type) {
+		case protocol.PingCommand:
+			pong := protocol.PongCommand{}
+			if err := cli.sendMessageToServer(context.Background(), pong.ToByteArray()); err != nil {
+				log.Printf("Cannot answer ping: %v", err)
+			}
+			continue
+		case protocol.PongCommand:
+			continue
+		case protocol.NickChangedCommand:
+			if cli.nickChangeHandler != nil {
+				cli.nickChangeHandler(v)
+			}
+			continue
+		case protocol.PresenceCommand:
+			if cli.presenceHandler != nil {
+				cli.presenceHandler(v)
+			}
+			continue
+		case protocol.GoAwayCommand:
+			// nothing comes after going away, the server waits for us to close the connection
+			log.Printf("Server is going away: %s", v.Reason)
+			dataStream.CloseConnection()
+			return
+		}
+
+		// responses go to the callers waiting for them, responses nobody waits for anymore are dropped
+		if correlated, ok := command.(protocol.ICorrelatedCommand); ok && correlated.CorrelationID() != 0 {
+			if !cli.pending.resolve(correlated.CorrelationID(), command) {
+				log.Printf("Dropping response of unknown request %d", correlated.CorrelationID())
+			}
+			continue
+		}
+
 		// if command is not nil, then we have a comlete command object, send it to the related channels
 		if command != nil {
-			cli.commandChannels.Add(command)
+			if err := cli.commandChannels.Add(command); err == channels.ErrDeliveryQueueFull {
+				cli.dropMessage(command)
+			}
+		}
+	}
+}
+
+// dropMessage reports the message the application did not read in time to the dropped message handler
+func (cli *Client) dropMessage(message interface{}) {
+	log.Printf("Too many unread messages, dropping %T", message)
+	if cli.droppedMessageHandler != nil {
+		cli.droppedMessageHandler(message)
+	}
+}
+
+// heartbeat pings the server every heartbeat interval until stop is closed,
+// the connection is closed if nothing comes from the server for more than max missed heartbeats
+func (cli *Client) heartbeat(dataStream datastream.IDataStreamer, stop <-chan struct{}) {
+	atomic.StoreInt32(&cli.missedHeartbeats, 0)
+
+	ticker := time.NewTicker(cli.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		missed := atomic.AddInt32(&cli.missedHeartbeats, 1)
+		if int(missed) > cli.maxMissedHeartbeats {
+			log.Printf("Server missed %d heartbeats, closing the connection", missed-1)
+			// reading stops once the connection is closed, then the client reconnects if it has a policy
+			dataStream.CloseConnection()
+			return
+		}
+
+		ping := protocol.PingCommand{}
+		if err := cli.sendMessageToServer(context.Background(), ping.ToByteArray()); err != nil {
+			log.Printf("Cannot send ping: %v", err)
+		}
+	}
+}
+
+// reconnect dials the server with the backoff of the reconnect policy until the handshake succeeds
+func (cli *Client) reconnect() error {
+	cli.stream().CloseConnection()
+
+	for attempt := 1; ; attempt++ {
+		cli.setState(StateReconnecting)
+
+		select {
+		case <-time.After(cli.reconnectPolicy.backoff(attempt)):
+		case <-cli.closing:
+			return ErrClientClosed
+		}
+
+		err := cli.redial()
+		if err == ErrClientClosed {
+			return err
+		}
+		if err == nil {
+			cli.pending.reopen()
+			cli.setState(StateConnected)
+			return nil
 		}
+
+		log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+		if cli.reconnectPolicy.exhausted(attempt) {
+			return err
+		}
+	}
+}
+
+// redial creates a new connection to the server and does the handshake on it with a fresh parser,
+// the parser may have stopped in the middle of a frame of the lost connection
+func (cli *Client) redial() error {
+	dataStream, err := cli.stream().CreateConnection(cli.serverAddr)
+	if err != nil {
+		return err
+	}
+
+	err = cli.setStream(dataStream)
+	if err != nil {
+		dataStream.CloseConnection()
+		return err
+	}
+
+	cli.protocolParser = cli.protocolParserProducer.Produce()
+	return cli.handshakeContext(context.Background())
+}
+
+// stream returns the current connection
+func (cli *Client) stream() datastream.IDataStreamer {
+	cli.streamMutex.Lock()
+	defer cli.streamMutex.Unlock()
+
+	return cli.dataStream
+}
+
+// setStream replaces the current connection unless the client is closed
+func (cli *Client) setStream(dataStream datastream.IDataStreamer) error {
+	cli.streamMutex.Lock()
+	defer cli.streamMutex.Unlock()
+
+	if cli.closed {
+		return ErrClientClosed
 	}
+	cli.dataStream = dataStream
+	return nil
+}
+
+// isClosed tells if Close is called
+func (cli *Client) isClosed() bool {
+	cli.streamMutex.Lock()
+	defer cli.streamMutex.Unlock()
+
+	return cli.closed
 }
 
-// Close the connection
+// setState notifies the connection state handler if there is one
+func (cli *Client) setState(state ConnectionState) {
+	if cli.stateHandler != nil {
+		cli.stateHandler(state)
+	}
+}
+
+// Close the connection, the client does not reconnect after it is closed
 func (cli *Client) Close() error {
-	err := cli.dataStream.CloseConnection()
+	cli.streamMutex.Lock()
+	if !cli.closed && cli.closing != nil {
+		close(cli.closing)
+	}
+	cli.closed = true
+	dataStream := cli.dataStream
+	cli.streamMutex.Unlock()
+
+	err := dataStream.CloseConnection()
 	if err != nil {
 		log.Printf("cannot close: %v", err)
 		return err
@@ -92,46 +493,483 @@ func (cli *Client) Close() error {
 
 // WhoAmI function is to get the client id from the server
 func (cli *Client) WhoAmI() (uint64, error) {
-	command := protocol.QueryCommand{}
-	// send a whoami message to the server then wait for response to come to the channel
-	err := cli.sendMessageToServer(command.CreateQueryCommand(protocol.CommandTypeWhoAmI))
+	return cli.WhoAmIContext(context.Background())
+}
+
+// WhoAmIContext gets the client id like WhoAmI, but stops waiting for the server when the context is done
+func (cli *Client) WhoAmIContext(ctx context.Context) (uint64, error) {
+	// send a whoami message to the server then wait for the response of this request
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.QueryCommand{RequestID: requestID}
+		return command.CreateQueryCommand(protocol.CommandTypeWhoAmI)
+	})
 	if err != nil {
 		return 0, err
 	}
-	cmdResponse, err := cli.commandChannels.Get(protocol.CommandTypeWhoAmI)
-	if err != nil {
-		return 0, err
+
+	whoAmI, ok := cmdResponse.(protocol.WhoAmICommand)
+	if !ok {
+		return 0, ErrUnexpectedResponse
 	}
-	clientID := cmdResponse.(protocol.WhoAmICommand).ClientID
-	return clientID, nil
+	return whoAmI.ClientID, nil
 }
 
 // ListClientIDs function is to get current connected clients' ids from the server
 func (cli *Client) ListClientIDs() ([]uint64, error) {
-	command := protocol.QueryCommand{}
-	// send a listClients message to the server then wait for response to come to the channel
-	err := cli.sendMessageToServer(command.CreateQueryCommand(protocol.CommandTypeListClients))
+	return cli.ListClientIDsContext(context.Background())
+}
+
+// ListClientIDsContext gets the connected clients like ListClientIDs, but stops waiting for the server when the context is done
+func (cli *Client) ListClientIDsContext(ctx context.Context) ([]uint64, error) {
+	// send a listClients message to the server then wait for the response of this request
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.QueryCommand{RequestID: requestID}
+		return command.CreateQueryCommand(protocol.CommandTypeListClients)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listClients, ok := cmdResponse.(protocol.ListClientsCommand)
+	if !ok {
+		return nil, ErrUnexpectedResponse
+	}
+	return listClients.ConnectedClients, nil
+}
+
+// roundTrip sends the command created for a new request id and waits for the response with the same id.
+// Rejections of the server are returned as protocol.ErrorCommand. If the context is done first,
+// the request is forgotten and its response will be dropped when it comes.
+func (cli *Client) roundTrip(ctx context.Context, createCommand func(requestID uint32) []byte) (interface{}, error) {
+	requestID, responseChannel, err := cli.pending.add()
 	if err != nil {
 		return nil, err
 	}
-	cmdResponse, err := cli.commandChannels.Get(protocol.CommandTypeListClients)
+
+	err = cli.sendMessageToServer(ctx, createCommand(requestID))
 	if err != nil {
+		cli.pending.remove(requestID)
 		return nil, err
 	}
-	connectedClients := cmdResponse.(protocol.ListClientsCommand).ConnectedClients
-	return connectedClients, nil
+
+	select {
+	case response := <-responseChannel:
+		switch v := response.(type) {
+		case protocol.ErrorCommand:
+			return nil, v
+		case error:
+			return nil, v
+		}
+		return response, nil
+	case <-ctx.Done():
+		cli.pending.remove(requestID)
+		return nil, ctx.Err()
+	}
 }
 
-// SendMsg function is to Send messages to the other connected clients
+// SendMsg function is to Send messages to the other connected clients. It waits for the server to pass the message,
+// the recipients it could not be passed to are returned as UndeliveredError
 func (cli *Client) SendMsg(recipients []uint64, body []byte) error {
-	command := protocol.SendMessageCommand{Recipients: recipients, Body: body}
-	err := cli.sendMessageToServer(command.ToByteArray())
+	return cli.SendMsgContext(context.Background(), recipients, body)
+}
+
+// SendMsgContext sends the message like SendMsg, but stops waiting for the server when the context is done
+func (cli *Client) SendMsgContext(ctx context.Context, recipients []uint64, body []byte) error {
+	result, err := cli.SendMsgWithResultContext(ctx, recipients, body)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Failed) > 0 {
+		return UndeliveredError{MessageID: result.MessageID, Recipients: result.Failed}
+	}
+	return nil
+}
+
+// SendMsgWithResult function is to send the message like SendMsg, but it waits for the server to tell the id of the
+// message and which recipients the message is delivered to. Unknown recipients are listed as failed, not returned as error.
+func (cli *Client) SendMsgWithResult(recipients []uint64, body []byte) (protocol.SendResultCommand, error) {
+	return cli.SendMsgWithResultContext(context.Background(), recipients, body)
+}
+
+// SendMsgWithResultContext sends the message like SendMsgWithResult, but stops waiting for the server when the context is done
+func (cli *Client) SendMsgWithResultContext(ctx context.Context, recipients []uint64, body []byte) (protocol.SendResultCommand, error) {
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.SendMessageCommand{RequestID: requestID, Recipients: recipients, Body: body}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return protocol.SendResultCommand{}, err
+	}
+
+	result, ok := cmdResponse.(protocol.SendResultCommand)
+	if !ok {
+		return protocol.SendResultCommand{}, ErrUnexpectedResponse
+	}
+	return result, nil
+}
+
+// SendMsgToNick function is to send a message to the client with the nick. If nobody has the nick, a server
+// with a mailbox keeps the message until a client takes the nick. It waits for the server to pass or keep the message,
+// a rejection is returned as protocol.ErrorCommand.
+func (cli *Client) SendMsgToNick(nick string, body []byte) error {
+	return cli.SendMsgToNickContext(context.Background(), nick, body)
+}
+
+// SendMsgToNickContext sends the message like SendMsgToNick, but stops waiting for the server when the context is done
+func (cli *Client) SendMsgToNickContext(ctx context.Context, nick string, body []byte) error {
+	if err := protocol.ValidateNick(nick); err != nil {
+		return err
+	}
+
+	return cli.send(ctx, func(requestID uint32) []byte {
+		command := protocol.SendToNickCommand{RequestID: requestID, Nick: nick, Body: body}
+		return command.ToByteArray()
+	})
+}
+
+// send sends the message of a new request and waits for the server to accept it, the rejection is returned
+// as protocol.ErrorCommand
+func (cli *Client) send(ctx context.Context, createCommand func(requestID uint32) []byte) error {
+	cmdResponse, err := cli.roundTrip(ctx, createCommand)
 	if err != nil {
 		return err
 	}
+
+	if _, ok := cmdResponse.(protocol.SendResultCommand); !ok {
+		return ErrUnexpectedResponse
+	}
 	return nil
 }
 
+// Broadcast function is to send a message to all the other connected clients without listing them first.
+// It does not wait for the server, the other clients get the message as protocol.MessageFromClient
+func (cli *Client) Broadcast(body []byte) error {
+	return cli.BroadcastContext(context.Background(), body)
+}
+
+// BroadcastContext sends the message like Broadcast, but gives up if the context is done before the message is written
+func (cli *Client) BroadcastContext(ctx context.Context, body []byte) error {
+	command := protocol.BroadcastCommand{Body: body}
+	return cli.sendMessageToServer(ctx, command.ToByteArray())
+}
+
+// JoinRoom function is to join the room, the messages sent to the room are received after it returns
+func (cli *Client) JoinRoom(room string) error {
+	return cli.JoinRoomContext(context.Background(), room)
+}
+
+// JoinRoomContext joins the room like JoinRoom, but stops waiting for the server when the context is done
+func (cli *Client) JoinRoomContext(ctx context.Context, room string) error {
+	if err := protocol.ValidateRoomName(room); err != nil {
+		return err
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.JoinRoomCommand{RequestID: requestID, Room: room}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cmdResponse.(protocol.JoinRoomCommand); !ok {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// LeaveRoom function is to leave the room
+func (cli *Client) LeaveRoom(room string) error {
+	return cli.LeaveRoomContext(context.Background(), room)
+}
+
+// LeaveRoomContext leaves the room like LeaveRoom, but stops waiting for the server when the context is done
+func (cli *Client) LeaveRoomContext(ctx context.Context, room string) error {
+	if err := protocol.ValidateRoomName(room); err != nil {
+		return err
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.LeaveRoomCommand{RequestID: requestID, Room: room}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cmdResponse.(protocol.LeaveRoomCommand); !ok {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// ListRooms function is to get the rooms which have members from the server
+func (cli *Client) ListRooms() ([]string, error) {
+	return cli.ListRoomsContext(context.Background())
+}
+
+// ListRoomsContext gets the rooms like ListRooms, but stops waiting for the server when the context is done
+func (cli *Client) ListRoomsContext(ctx context.Context) ([]string, error) {
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.QueryCommand{RequestID: requestID}
+		return command.CreateQueryCommand(protocol.CommandTypeListRooms)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listRooms, ok := cmdResponse.(protocol.ListRoomsCommand)
+	if !ok {
+		return nil, ErrUnexpectedResponse
+	}
+	return listRooms.Rooms, nil
+}
+
+// SendRoomMsg function is to send a message to the other members of a room the client joined.
+// It waits for the server to pass the message, a rejection is returned as protocol.ErrorCommand.
+func (cli *Client) SendRoomMsg(room string, body []byte) error {
+	return cli.SendRoomMsgContext(context.Background(), room, body)
+}
+
+// SendRoomMsgContext sends the room message like SendRoomMsg, but stops waiting for the server when the context is done
+func (cli *Client) SendRoomMsgContext(ctx context.Context, room string, body []byte) error {
+	if err := protocol.ValidateRoomName(room); err != nil {
+		return err
+	}
+
+	return cli.send(ctx, func(requestID uint32) []byte {
+		command := protocol.RoomMessageCommand{RequestID: requestID, Room: room, Body: body}
+		return command.ToByteArray()
+	})
+}
+
+// HandleIncomingRoomMessages function is to get messages sent to the rooms of the client and push them to the channel
+func (cli *Client) HandleIncomingRoomMessages(writeCh chan<- protocol.RoomMessageCommand) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("run time panic: %v", err)
+		}
+	}()
+	for {
+		message, err := cli.commandChannels.Get(protocol.CommandTypeRoomMessage)
+		if err != nil {
+			log.Printf("Cannot get room message: %v", err)
+			break
+		}
+		writeCh <- message.(protocol.RoomMessageCommand)
+	}
+}
+
+// SetNick function is to set the nick the other clients see, it fails if another client uses the nick
+func (cli *Client) SetNick(nick string) error {
+	return cli.SetNickContext(context.Background(), nick)
+}
+
+// SetNickContext sets the nick like SetNick, but stops waiting for the server when the context is done
+func (cli *Client) SetNickContext(ctx context.Context, nick string) error {
+	if err := protocol.ValidateNick(nick); err != nil {
+		return err
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.SetNickCommand{RequestID: requestID, Nick: nick}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cmdResponse.(protocol.SetNickCommand); !ok {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// LookupNick function is to get the id of the client with the nick
+func (cli *Client) LookupNick(nick string) (uint64, error) {
+	return cli.LookupNickContext(context.Background(), nick)
+}
+
+// LookupNickContext gets the id like LookupNick, but stops waiting for the server when the context is done
+func (cli *Client) LookupNickContext(ctx context.Context, nick string) (uint64, error) {
+	if err := protocol.ValidateNick(nick); err != nil {
+		return 0, err
+	}
+
+	lookup, err := cli.lookup(ctx, protocol.LookupCommand{Nick: nick})
+	if err != nil {
+		return 0, err
+	}
+	return lookup.ClientID, nil
+}
+
+// LookupID function is to get the nick of the client with the id, the nick is empty if the client has not set one
+func (cli *Client) LookupID(clientID uint64) (string, error) {
+	return cli.LookupIDContext(context.Background(), clientID)
+}
+
+// LookupIDContext gets the nick like LookupID, but stops waiting for the server when the context is done
+func (cli *Client) LookupIDContext(ctx context.Context, clientID uint64) (string, error) {
+	lookup, err := cli.lookup(ctx, protocol.LookupCommand{ClientID: clientID})
+	if err != nil {
+		return "", err
+	}
+	return lookup.Nick, nil
+}
+
+func (cli *Client) lookup(ctx context.Context, query protocol.LookupCommand) (protocol.LookupCommand, error) {
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		query.RequestID = requestID
+		return query.ToByteArray()
+	})
+	if err != nil {
+		return protocol.LookupCommand{}, err
+	}
+
+	lookup, ok := cmdResponse.(protocol.LookupCommand)
+	if !ok {
+		return protocol.LookupCommand{}, ErrUnexpectedResponse
+	}
+	return lookup, nil
+}
+
+// ListUsers function is to get the other connected clients with their nicks, like ListClientIDs gets their ids
+func (cli *Client) ListUsers() ([]protocol.User, error) {
+	return cli.ListUsersContext(context.Background())
+}
+
+// ListUsersContext gets the users like ListUsers, but stops waiting for the server when the context is done
+func (cli *Client) ListUsersContext(ctx context.Context) ([]protocol.User, error) {
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.QueryCommand{RequestID: requestID}
+		return command.CreateQueryCommand(protocol.CommandTypeListUsers)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listUsers, ok := cmdResponse.(protocol.ListUsersCommand)
+	if !ok {
+		return nil, ErrUnexpectedResponse
+	}
+	return listUsers.Users, nil
+}
+
+// History function is to scroll back the messages the client sent or received, newest first. It returns a page
+// of the messages matching the query and the cursor of the next page, which is zero if there are no older messages.
+// Pass the cursor as query.Before to get the next page.
+func (cli *Client) History(query protocol.HistoryQuery) ([]protocol.HistoryMessage, uint64, error) {
+	return cli.HistoryContext(context.Background(), query)
+}
+
+// HistoryContext gets the history like History, but stops waiting for the server when the context is done
+func (cli *Client) HistoryContext(ctx context.Context, query protocol.HistoryQuery) ([]protocol.HistoryMessage, uint64, error) {
+	if query.Room != "" {
+		if err := protocol.ValidateRoomName(query.Room); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.HistoryCommand{RequestID: requestID, Query: query}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	history, ok := cmdResponse.(protocol.HistoryCommand)
+	if !ok {
+		return nil, 0, ErrUnexpectedResponse
+	}
+	return history.Messages, history.Next, nil
+}
+
+// Subscribe function is to subscribe to the topics matching the pattern, like alerts.*.
+// The messages published to the matching topics are received after it returns
+func (cli *Client) Subscribe(pattern string) error {
+	return cli.SubscribeContext(context.Background(), pattern)
+}
+
+// SubscribeContext subscribes like Subscribe, but stops waiting for the server when the context is done
+func (cli *Client) SubscribeContext(ctx context.Context, pattern string) error {
+	if err := protocol.ValidateTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.SubscribeCommand{RequestID: requestID, Pattern: pattern}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cmdResponse.(protocol.SubscribeCommand); !ok {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// Unsubscribe function is to remove a subscription made by Subscribe with the same pattern
+func (cli *Client) Unsubscribe(pattern string) error {
+	return cli.UnsubscribeContext(context.Background(), pattern)
+}
+
+// UnsubscribeContext unsubscribes like Unsubscribe, but stops waiting for the server when the context is done
+func (cli *Client) UnsubscribeContext(ctx context.Context, pattern string) error {
+	if err := protocol.ValidateTopicPattern(pattern); err != nil {
+		return err
+	}
+
+	cmdResponse, err := cli.roundTrip(ctx, func(requestID uint32) []byte {
+		command := protocol.UnsubscribeCommand{RequestID: requestID, Pattern: pattern}
+		return command.ToByteArray()
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cmdResponse.(protocol.UnsubscribeCommand); !ok {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// Publish function is to send a message to the other clients subscribed to the topic.
+// It does not wait for the server, having no subscribers is not an error
+func (cli *Client) Publish(topic string, body []byte) error {
+	return cli.PublishContext(context.Background(), topic, body)
+}
+
+// PublishContext publishes the message like Publish, but gives up if the context is done before the message is written
+func (cli *Client) PublishContext(ctx context.Context, topic string, body []byte) error {
+	if err := protocol.ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	command := protocol.PublishCommand{Topic: topic, Body: body}
+	return cli.sendMessageToServer(ctx, command.ToByteArray())
+}
+
+// HandleIncomingTopicMessages function is to get messages published to the subscribed topics and push them to the channel
+func (cli *Client) HandleIncomingTopicMessages(writeCh chan<- protocol.TopicMessageCommand) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("run time panic: %v", err)
+		}
+	}()
+	for {
+		message, err := cli.commandChannels.Get(protocol.CommandTypeTopicMessage)
+		if err != nil {
+			log.Printf("Cannot get topic message: %v", err)
+			break
+		}
+		writeCh <- message.(protocol.TopicMessageCommand)
+	}
+}
+
 // HandleIncomingMessages function is to get messages from the other clients and push it to the channels
 func (cli *Client) HandleIncomingMessages(writeCh chan<- protocol.MessageFromClient) {
 	defer func() {
@@ -150,13 +988,28 @@ func (cli *Client) HandleIncomingMessages(writeCh chan<- protocol.MessageFromCli
 
 }
 
-func (cli *Client) sendMessageToServer(data []byte) error {
-	_, err := cli.dataStream.Write(data)
+// sendMessageToServer writes the data unless the context is done before it is its turn to write,
+// once the writing starts it is not interrupted
+func (cli *Client) sendMessageToServer(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// commands of different goroutines should not be mixed in the stream
+	cli.writeMutex.Lock()
+	defer cli.writeMutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dataStream := cli.stream()
+	_, err := dataStream.Write(data)
 	if err != nil {
 		return err
 	}
 
-	err = cli.dataStream.Flush()
+	err = dataStream.Flush()
 	if err != nil {
 		return err
 	}
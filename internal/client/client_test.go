@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -27,8 +28,19 @@ var (
 		Recipients: []uint64{uint64(1)},
 		Body:       []byte("hello"),
 	}
+	fakeWelcomeCommand = protocol.WelcomeCommand{
+		Version:      protocol.ProtocolVersion,
+		Capabilities: protocol.SupportedCapabilities,
+	}
 )
 
+// expectFrame makes the fake data streamer return the given frame byte by byte
+func expectFrame(fakeDataStreamer *datastream.MockTcpDataStream, frame []byte) {
+	for i := 0; i < len(frame); i++ {
+		fakeDataStreamer.On("ReadByte").Return(frame[i], nil).Once()
+	}
+}
+
 func TestNewMethodShouldCreateNewClientInstance(t *testing.T) {
 	client := New()
 	assert.NotNil(t, client)
@@ -41,11 +53,64 @@ func TestConnectShouldReturnNoError(t *testing.T) {
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
 
 	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeHello))
+	}).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	expectFrame(fakeDataStreamer, fakeWelcomeCommand.ToByteArray())
 	fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Maybe()
 	client := New()
 	client.dataStream = fakeDataStreamer
 	response := client.Connect(&fakeAddress)
 	assert.Nil(t, response)
+	assert.Equal(t, fakeWelcomeCommand.Version, client.ProtocolVersion())
+	assert.Equal(t, fakeWelcomeCommand.Capabilities, client.Capabilities())
+}
+
+func TestConnectShouldReturnErrorIfHandshakeIsNotAnswered(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	expectFrame(fakeDataStreamer, fakeWhoAmICommand.ToByteArray())
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	client := New()
+	client.dataStream = fakeDataStreamer
+	response := client.Connect(&fakeAddress)
+	assert.Equal(t, protocol.ErrHandshakeRequired, response)
+}
+
+func TestConnectShouldReturnServerErrorIfHandshakeIsRejected(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	rejection := protocol.ErrorCommand{Code: protocol.ErrorCodeUnsupportedVersion, RefCommandType: protocol.CommandTypeHello}
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	expectFrame(fakeDataStreamer, rejection.ToByteArray())
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	client := New()
+	client.dataStream = fakeDataStreamer
+	response := client.Connect(&fakeAddress)
+	assert.Equal(t, rejection, response)
+}
+
+func TestConnectShouldReturnErrorIfConnectionClosedDuringHandshake(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	client := New()
+	client.dataStream = fakeDataStreamer
+	response := client.Connect(&fakeAddress)
+	assert.Equal(t, io.EOF, response)
 }
 
 func TestConnectShouldReturnErrorIfErrorOccured(t *testing.T) {
@@ -162,6 +227,63 @@ func TestStartFunctionShouldCallParseFunctionIfNoErrorReturnReadErrorIfCannotPar
 	client.Start()
 }
 
+func TestStartFunctionShouldSkipUnknownAndRejectedFramesOfTheServer(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	unknown := protocol.UnknownCommandError{CommandType: protocol.CommandType(63)}
+	tooLarge := protocol.FrameError{RequestID: 1, CommandType: protocol.CommandTypeListClients, Err: protocol.ErrFrameTooLarge}
+	fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Times(3)
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(nil, unknown).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(nil, tooLarge).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeWhoAmICommand, nil).Once()
+	fakeCommandChannels.On("Add", fakeWhoAmICommand).Return(nil).Once()
+
+	client := New()
+	client.commandChannels = fakeCommandChannels
+	client.dataStream = fakeDataStreamer
+	client.protocolParser = fakeProtocolParser
+	requestID, response, err := client.pending.add()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), requestID)
+
+	client.Start()
+
+	// the waiting request gets the rejection of its frame, and the frames after it are still read
+	assert.Equal(t, tooLarge, <-response)
+	fakeDataStreamer.AssertExpectations(t)
+	fakeProtocolParser.AssertExpectations(t)
+	fakeCommandChannels.AssertExpectations(t)
+}
+
+func TestStartFunctionShouldReportMessagesTheApplicationDoesNotReadInTime(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Once()
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeMessageFromClientCommand, nil).Once()
+	fakeCommandChannels.On("Add", fakeMessageFromClientCommand).Return(channels.ErrDeliveryQueueFull).Once()
+
+	var dropped []interface{}
+	client := New(WithDroppedMessageHandler(func(message interface{}) {
+		dropped = append(dropped, message)
+	}))
+	client.commandChannels = fakeCommandChannels
+	client.dataStream = fakeDataStreamer
+	client.protocolParser = fakeProtocolParser
+
+	client.Start()
+
+	assert.Equal(t, []interface{}{fakeMessageFromClientCommand}, dropped)
+	fakeCommandChannels.AssertExpectations(t)
+}
+
 func TestCloseFunctionShouldReturnNoError(t *testing.T) {
 
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
@@ -196,18 +318,19 @@ func TestWhoAmIFunctionShouldReturnID(t *testing.T) {
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 
-	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
-	fakeDataStreamer.On("Flush").Return(nil)
-	fakeCommandChannels.On("Get", mock.Anything).Return(fakeWhoAmICommand, nil).Run(func(args mock.Arguments) {
-		assert.Equal(t, args.Get(0), protocol.CommandTypeWhoAmI)
-	})
-
 	client := &Client{
 		commandChannels: fakeCommandChannels,
 		dataStream:      fakeDataStreamer,
 		protocolParser:  fakeProtocolParser,
 	}
 
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWhoAmI)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.WhoAmICommand{RequestID: 1, ClientID: fakeWhoAmICommand.ClientID}))
+	})
+
 	response, err := client.WhoAmI()
 	assert.Equal(t, response, fakeWhoAmICommand.ClientID)
 	assert.Equal(t, err, nil)
@@ -254,28 +377,26 @@ func TestWhoAmIFunctionShouldReturnErrorIfFlushReturnError(t *testing.T) {
 	assert.Equal(t, err, fakeWriteError)
 }
 
-func TestWhoAmIFunctionShouldReturnErrorIfGetReturnError(t *testing.T) {
+func TestWhoAmIFunctionShouldReturnErrorIfResponseIsUnexpected(t *testing.T) {
 
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 
-	fakeGetError := errors.New("get error")
-	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
-	fakeDataStreamer.On("Flush").Return(nil)
-	fakeCommandChannels.On("Get", mock.Anything).Return(nil, fakeGetError).Run(func(args mock.Arguments) {
-		assert.Equal(t, args.Get(0), protocol.CommandTypeWhoAmI)
-	})
-
 	client := &Client{
 		commandChannels: fakeCommandChannels,
 		dataStream:      fakeDataStreamer,
 		protocolParser:  fakeProtocolParser,
 	}
 
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.ListClientsCommand{RequestID: 1}))
+	})
+
 	response, err := client.WhoAmI()
 	assert.Equal(t, uint64(0), response)
-	assert.Equal(t, err, fakeGetError)
+	assert.Equal(t, err, ErrUnexpectedResponse)
 }
 
 func TestListClientIDsFunctionShouldReturnConnectedClients(t *testing.T) {
@@ -284,18 +405,19 @@ func TestListClientIDsFunctionShouldReturnConnectedClients(t *testing.T) {
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 
-	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
-	fakeDataStreamer.On("Flush").Return(nil)
-	fakeCommandChannels.On("Get", mock.Anything).Return(fakeConnectedClientsCommand, nil).Run(func(args mock.Arguments) {
-		assert.Equal(t, args.Get(0), protocol.CommandTypeListClients)
-	})
-
 	client := &Client{
 		commandChannels: fakeCommandChannels,
 		dataStream:      fakeDataStreamer,
 		protocolParser:  fakeProtocolParser,
 	}
 
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeListClients)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.ListClientsCommand{RequestID: 1, ConnectedClients: fakeConnectedClientsCommand.ConnectedClients}))
+	})
+
 	response, err := client.ListClientIDs()
 	assert.Equal(t, response, fakeConnectedClientsCommand.ConnectedClients)
 	assert.Equal(t, err, nil)
@@ -342,28 +464,27 @@ func TestListClientsFunctionShouldReturnErrorIfFlushReturnError(t *testing.T) {
 	assert.Equal(t, err, fakeWriteError)
 }
 
-func TestListClientsFunctionShouldReturnErrorIfGetReturnError(t *testing.T) {
+func TestListClientsFunctionShouldReturnServerError(t *testing.T) {
 
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 
-	fakeGetError := errors.New("get error")
-	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
-	fakeDataStreamer.On("Flush").Return(nil)
-	fakeCommandChannels.On("Get", mock.Anything).Return(nil, fakeGetError).Run(func(args mock.Arguments) {
-		assert.Equal(t, args.Get(0), protocol.CommandTypeListClients)
-	})
-
 	client := &Client{
 		commandChannels: fakeCommandChannels,
 		dataStream:      fakeDataStreamer,
 		protocolParser:  fakeProtocolParser,
 	}
 
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeUnknownCommand, RefCommandType: protocol.CommandTypeListClients}
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
 	response, err := client.ListClientIDs()
 	assert.Nil(t, response)
-	assert.Equal(t, err, fakeGetError)
+	assert.Equal(t, rejection, err)
 }
 
 func TestSendMsgFunctionShouldSendMessageToServer(t *testing.T) {
@@ -372,19 +493,101 @@ func TestSendMsgFunctionShouldSendMessageToServer(t *testing.T) {
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 
-	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
-	fakeDataStreamer.On("Flush").Return(nil)
-
 	client := &Client{
 		commandChannels: fakeCommandChannels,
 		dataStream:      fakeDataStreamer,
 		protocolParser:  fakeProtocolParser,
 	}
 
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.SendResultCommand{RequestID: 1, MessageID: 1, Delivered: []uint64{1}}))
+	})
+
 	err := client.SendMsg([]uint64{uint64(1)}, []byte("message"))
 	assert.Equal(t, err, nil)
 }
 
+func TestSendMsgFunctionShouldReturnUndeliveredRecipientsOfItsOwnMessage(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.SendResultCommand{RequestID: 1, MessageID: 4, Delivered: []uint64{1}, Failed: []uint64{99}}))
+	}).Once()
+
+	err := client.SendMsg([]uint64{1, 99}, []byte("message"))
+	assert.Equal(t, UndeliveredError{MessageID: 4, Recipients: []uint64{99}}, err)
+
+	// the next message gets its own result, not the failure of the earlier one
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(2, protocol.SendResultCommand{RequestID: 2, MessageID: 5, Delivered: []uint64{1}}))
+	}).Once()
+
+	err = client.SendMsg([]uint64{1}, []byte("message"))
+	assert.Nil(t, err)
+}
+
+func TestWhoAmIFunctionShouldReturnServerError(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeUnknownCommand, RefCommandType: protocol.CommandTypeWhoAmI}
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
+	response, err := client.WhoAmI()
+	assert.Equal(t, uint64(0), response)
+	assert.Equal(t, rejection, err)
+}
+
+func TestStartFunctionShouldRouteResponsesToTheirRequests(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+	firstRequestID, firstResponse, _ := client.pending.add()
+	secondRequestID, secondResponse, _ := client.pending.add()
+
+	// responses come in reverse order, and a response nobody waits for is dropped
+	fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Times(3)
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(protocol.ListClientsCommand{RequestID: secondRequestID, ConnectedClients: []uint64{2}}, nil).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(protocol.ListClientsCommand{RequestID: 99}, nil).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(protocol.ListClientsCommand{RequestID: firstRequestID, ConnectedClients: []uint64{1}}, nil).Once()
+
+	client.Start()
+
+	assert.Equal(t, protocol.ListClientsCommand{RequestID: firstRequestID, ConnectedClients: []uint64{1}}, <-firstResponse)
+	assert.Equal(t, protocol.ListClientsCommand{RequestID: secondRequestID, ConnectedClients: []uint64{2}}, <-secondResponse)
+	fakeCommandChannels.AssertNotCalled(t, "Add", mock.Anything)
+}
+
 func TestSendMessageFunctionShouldReturnErrorIfWriteReturnError(t *testing.T) {
 
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
@@ -463,3 +666,771 @@ func TestHandleIncomingMsgShouldBeRecoveredIfErrorOccur(t *testing.T) {
 	go client.HandleIncomingMessages(incomingChan)
 	time.Sleep(20 * time.Millisecond) // to ensure above routine started
 }
+
+func TestWhoAmIContextShouldStopWaitingWhenContextIsDone(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	response, err := client.WhoAmIContext(ctx)
+	assert.Equal(t, uint64(0), response)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// late response should not be delivered to anybody
+	assert.False(t, client.pending.resolve(1, protocol.WhoAmICommand{RequestID: 1, ClientID: 1}))
+	assert.Empty(t, client.pending.requests)
+}
+
+func TestListClientIDsContextShouldNotSendIfContextIsDone(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response, err := client.ListClientIDsContext(ctx)
+	assert.Nil(t, response)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, client.pending.requests)
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestSendMsgContextShouldNotSendIfContextIsDone(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := client.SendMsgContext(ctx, []uint64{uint64(1)}, []byte("message"))
+	assert.Equal(t, context.Canceled, err)
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestRequestsShouldFailWhenConnectionIsClosed(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+		protocolParser:  fakeProtocolParser,
+	}
+	_, waitingResponse, _ := client.pending.add()
+
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	client.Start()
+
+	assert.Equal(t, ErrConnectionClosed, <-waitingResponse)
+
+	response, err := client.WhoAmI()
+	assert.Equal(t, uint64(0), response)
+	assert.Equal(t, ErrConnectionClosed, err)
+}
+
+func TestConnectContextShouldStopHandshakeWhenContextIsDone(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	closed := make(chan time.Time)
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Run(func(args mock.Arguments) {
+		close(closed)
+	}).Once()
+	// server never answers, reading is blocked until the connection is closed
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).WaitUntil(closed).Once()
+
+	client := New()
+	client.dataStream = fakeDataStreamer
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	response := client.ConnectContext(ctx, &fakeAddress)
+	assert.Equal(t, context.DeadlineExceeded, response)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestNewShouldApplyOptions(t *testing.T) {
+	policy := DefaultReconnectPolicy()
+	client := New(WithReconnect(policy), WithConnectionStateHandler(func(ConnectionState) {}))
+	assert.Equal(t, &policy, client.reconnectPolicy)
+	assert.NotNil(t, client.stateHandler)
+}
+
+func TestStartShouldReconnectWhenConnectionIsLost(t *testing.T) {
+
+	firstDataStreamer := new(datastream.MockTcpDataStream)
+	secondDataStreamer := new(datastream.MockTcpDataStream)
+	var states []ConnectionState
+
+	client := New(
+		WithReconnect(ReconnectPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: 2}),
+		WithConnectionStateHandler(func(state ConnectionState) {
+			states = append(states, state)
+		}),
+	)
+	client.dataStream = firstDataStreamer
+	client.serverAddr = &fakeAddress
+	// the lost connection stopped in the middle of a frame, the new connection should not continue it
+	client.protocolParser.ParseStreamedData(byte(protocol.CommandTypeWhoAmI))
+	client.pending.failAll(ErrConnectionClosed)
+
+	firstDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	firstDataStreamer.On("CloseConnection").Return(nil).Once()
+	firstDataStreamer.On("CreateConnection", &fakeAddress).Return(firstDataStreamer, errors.New("cannot connect")).Once()
+	firstDataStreamer.On("CreateConnection", &fakeAddress).Return(secondDataStreamer, nil).Once()
+
+	secondDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, byte(protocol.CommandTypeHello), args.Get(0).([]byte)[0])
+	}).Once()
+	secondDataStreamer.On("Flush").Return(nil).Once()
+	expectFrame(secondDataStreamer, fakeWelcomeCommand.ToByteArray())
+	secondDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	secondDataStreamer.On("CloseConnection").Return(nil).Once()
+	secondDataStreamer.On("CreateConnection", &fakeAddress).Return(secondDataStreamer, errors.New("cannot connect")).Twice()
+
+	client.Start()
+
+	assert.Equal(t, []ConnectionState{
+		StateDisconnected, StateReconnecting, StateReconnecting, StateConnected,
+		StateDisconnected, StateReconnecting, StateReconnecting,
+	}, states)
+	firstDataStreamer.AssertExpectations(t)
+	secondDataStreamer.AssertExpectations(t)
+}
+
+func TestStartShouldNotReconnectAfterClose(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := New(WithReconnect(DefaultReconnectPolicy()))
+	client.dataStream = fakeDataStreamer
+
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+
+	assert.Nil(t, client.Close())
+	client.Start()
+
+	fakeDataStreamer.AssertNotCalled(t, "CreateConnection", mock.Anything)
+}
+
+func TestReconnectShouldStopWaitingWhenClientIsClosed(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := New(WithReconnect(ReconnectPolicy{InitialBackoff: time.Hour}))
+	client.dataStream = fakeDataStreamer
+
+	fakeDataStreamer.On("CloseConnection").Return(nil)
+
+	done := make(chan error)
+	go func() {
+		done <- client.reconnect()
+	}()
+	time.Sleep(20 * time.Millisecond) // to ensure above routine started waiting
+	client.Close()
+
+	assert.Equal(t, ErrClientClosed, <-done)
+	fakeDataStreamer.AssertNotCalled(t, "CreateConnection", mock.Anything)
+}
+
+func TestReconnectPolicyBackoffShouldGrowUpToMaxBackoff(t *testing.T) {
+	policy := ReconnectPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, policy.backoff(4))
+	assert.Equal(t, time.Second, policy.backoff(5))
+	assert.Equal(t, time.Second, policy.backoff(1000))
+}
+
+func TestReconnectPolicyBackoffShouldBeRandomizedByJitter(t *testing.T) {
+	policy := ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: time.Second, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(1)
+		assert.True(t, backoff > 500*time.Millisecond && backoff <= time.Second)
+	}
+}
+
+func TestReconnectPolicyShouldBeExhaustedAfterMaxAttempts(t *testing.T) {
+	policy := ReconnectPolicy{MaxAttempts: 3}
+	assert.False(t, policy.exhausted(2))
+	assert.True(t, policy.exhausted(3))
+
+	policy = ReconnectPolicy{}
+	assert.False(t, policy.exhausted(1000))
+}
+
+func TestStartShouldAnswerPingWithPong(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+	client := New()
+	client.dataStream = fakeDataStreamer
+	client.commandChannels = fakeCommandChannels
+
+	ping := protocol.PingCommand{}
+	pong := protocol.PongCommand{}
+	expectFrame(fakeDataStreamer, ping.ToByteArray())
+	expectFrame(fakeDataStreamer, pong.ToByteArray())
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+	fakeDataStreamer.On("Write", pong.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+
+	client.Start()
+
+	fakeDataStreamer.AssertExpectations(t)
+	fakeCommandChannels.AssertNotCalled(t, "Add", mock.Anything)
+}
+
+func TestHeartbeatShouldCloseConnectionIfServerMissesHeartbeats(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := New(WithHeartbeat(time.Millisecond, 2))
+	client.dataStream = fakeDataStreamer
+
+	ping := protocol.PingCommand{}
+	fakeDataStreamer.On("Write", ping.ToByteArray()).Return(0, nil).Twice()
+	fakeDataStreamer.On("Flush").Return(nil).Twice()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	client.heartbeat(fakeDataStreamer, make(chan struct{}))
+
+	fakeDataStreamer.AssertExpectations(t)
+	assert.False(t, client.isClosed())
+}
+
+func TestStartShouldNotPingServerWithoutHeartbeatSupport(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := New(WithHeartbeat(time.Millisecond, 2))
+	client.dataStream = fakeDataStreamer
+	client.capabilities = protocol.CapabilityExtendedFrames
+
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).After(20 * time.Millisecond).Once()
+
+	client.Start()
+
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestStartShouldCloseConnectionWhenServerIsGoingAway(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := New()
+	client.dataStream = fakeDataStreamer
+
+	goAway := protocol.GoAwayCommand{Reason: "server is shutting down"}
+	expectFrame(fakeDataStreamer, goAway.ToByteArray())
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	client.Start()
+
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestJoinRoomFunctionShouldWaitForTheServerToConfirm(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeJoinRoom)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.JoinRoomCommand{RequestID: 1, Room: "general"}))
+	})
+
+	err := client.JoinRoom("general")
+	assert.Nil(t, err)
+}
+
+func TestJoinRoomFunctionShouldRejectInvalidRoomName(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	err := client.JoinRoom("")
+	assert.Equal(t, protocol.ErrInvalidRoomName, err)
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestLeaveRoomFunctionShouldReturnServerError(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeNotInRoom, RefCommandType: protocol.CommandTypeLeaveRoom}
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
+	err := client.LeaveRoom("general")
+	assert.Equal(t, rejection, err)
+}
+
+func TestListRoomsFunctionShouldReturnRooms(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeListRooms)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.ListRoomsCommand{RequestID: 1, Rooms: []string{"general", "random"}}))
+	})
+
+	rooms, err := client.ListRooms()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"general", "random"}, rooms)
+}
+
+func TestSendRoomMsgFunctionShouldReturnItsOwnRejection(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeNotInRoom, RefCommandType: protocol.CommandTypeRoomMessage}
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeRoomMessage)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
+	err := client.SendRoomMsg("general", []byte("message"))
+	assert.Equal(t, rejection, err)
+}
+
+func TestHandleIncomingRoomMessagesShouldWriteToChannel(t *testing.T) {
+
+	fakeCommandChannels := new(channels.MockCommandChannels)
+	message := protocol.RoomMessageCommand{Room: "general", SenderID: 2, Body: []byte("hello")}
+
+	client := &Client{commandChannels: fakeCommandChannels}
+	fakeCommandChannels.On("Get", protocol.CommandTypeRoomMessage).Return(message, nil).Once()
+	fakeCommandChannels.On("Get", protocol.CommandTypeRoomMessage).Return(nil, errors.New("closed"))
+
+	incomingChan := make(chan protocol.RoomMessageCommand, 1)
+	client.HandleIncomingRoomMessages(incomingChan)
+	assert.Equal(t, message, <-incomingChan)
+}
+
+func TestBroadcastFunctionShouldSendMessageToServer(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	expected := protocol.BroadcastCommand{Body: []byte("message")}
+	fakeDataStreamer.On("Write", expected.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+
+	err := client.Broadcast([]byte("message"))
+	assert.Nil(t, err)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestSubscribeFunctionShouldWaitForTheServerToConfirm(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeSubscribe)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.SubscribeCommand{RequestID: 1, Pattern: "alerts.*"}))
+	})
+
+	err := client.Subscribe("alerts.*")
+	assert.Nil(t, err)
+}
+
+func TestUnsubscribeFunctionShouldReturnServerError(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeNotSubscribed, RefCommandType: protocol.CommandTypeUnsubscribe}
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
+	err := client.Unsubscribe("alerts.*")
+	assert.Equal(t, rejection, err)
+}
+
+func TestPublishFunctionShouldSendMessageToServer(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	expected := protocol.PublishCommand{Topic: "alerts.disk", Body: []byte("full")}
+	fakeDataStreamer.On("Write", expected.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+
+	err := client.Publish("alerts.disk", []byte("full"))
+	assert.Nil(t, err)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestPublishFunctionShouldRejectPatterns(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	err := client.Publish("alerts.*", []byte("full"))
+	assert.Equal(t, protocol.ErrInvalidTopic, err)
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestHandleIncomingTopicMessagesShouldWriteToChannel(t *testing.T) {
+
+	fakeCommandChannels := new(channels.MockCommandChannels)
+	message := protocol.TopicMessageCommand{Topic: "alerts.disk", SenderID: 2, Body: []byte("full")}
+
+	client := &Client{commandChannels: fakeCommandChannels}
+	fakeCommandChannels.On("Get", protocol.CommandTypeTopicMessage).Return(message, nil).Once()
+	fakeCommandChannels.On("Get", protocol.CommandTypeTopicMessage).Return(nil, errors.New("closed"))
+
+	incomingChan := make(chan protocol.TopicMessageCommand, 1)
+	client.HandleIncomingTopicMessages(incomingChan)
+	assert.Equal(t, message, <-incomingChan)
+}
+
+func TestSetNickFunctionShouldWaitForTheServerToConfirm(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeSetNick)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.SetNickCommand{RequestID: 1, Nick: "alice"}))
+	})
+
+	err := client.SetNick("alice")
+	assert.Nil(t, err)
+}
+
+func TestSetNickFunctionShouldReturnServerError(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeNickTaken, RefCommandType: protocol.CommandTypeSetNick}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	})
+
+	err := client.SetNick("alice")
+	assert.Equal(t, rejection, err)
+}
+
+func TestSetNickFunctionShouldRejectInvalidNick(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	err := client.SetNick("al ice")
+	assert.Equal(t, protocol.ErrInvalidNick, err)
+	fakeDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestLookupFunctionsShouldReturnTheOtherSide(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+	parser := protocol.ProtocolParserProducer{}
+
+	// the written query is answered with both the id and the nick
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		protocolParser := parser.Produce()
+		var query interface{}
+		for _, data := range args.Get(0).([]byte) {
+			query, _ = protocolParser.ParseStreamedData(data)
+		}
+		lookup := query.(protocol.LookupCommand)
+		assert.True(t, client.pending.resolve(lookup.RequestID, protocol.LookupCommand{RequestID: lookup.RequestID, ClientID: 2, Nick: "alice"}))
+	})
+	fakeDataStreamer.On("Flush").Return(nil)
+
+	id, err := client.LookupNick("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), id)
+
+	nick, err := client.LookupID(2)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", nick)
+}
+
+func TestListUsersFunctionShouldReturnUsers(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+	users := []protocol.User{{ID: 2, Nick: "alice"}, {ID: 3}}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeListUsers)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.ListUsersCommand{RequestID: 1, Users: users}))
+	})
+
+	response, err := client.ListUsers()
+	assert.Nil(t, err)
+	assert.Equal(t, users, response)
+}
+
+func TestStartShouldPassNickChangesToTheHandler(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	var changes []protocol.NickChangedCommand
+	client := New(WithNickChangeHandler(func(change protocol.NickChangedCommand) {
+		changes = append(changes, change)
+	}))
+	client.dataStream = fakeDataStreamer
+
+	nickChanged := protocol.NickChangedCommand{ClientID: 2, OldNick: "alice", Nick: "bob"}
+	expectFrame(fakeDataStreamer, nickChanged.ToByteArray())
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+
+	client.Start()
+
+	assert.Equal(t, []protocol.NickChangedCommand{nickChanged}, changes)
+}
+
+func TestConnectShouldAskForPresenceOnlyWithPresenceHandler(t *testing.T) {
+
+	for _, withHandler := range []bool{false, true} {
+		fakeDataStreamer := new(datastream.MockTcpDataStream)
+
+		var hello protocol.HelloCommand
+		fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+		fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+			parser := protocol.ProtocolParserProducer{}
+			protocolParser := parser.Produce()
+			for _, data := range args.Get(0).([]byte) {
+				command, _ := protocolParser.ParseStreamedData(data)
+				if command != nil {
+					hello = command.(protocol.HelloCommand)
+				}
+			}
+		}).Once()
+		fakeDataStreamer.On("Flush").Return(nil).Once()
+		expectFrame(fakeDataStreamer, fakeWelcomeCommand.ToByteArray())
+		fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Maybe()
+
+		var options []Option
+		if withHandler {
+			options = append(options, WithPresenceHandler(func(protocol.PresenceCommand) {}))
+		}
+		client := New(options...)
+		client.dataStream = fakeDataStreamer
+
+		assert.Nil(t, client.Connect(&fakeAddress))
+		assert.Equal(t, withHandler, hello.Capabilities.Has(protocol.CapabilityPresence))
+		assert.True(t, hello.Capabilities.Has(protocol.CapabilityNicknames))
+	}
+}
+
+func TestStartShouldPassPresenceEventsToTheHandler(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	var events []protocol.PresenceCommand
+	client := New(WithPresenceHandler(func(event protocol.PresenceCommand) {
+		events = append(events, event)
+	}))
+	client.dataStream = fakeDataStreamer
+
+	joined := protocol.PresenceCommand{Event: protocol.PresenceJoined, ClientID: 2}
+	left := protocol.PresenceCommand{Event: protocol.PresenceLeft, ClientID: 2}
+	expectFrame(fakeDataStreamer, append(joined.ToByteArray(), left.ToByteArray()...))
+	fakeDataStreamer.On("ReadByte").Return(byte(0), io.EOF).Once()
+
+	client.Start()
+
+	assert.Equal(t, []protocol.PresenceCommand{joined, left}, events)
+}
+
+func TestSendMsgWithResultFunctionShouldReturnResult(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+	result := protocol.SendResultCommand{RequestID: 1, MessageID: 5, Delivered: []uint64{2}, Failed: []uint64{3}}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeSendMessage)|protocol.FrameFlagRequestID)
+	})
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, result))
+	})
+
+	response, err := client.SendMsgWithResult([]uint64{2, 3}, []byte("message"))
+	assert.Nil(t, err)
+	assert.Equal(t, result, response)
+}
+
+func TestSendMsgWithResultFunctionShouldReturnErrorIfResponseIsUnexpected(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil)
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.WhoAmICommand{RequestID: 1}))
+	})
+
+	_, err := client.SendMsgWithResult([]uint64{2}, []byte("message"))
+	assert.Equal(t, ErrUnexpectedResponse, err)
+}
+
+func TestSendMsgToNickFunctionShouldReturnItsOwnRejection(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeCommandChannels := new(channels.MockCommandChannels)
+
+	client := &Client{
+		commandChannels: fakeCommandChannels,
+		dataStream:      fakeDataStreamer,
+	}
+
+	rejection := protocol.ErrorCommand{RequestID: 1, Code: protocol.ErrorCodeNotDelivered, RefCommandType: protocol.CommandTypeSendToNick}
+	expected := protocol.SendToNickCommand{RequestID: 1, Nick: "bob", Body: []byte("message")}
+	fakeDataStreamer.On("Write", expected.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, rejection))
+	}).Once()
+
+	err := client.SendMsgToNick("bob", []byte("message"))
+	assert.Equal(t, rejection, err)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestHistoryFunctionShouldReturnMessagesAndNextCursor(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	client := &Client{dataStream: fakeDataStreamer}
+	query := protocol.HistoryQuery{Peer: 2, Before: 10, Limit: 1}
+	messages := []protocol.HistoryMessage{{ID: 7, SenderID: 2, Recipients: []uint64{1}, Body: []byte("hello")}}
+
+	expected := protocol.HistoryCommand{RequestID: 1, Query: query}
+	fakeDataStreamer.On("Write", expected.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Run(func(args mock.Arguments) {
+		assert.True(t, client.pending.resolve(1, protocol.HistoryCommand{RequestID: 1, Query: query, Messages: messages, Next: 7}))
+	})
+
+	response, next, err := client.History(query)
+	assert.Nil(t, err)
+	assert.Equal(t, messages, response)
+	assert.Equal(t, uint64(7), next)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestConnectShouldAuthenticateWithCredentials(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	credentials := protocol.AuthCommand{Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "secret"}
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Once()
+	fakeDataStreamer.On("Write", credentials.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Twice()
+	expectFrame(fakeDataStreamer, fakeWelcomeCommand.ToByteArray())
+	authenticated := protocol.AuthCommand{Scheme: protocol.AuthSchemePassword, Identity: "alice"}
+	expectFrame(fakeDataStreamer, authenticated.ToByteArray())
+	fakeDataStreamer.On("ReadByte").Return(byte(0), nil).Maybe()
+	client := New(WithPassword("alice", "secret"))
+	client.dataStream = fakeDataStreamer
+
+	assert.Nil(t, client.Connect(&fakeAddress))
+	assert.Equal(t, "alice", client.Identity())
+}
+
+func TestConnectShouldReturnRejectionOfCredentials(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	rejection := protocol.ErrorCommand{Code: protocol.ErrorCodeAuthenticationFailed, RefCommandType: protocol.CommandTypeAuth, Message: "Invalid credentials"}
+
+	fakeDataStreamer.On("CreateConnection", mock.Anything).Return(fakeDataStreamer, nil).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Twice()
+	fakeDataStreamer.On("Flush").Return(nil).Twice()
+	expectFrame(fakeDataStreamer, fakeWelcomeCommand.ToByteArray())
+	expectFrame(fakeDataStreamer, rejection.ToByteArray())
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	client := New(WithToken("token"))
+	client.dataStream = fakeDataStreamer
+
+	assert.Equal(t, rejection, client.Connect(&fakeAddress))
+	assert.Empty(t, client.Identity())
+	fakeDataStreamer.AssertExpectations(t)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/datastream"
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// Option is to configure optional client behaviour in New
+type Option func(*Client)
+
+// WithReconnect makes the client dial the server again with the given policy when the connection is lost
+func WithReconnect(policy ReconnectPolicy) Option {
+	return func(cli *Client) {
+		cli.reconnectPolicy = &policy
+	}
+}
+
+// WithConnectionStateHandler sets the function called whenever the connection state of the client changes.
+// It is called from the reading goroutine, so it should not block.
+func WithConnectionStateHandler(handler func(ConnectionState)) Option {
+	return func(cli *Client) {
+		cli.stateHandler = handler
+	}
+}
+
+// WithNickChangeHandler sets the function called when another client changes its nick.
+// It is called from the reading goroutine, so it should not block.
+func WithNickChangeHandler(handler func(protocol.NickChangedCommand)) Option {
+	return func(cli *Client) {
+		cli.nickChangeHandler = handler
+	}
+}
+
+// WithPresenceHandler makes the client ask the server for presence events while connecting, and sets the function
+// called when another client connects or disconnects. It is called from the reading goroutine, so it should not block.
+func WithPresenceHandler(handler func(protocol.PresenceCommand)) Option {
+	return func(cli *Client) {
+		cli.presenceHandler = handler
+	}
+}
+
+// WithDroppedMessageHandler sets the function called with the direct, room and topic messages which are dropped
+// because the application did not read the messages of their type in time. Up to 64 messages of each type are kept
+// until they are read. It is called from the reading goroutine, so it should not block.
+func WithDroppedMessageHandler(handler func(message interface{})) Option {
+	return func(cli *Client) {
+		cli.droppedMessageHandler = handler
+	}
+}
+
+// WithHeartbeat makes the client ping the server every interval if the server supports heartbeats,
+// the connection is closed if nothing comes from the server for more than maxMissed heartbeats
+func WithHeartbeat(interval time.Duration, maxMissed int) Option {
+	return func(cli *Client) {
+		cli.heartbeatInterval = interval
+		cli.maxMissedHeartbeats = maxMissed
+	}
+}
+
+// WithToken makes the client authenticate with the token after the handshake, for servers which require authentication
+func WithToken(token string) Option {
+	return func(cli *Client) {
+		cli.credentials = &protocol.AuthCommand{Scheme: protocol.AuthSchemeToken, Secret: token}
+	}
+}
+
+// WithPassword makes the client authenticate with the username and password after the handshake,
+// for servers which require authentication
+func WithPassword(username string, password string) Option {
+	return func(cli *Client) {
+		cli.credentials = &protocol.AuthCommand{Scheme: protocol.AuthSchemePassword, Username: username, Secret: password}
+	}
+}
+
+// WithDataStreamerProducer sets the transport the client connects with, plain TCP by default
+func WithDataStreamerProducer(producer datastream.IDataStreamerProducer) Option {
+	return func(cli *Client) {
+		cli.dataStream = producer.Produce()
+	}
+}
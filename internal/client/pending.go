@@ -0,0 +1,83 @@
+package client
+
+import (
+	"sync"
+)
+
+// pendingRequests routes the responses of the server to the callers which sent the requests.
+// The zero value is ready to use.
+type pendingRequests struct {
+	mutex    sync.Mutex
+	nextID   uint32
+	requests map[uint32]chan interface{}
+	err      error
+}
+
+// add registers a new request, the response is delivered to the returned channel
+func (t *pendingRequests) add() (uint32, chan interface{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.err != nil {
+		return 0, nil, t.err
+	}
+
+	if t.requests == nil {
+		t.requests = make(map[uint32]chan interface{})
+	}
+
+	// zero means no request id, and ids of the waiting requests cannot be given again
+	for {
+		t.nextID = t.nextID + 1
+		if _, ok := t.requests[t.nextID]; t.nextID != 0 && !ok {
+			break
+		}
+	}
+
+	response := make(chan interface{}, 1)
+	t.requests[t.nextID] = response
+	return t.nextID, response, nil
+}
+
+// resolve delivers the response to the caller of the request, it returns false if nobody waits for it
+func (t *pendingRequests) resolve(requestID uint32, response interface{}) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	responseChannel, ok := t.requests[requestID]
+	if !ok {
+		return false
+	}
+
+	delete(t.requests, requestID)
+	responseChannel <- response
+	return true
+}
+
+// remove forgets the request, so its response will be dropped
+func (t *pendingRequests) remove(requestID uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.requests, requestID)
+}
+
+// failAll delivers the error to all the waiting callers, and makes the later requests fail with it
+func (t *pendingRequests) failAll(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.err = err
+	for requestID, responseChannel := range t.requests {
+		delete(t.requests, requestID)
+		responseChannel <- err
+	}
+}
+
+// reopen makes the requests usable again after failAll, once there is a new connection
+func (t *pendingRequests) reopen() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.err = nil
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ConnectionState is the state of the connection between the client and the server
+type ConnectionState int
+
+const (
+	// StateDisconnected means the connection is lost or closed
+	StateDisconnected ConnectionState = iota
+	// StateConnected means the handshake with the server is done and the client is usable
+	StateConnected
+	// StateReconnecting means the client is trying to connect to the server again
+	StateReconnecting
+)
+
+func (t ConnectionState) String() string {
+	switch t {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// DefaultMaxBackoff is the longest wait between two attempts if the policy does not set one
+const DefaultMaxBackoff = 30 * time.Second
+
+// ReconnectPolicy decides how the client dials the server again after the connection is lost
+type ReconnectPolicy struct {
+	// InitialBackoff is the wait before the first attempt
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest wait between two attempts, DefaultMaxBackoff if zero
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every failed attempt, 2 if zero
+	Multiplier float64
+	// Jitter is the fraction of the wait which is randomized, between 0 and 1
+	Jitter float64
+	// MaxAttempts is the number of attempts before giving up, zero means trying forever
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy returns a policy waiting from 100 milliseconds up to 30 seconds and trying forever
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     DefaultMaxBackoff,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// backoff returns the wait before the given attempt, attempts start from 1
+func (t *ReconnectPolicy) backoff(attempt int) time.Duration {
+	multiplier := t.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	maxBackoff := float64(t.MaxBackoff)
+	if maxBackoff == 0 {
+		maxBackoff = float64(DefaultMaxBackoff)
+	}
+
+	backoff := float64(t.InitialBackoff)
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff = backoff * multiplier
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	// clients restarted by the same server restart should not dial at the same moment
+	if t.Jitter > 0 {
+		backoff = backoff * (1 - t.Jitter*rand.Float64())
+	}
+	return time.Duration(backoff)
+}
+
+// exhausted tells if no attempt is left after the given one
+func (t *ReconnectPolicy) exhausted(attempt int) bool {
+	return t.MaxAttempts > 0 && attempt >= t.MaxAttempts
+}
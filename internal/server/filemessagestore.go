@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// errCorruptHistory is returned when a record of the history file cannot be read back
+var errCorruptHistory = errors.New("corrupt history file")
+
+// historyRecordHeaderLength is the record length (4 bytes) + id (8 bytes) + time (8 bytes) + sender (8 bytes) +
+// recipient count (4 bytes) before the recipients of a record
+const historyRecordHeaderLength = 4 + 8 + 8 + 8 + 4
+
+// historyEntry is a record of the history file without its body, the body is read from the file when it is queried
+type historyEntry struct {
+	record     HistoryRecord
+	bodyOffset int64
+	bodyLength int
+}
+
+// FileMessageStore appends the history to a file, so it survives server restarts. The file is only appended to,
+// the bodies stay in the file and the rest of the records is kept in memory to filter them.
+type FileMessageStore struct {
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	entries []historyEntry
+}
+
+// NewFileMessageStore opens the history file at the path, creating it if needed. A record left incomplete by a
+// crash at the end of the file is dropped.
+func NewFileMessageStore(path string) (*FileMessageStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileMessageStore{file: file}
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the records of the file and truncates the incomplete one at the end if there is one
+func (t *FileMessageStore) load() error {
+	reader := bufio.NewReader(t.file)
+	for {
+		entry, length, err := readHistoryRecord(reader, t.size)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return t.file.Truncate(t.size)
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.record.Message.ID != uint64(len(t.entries))+1 {
+			return errCorruptHistory
+		}
+		t.entries = append(t.entries, entry)
+		t.size += length
+	}
+}
+
+// readHistoryRecord reads the record at the offset, skipping its body, and returns the length of the record
+func readHistoryRecord(reader *bufio.Reader, offset int64) (historyEntry, int64, error) {
+	header := make([]byte, historyRecordHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return historyEntry{}, 0, err
+	}
+
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	recipientCount := int64(binary.LittleEndian.Uint32(header[28:32]))
+	// every recipient has an id and a key, and there are the sender key and the room after them
+	if length < historyRecordHeaderLength+recipientCount*(8+protocol.CommandLengthStringLength)+2*protocol.CommandLengthStringLength {
+		return historyEntry{}, 0, errCorruptHistory
+	}
+
+	recipients := make([]byte, recipientCount*8)
+	if _, err := io.ReadFull(reader, recipients); err != nil {
+		return historyEntry{}, 0, unexpectedEOF(err)
+	}
+
+	entry := historyEntry{record: HistoryRecord{Message: protocol.HistoryMessage{
+		ID:       binary.LittleEndian.Uint64(header[4:12]),
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(header[12:20]))),
+		SenderID: binary.LittleEndian.Uint64(header[20:28]),
+	}}}
+	for i := int64(0); i < recipientCount; i++ {
+		entry.record.Message.Recipients = append(entry.record.Message.Recipients, binary.LittleEndian.Uint64(recipients[i*8:]))
+	}
+
+	headerLength := historyRecordHeaderLength + int64(len(recipients))
+	readString := func() (string, error) {
+		value, err := readHistoryString(reader)
+		headerLength += int64(protocol.CommandLengthStringLength + len(value))
+		return value, err
+	}
+
+	var err error
+	if entry.record.SenderKey, err = readString(); err != nil {
+		return historyEntry{}, 0, err
+	}
+	for i := int64(0); i < recipientCount; i++ {
+		key, err := readString()
+		if err != nil {
+			return historyEntry{}, 0, err
+		}
+		entry.record.RecipientKeys = append(entry.record.RecipientKeys, key)
+	}
+	if entry.record.Message.Room, err = readString(); err != nil {
+		return historyEntry{}, 0, err
+	}
+
+	if length < headerLength {
+		return historyEntry{}, 0, errCorruptHistory
+	}
+	entry.bodyOffset = offset + headerLength
+	entry.bodyLength = int(length - headerLength)
+
+	if _, err := reader.Discard(entry.bodyLength); err != nil {
+		return historyEntry{}, 0, unexpectedEOF(err)
+	}
+	return entry, length, nil
+}
+
+// readHistoryString reads a string of the record, its length (2 bytes) and the string
+func readHistoryString(reader *bufio.Reader) (string, error) {
+	length := make([]byte, protocol.CommandLengthStringLength)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	value := make([]byte, binary.LittleEndian.Uint16(length))
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(value), nil
+}
+
+// unexpectedEOF turns the end of the file in the middle of a record into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Append writes the message to the end of the file and returns the id it is given
+func (t *FileMessageStore) Append(record HistoryRecord) (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	record.Message.ID = uint64(len(t.entries)) + 1
+	encoded := encodeHistoryRecord(record)
+	if _, err := t.file.WriteAt(encoded, t.size); err != nil {
+		// do not leave a part of the record for the next one to be appended after
+		t.file.Truncate(t.size)
+		return 0, err
+	}
+
+	body := record.Message.Body
+	record.Message.Body = nil
+	t.entries = append(t.entries, historyEntry{
+		record:     record,
+		bodyOffset: t.size + int64(len(encoded)-len(body)),
+		bodyLength: len(body),
+	})
+	t.size += int64(len(encoded))
+	return record.Message.ID, nil
+}
+
+// encodeHistoryRecord writes the record length (4 bytes) + id (8 bytes) + time in unix nanoseconds (8 bytes) +
+// sender (8 bytes) + recipient count (4 bytes) + recipients (8 bytes each) + sender key + recipient keys + room + body
+func encodeHistoryRecord(record HistoryRecord) []byte {
+	message := record.Message
+	encoded := make([]byte, historyRecordHeaderLength+len(message.Recipients)*8)
+	binary.LittleEndian.PutUint64(encoded[4:12], message.ID)
+	binary.LittleEndian.PutUint64(encoded[12:20], uint64(message.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(encoded[20:28], message.SenderID)
+	binary.LittleEndian.PutUint32(encoded[28:32], uint32(len(message.Recipients)))
+	for i, recipient := range message.Recipients {
+		binary.LittleEndian.PutUint64(encoded[historyRecordHeaderLength+i*8:], recipient)
+	}
+
+	encoded = appendHistoryString(encoded, record.SenderKey)
+	for i := range message.Recipients {
+		key := ""
+		if i < len(record.RecipientKeys) {
+			key = record.RecipientKeys[i]
+		}
+		encoded = appendHistoryString(encoded, key)
+	}
+	encoded = appendHistoryString(encoded, message.Room)
+	encoded = append(encoded, message.Body...)
+
+	binary.LittleEndian.PutUint32(encoded[0:4], uint32(len(encoded)))
+	return encoded
+}
+
+// appendHistoryString writes the length of the string (2 bytes) and the string
+func appendHistoryString(encoded []byte, value string) []byte {
+	length := make([]byte, protocol.CommandLengthStringLength)
+	binary.LittleEndian.PutUint16(length, uint16(len(value)))
+	encoded = append(encoded, length...)
+	return append(encoded, value...)
+}
+
+// Query returns the messages matching the filter older than before, newest first. Only the bodies of the returned
+// messages are read from the file.
+func (t *FileMessageStore) Query(filter HistoryFilter, before uint64, limit int) ([]protocol.HistoryMessage, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	end := len(t.entries)
+	if before != 0 && before <= uint64(end) {
+		end = int(before) - 1
+	}
+
+	var messages []protocol.HistoryMessage
+	for i := end - 1; i >= 0 && len(messages) < limit; i-- {
+		entry := t.entries[i]
+		if !filter.matches(entry.record) {
+			continue
+		}
+
+		message := entry.record.Message
+		message.Body = make([]byte, entry.bodyLength)
+		if _, err := t.file.ReadAt(message.Body, entry.bodyOffset); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Close writes the history to the disk and closes the file
+func (t *FileMessageStore) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := t.file.Sync(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
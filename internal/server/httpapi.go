@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Applifier/golang-backend-assignment/auth"
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// APISenderID is the sender id of the messages sent through the HTTP API, it is never given to a client
+const APISenderID uint64 = 0
+
+// maxAPIRequestSize is the largest request body the HTTP API reads, a message bigger than a frame cannot be sent anyway
+const maxAPIRequestSize = protocol.DefaultMaxFrameSize
+
+// errNoRecipients is returned when a message sent through the HTTP API has no recipients
+var errNoRecipients = errors.New("no recipients")
+
+type apiClients struct {
+	Clients []uint64 `json:"clients"`
+}
+
+type apiMessage struct {
+	Recipients []uint64 `json:"recipients"`
+	Body       string   `json:"body"`
+}
+
+type apiSendResult struct {
+	MessageID uint64   `json:"message_id"`
+	Delivered []uint64 `json:"delivered"`
+	Failed    []uint64 `json:"failed"`
+}
+
+type apiIdentity struct {
+	ID       uint64 `json:"id"`
+	Identity string `json:"identity,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// httpHandler serves the HTTP API for the scripts which send messages without the client. GET /clients lists the
+// connected clients, POST /messages sends a message like SendMessageCommand and GET /whoami tells who the API sends
+// the messages as. If the server has an authenticator, the requests authenticate with a bearer token or basic auth.
+func (server *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", server.apiHandler(http.MethodGet, server.handleListClientsRequest))
+	mux.HandleFunc("/messages", server.apiHandler(http.MethodPost, server.handleSendMessageRequest))
+	mux.HandleFunc("/whoami", server.apiHandler(http.MethodGet, server.handleWhoAmIRequest))
+	return mux
+}
+
+// apiHandler checks the method and the credentials of the request, and passes it to the handler with the identity
+func (server *Server) apiHandler(method string, handle func(writer http.ResponseWriter, request *http.Request, identity string)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != method {
+			writer.Header().Set("Allow", method)
+			writeJSON(writer, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+			return
+		}
+
+		identity, err := server.authenticateRequest(request)
+		if err != nil {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="chat"`)
+			writeJSON(writer, http.StatusUnauthorized, apiError{Error: err.Error()})
+			return
+		}
+		handle(writer, request, identity)
+	}
+}
+
+// authenticateRequest returns the identity the credentials of the request prove, it is empty if the server does not
+// authenticate. A bearer token is authenticated like the token scheme, basic auth like the password scheme.
+func (server *Server) authenticateRequest(request *http.Request) (string, error) {
+	if server.authenticator == nil {
+		return "", nil
+	}
+
+	var credentials auth.Credentials
+	authorization := request.Header.Get("Authorization")
+	if username, password, ok := request.BasicAuth(); ok {
+		credentials = auth.Credentials{Scheme: protocol.AuthSchemePassword, Username: username, Secret: password}
+	} else if strings.HasPrefix(authorization, "Bearer ") {
+		credentials = auth.Credentials{Scheme: protocol.AuthSchemeToken, Secret: strings.TrimPrefix(authorization, "Bearer ")}
+	} else {
+		return "", protocol.ErrAuthenticationRequired
+	}
+
+	identity, err := server.authenticator.Authenticate(credentials)
+	if err == nil && identity == "" {
+		err = auth.ErrInvalidCredentials
+	}
+	return identity, err
+}
+
+func (server *Server) handleListClientsRequest(writer http.ResponseWriter, request *http.Request, identity string) {
+	writeJSON(writer, http.StatusOK, apiClients{Clients: nonNil(server.ListClientIDs())})
+}
+
+// handleSendMessageRequest passes the message to the recipients the way handleSendMessageCommand does,
+// the recipients get it from APISenderID with the authenticated identity as the nick
+func (server *Server) handleSendMessageRequest(writer http.ResponseWriter, request *http.Request, identity string) {
+	var message apiMessage
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxAPIRequestSize))
+	if err := decoder.Decode(&message); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if len(message.Recipients) == 0 {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: errNoRecipients.Error()})
+		return
+	}
+
+	sender := server.apiSender(identity)
+	messageID, delivered, failed, _ := server.sendMessage(sender, message.Recipients, []byte(message.Body))
+	writeJSON(writer, http.StatusOK, apiSendResult{MessageID: messageID, Delivered: nonNil(delivered), Failed: nonNil(failed)})
+}
+
+// apiSender returns the client the HTTP API sends the messages as. The history keeps them under the identity,
+// or under the API of this run if the server does not authenticate.
+func (server *Server) apiSender(identity string) *client {
+	return &client{id: APISenderID, identity: identity, connectionKey: "api:" + server.runID}
+}
+
+func (server *Server) handleWhoAmIRequest(writer http.ResponseWriter, request *http.Request, identity string) {
+	writeJSON(writer, http.StatusOK, apiIdentity{ID: APISenderID, Identity: identity})
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+// nonNil makes the empty lists [] instead of null in JSON
+func nonNil(ids []uint64) []uint64 {
+	if ids == nil {
+		return []uint64{}
+	}
+	return ids
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Applifier/golang-backend-assignment/auth"
+	"github.com/Applifier/golang-backend-assignment/datastream"
+	"github.com/Applifier/golang-backend-assignment/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveAPIRequest passes the request to the HTTP API of the server and returns the response
+func serveAPIRequest(server *Server, method string, target string, body string, authorization string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	server.httpHandler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHTTPAPIShouldListClientsAndSendMessagesFromAPISender(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	first := newFakeClient(fakeDataStreamer, 1)
+	second := newFakeClient(fakeDataStreamer, 2)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{first, second},
+		clientIDs:    []uint64{first.id, second.id},
+		clientMutex:  &sync.Mutex{}}
+
+	response := serveAPIRequest(server, http.MethodGet, "/clients", "", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"clients": [1, 2]}`, response.Body.String())
+
+	response = serveAPIRequest(server, http.MethodPost, "/messages", `{"recipients": [2, 5], "body": "deployed"}`, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"message_id": 1, "delivered": [2], "failed": [5]}`, response.Body.String())
+
+	message := protocol.MessageFromClient{SenderID: APISenderID, Body: []byte("deployed")}
+	assert.Equal(t, [][]byte{message.ToByteArray()}, second.outbound.frames)
+	assert.Empty(t, first.outbound.frames)
+
+	response = serveAPIRequest(server, http.MethodGet, "/whoami", "", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"id": 0}`, response.Body.String())
+}
+
+func TestHTTPAPIShouldRejectWrongMethodsBadMessagesAndMissingCredentials(t *testing.T) {
+
+	server := New(WithAuthenticator(auth.NewTokenAuthenticator(map[string]string{"ci-token": "ci"})))
+
+	response := serveAPIRequest(server, http.MethodGet, "/whoami", "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.JSONEq(t, `{"error": "Authentication required"}`, response.Body.String())
+
+	response = serveAPIRequest(server, http.MethodGet, "/whoami", "", "Bearer guess")
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// the token is only accepted as a bearer token
+	response = serveAPIRequest(server, http.MethodGet, "/whoami", "", "Basic "+base64.StdEncoding.EncodeToString([]byte("anything:ci-token")))
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = serveAPIRequest(server, http.MethodGet, "/whoami", "", "Bearer ci-token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"id": 0, "identity": "ci"}`, response.Body.String())
+
+	response = serveAPIRequest(server, http.MethodGet, "/messages", "", "Bearer ci-token")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+	assert.Equal(t, http.MethodPost, response.Header().Get("Allow"))
+
+	response = serveAPIRequest(server, http.MethodPost, "/messages", `{"body": "deployed"}`, "Bearer ci-token")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.JSONEq(t, `{"error": "no recipients"}`, response.Body.String())
+
+	response = serveAPIRequest(server, http.MethodPost, "/messages", `{"recipients": "everybody"}`, "Bearer ci-token")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = serveAPIRequest(server, http.MethodGet, "/clients", "", "Bearer ci-token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"clients": []}`, response.Body.String())
+}
+
+func TestHTTPAPIShouldSendMessagesAsAuthenticatedIdentity(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	store := NewMemoryMessageStore()
+	server := New(WithAuthenticator(auth.NewTokenAuthenticator(map[string]string{"ci-token": "ci"})), WithMessageStore(store))
+	recipient, _ := server.createClient(fakeDataStreamer)
+	recipient.handshaking = false
+	recipient.identity = "bob"
+	recipient.capabilities = protocol.SupportedCapabilities
+
+	response := serveAPIRequest(server, http.MethodPost, "/messages", `{"recipients": [1], "body": "deployed"}`, "Bearer ci-token")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"message_id": 1, "delivered": [1], "failed": []}`, response.Body.String())
+
+	message := protocol.MessageFromClient{SenderID: APISenderID, SenderNick: "ci", Body: []byte("deployed")}
+	assert.Equal(t, [][]byte{message.ToByteArray()}, recipient.outbound.frames)
+
+	// the history keeps the message under the identity, so it is found with it after the API request
+	messages, err := store.Query(HistoryFilter{Participant: identityKey("ci")}, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "deployed", string(messages[0].Body))
+		assert.Equal(t, APISenderID, messages[0].SenderID)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// IMessageStore keeps the history of the messages routed by the server
+type IMessageStore interface {
+	// Append records the message and returns the id it is given, ids grow with every message
+	Append(record HistoryRecord) (uint64, error)
+	// Query returns at most limit messages matching the filter with ids smaller than before, newest first.
+	// Zero before means the latest messages.
+	Query(filter HistoryFilter, before uint64, limit int) ([]protocol.HistoryMessage, error)
+}
+
+// HistoryRecord is a message of the history with the keys of its participants. Client ids are given to other clients
+// later, in the same run of the server or after a restart, so the messages of a client are found by its key: its
+// authenticated identity, or its connection if it has none. RecipientKeys are in the order of the recipients.
+type HistoryRecord struct {
+	Message       protocol.HistoryMessage
+	SenderKey     string
+	RecipientKeys []string
+}
+
+// HistoryFilter selects the messages a client can see in the history. Without a peer or room it selects the
+// direct messages the participant, the key of the client, sent or received. Peer narrows them to the ones
+// exchanged with the client of that key and Room selects the messages sent to the room instead.
+type HistoryFilter struct {
+	Participant string
+	Peer        string
+	Room        string
+}
+
+// matches tells if the filter selects the record
+func (t HistoryFilter) matches(record HistoryRecord) bool {
+	message := record.Message
+	if t.Room != "" || message.Room != "" {
+		return t.Room == message.Room
+	}
+
+	if t.Participant == "" {
+		return false
+	}
+	if record.SenderKey == t.Participant {
+		return t.Peer == "" || containsKey(record.RecipientKeys, t.Peer)
+	}
+	if containsKey(record.RecipientKeys, t.Participant) {
+		return t.Peer == "" || record.SenderKey == t.Peer
+	}
+	return false
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, check := range keys {
+		if check == key {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryMessageStore keeps the history in memory, it is lost when the server stops
+type MemoryMessageStore struct {
+	mutex   sync.Mutex
+	records []HistoryRecord
+}
+
+// NewMemoryMessageStore creates an empty history
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{}
+}
+
+// Append records the message and returns the id it is given
+func (t *MemoryMessageStore) Append(record HistoryRecord) (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	record.Message.ID = uint64(len(t.records)) + 1
+	t.records = append(t.records, record)
+	return record.Message.ID, nil
+}
+
+// Query returns the messages matching the filter older than before, newest first
+func (t *MemoryMessageStore) Query(filter HistoryFilter, before uint64, limit int) ([]protocol.HistoryMessage, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// the id of a message is its position in the history starting from one
+	end := len(t.records)
+	if before != 0 && before <= uint64(end) {
+		end = int(before) - 1
+	}
+
+	var messages []protocol.HistoryMessage
+	for i := end - 1; i >= 0 && len(messages) < limit; i-- {
+		if filter.matches(t.records[i]) {
+			messages = append(messages, t.records[i].Message)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forEachMessageStore runs the test against every message store implementation
+func forEachMessageStore(t *testing.T, test func(t *testing.T, store IMessageStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryMessageStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "history")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		store, err := NewFileMessageStore(filepath.Join(dir, "history"))
+		require.NoError(t, err)
+		defer store.Close()
+		test(t, store)
+	})
+}
+
+func appendMessages(t *testing.T, store IMessageStore, messages ...protocol.HistoryMessage) {
+	for i, message := range messages {
+		id, err := store.Append(recordOf(message))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), id)
+	}
+}
+
+// recordOf keys the participants of the message by their ids, like clients which keep their ids
+func recordOf(message protocol.HistoryMessage) HistoryRecord {
+	record := HistoryRecord{Message: message, SenderKey: testKey(message.SenderID)}
+	for _, recipient := range message.Recipients {
+		record.RecipientKeys = append(record.RecipientKeys, testKey(recipient))
+	}
+	return record
+}
+
+func testKey(id uint64) string {
+	return fmt.Sprintf("client-%d", id)
+}
+
+func TestMessageStoreShouldFilterByParticipantPeerAndRoom(t *testing.T) {
+	forEachMessageStore(t, func(t *testing.T, store IMessageStore) {
+		appendMessages(t, store,
+			protocol.HistoryMessage{Time: time.Unix(0, 1), SenderID: 1, Recipients: []uint64{2}, Body: []byte("1 to 2")},
+			protocol.HistoryMessage{Time: time.Unix(0, 2), SenderID: 3, Recipients: []uint64{1, 2}, Body: []byte("3 to 1 and 2")},
+			protocol.HistoryMessage{Time: time.Unix(0, 3), SenderID: 2, Recipients: []uint64{3}, Body: []byte("2 to 3")},
+			protocol.HistoryMessage{Time: time.Unix(0, 4), SenderID: 2, Recipients: []uint64{1}, Room: "general", Body: []byte("2 to general")},
+		)
+
+		messages, err := store.Query(HistoryFilter{Participant: testKey(1)}, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"3 to 1 and 2", "1 to 2"}, bodies(messages))
+
+		messages, err = store.Query(HistoryFilter{Participant: testKey(2), Peer: testKey(3)}, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"2 to 3", "3 to 1 and 2"}, bodies(messages))
+
+		messages, err = store.Query(HistoryFilter{Participant: testKey(1), Room: "general"}, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []protocol.HistoryMessage{
+			{ID: 4, Time: time.Unix(0, 4), SenderID: 2, Recipients: []uint64{1}, Room: "general", Body: []byte("2 to general")},
+		}, messages)
+	})
+}
+
+func TestMessageStoreShouldNotShowMessagesOfEarlierClientWithTheSameID(t *testing.T) {
+	forEachMessageStore(t, func(t *testing.T, store IMessageStore) {
+		// client 2 leaves and its id is given to a new connection
+		_, err := store.Append(HistoryRecord{
+			Message:       protocol.HistoryMessage{SenderID: 1, Recipients: []uint64{2}, Body: []byte("secret for 2")},
+			SenderKey:     "identity:alice",
+			RecipientKeys: []string{"connection:run:2"},
+		})
+		require.NoError(t, err)
+
+		messages, err := store.Query(HistoryFilter{Participant: "connection:run:3"}, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+
+		messages, err = store.Query(HistoryFilter{Participant: "connection:run:2", Peer: "identity:alice"}, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret for 2"}, bodies(messages))
+
+		messages, err = store.Query(HistoryFilter{}, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	})
+}
+
+func TestMessageStoreShouldPageBeforeTheCursor(t *testing.T) {
+	forEachMessageStore(t, func(t *testing.T, store IMessageStore) {
+		for i := 0; i < 5; i++ {
+			_, err := store.Append(recordOf(protocol.HistoryMessage{SenderID: 1, Recipients: []uint64{2}, Body: []byte{byte('a' + i)}}))
+			require.NoError(t, err)
+		}
+
+		messages, err := store.Query(HistoryFilter{Participant: testKey(2)}, 0, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"e", "d"}, bodies(messages))
+
+		messages, err = store.Query(HistoryFilter{Participant: testKey(2)}, messages[1].ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c", "b"}, bodies(messages))
+
+		messages, err = store.Query(HistoryFilter{Participant: testKey(2)}, messages[1].ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, bodies(messages))
+	})
+}
+
+func TestFileMessageStoreShouldKeepHistoryAfterReopening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+
+	store, err := NewFileMessageStore(path)
+	require.NoError(t, err)
+	appendMessages(t, store,
+		protocol.HistoryMessage{Time: time.Unix(0, 1), SenderID: 1, Recipients: []uint64{2}, Body: []byte("first")},
+		protocol.HistoryMessage{Time: time.Unix(0, 2), SenderID: 2, Recipients: []uint64{1}, Body: []byte("second")},
+	)
+	require.NoError(t, store.Close())
+
+	// a crash in the middle of an append leaves a partial record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write(encodeHistoryRecord(HistoryRecord{Message: protocol.HistoryMessage{ID: 3, Body: []byte("third")}})[:10])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store, err = NewFileMessageStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	id, err := store.Append(recordOf(protocol.HistoryMessage{Time: time.Unix(0, 3), SenderID: 1, Recipients: []uint64{2}, Body: []byte("third")}))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), id)
+
+	messages, err := store.Query(HistoryFilter{Participant: testKey(1)}, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"third", "second", "first"}, bodies(messages))
+	assert.Equal(t, time.Unix(0, 2), messages[1].Time)
+}
+
+func bodies(messages []protocol.HistoryMessage) []string {
+	var bodies []string
+	for _, message := range messages {
+		bodies = append(bodies, string(message.Body))
+	}
+	return bodies
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+)
+
+// nickDirectory keeps the nicks of the clients, a nick belongs to one client at a time.
+// The zero value is ready to use.
+type nickDirectory struct {
+	mutex   sync.Mutex
+	clients map[string]*client
+	nicks   map[*client]string
+}
+
+// set gives the nick to the client and frees its previous nick. It returns the previous nick,
+// and false if the nick belongs to another client.
+func (t *nickDirectory) set(owner *client, nick string) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	oldNick := t.nicks[owner]
+	if current, ok := t.clients[nick]; ok {
+		return oldNick, current == owner
+	}
+
+	if t.clients == nil {
+		t.clients = make(map[string]*client)
+		t.nicks = make(map[*client]string)
+	}
+	delete(t.clients, oldNick)
+	t.clients[nick] = owner
+	t.nicks[owner] = nick
+	return oldNick, true
+}
+
+// nick returns the nick of the client, or empty string if it has none
+func (t *nickDirectory) nick(owner *client) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.nicks[owner]
+}
+
+// lookup returns the client with the nick, or nil if nobody has it
+func (t *nickDirectory) lookup(nick string) *client {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.clients[nick]
+}
+
+// remove frees the nick of the client
+func (t *nickDirectory) remove(owner *client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if nick, ok := t.nicks[owner]; ok {
+		delete(t.clients, nick)
+		delete(t.nicks, owner)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNickDirectoryShouldKeepNicksUnique(t *testing.T) {
+	nicks := nickDirectory{}
+	first := &client{id: 1}
+	second := &client{id: 2}
+
+	oldNick, ok := nicks.set(first, "alice")
+	assert.True(t, ok)
+	assert.Equal(t, "", oldNick)
+
+	oldNick, ok = nicks.set(second, "alice")
+	assert.False(t, ok)
+	assert.Equal(t, "", oldNick)
+
+	oldNick, ok = nicks.set(first, "alice")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", oldNick)
+
+	assert.Equal(t, first, nicks.lookup("alice"))
+	assert.Equal(t, "alice", nicks.nick(first))
+	assert.Equal(t, "", nicks.nick(second))
+}
+
+func TestNickDirectoryShouldFreeOldNicks(t *testing.T) {
+	nicks := nickDirectory{}
+	first := &client{id: 1}
+	second := &client{id: 2}
+
+	nicks.set(first, "alice")
+	oldNick, ok := nicks.set(first, "bob")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", oldNick)
+	assert.Nil(t, nicks.lookup("alice"))
+
+	_, ok = nicks.set(second, "alice")
+	assert.True(t, ok)
+
+	nicks.remove(first)
+	assert.Nil(t, nicks.lookup("bob"))
+	assert.Equal(t, "", nicks.nick(first))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/auth"
+	"github.com/Applifier/golang-backend-assignment/datastream"
+	"github.com/Applifier/golang-backend-assignment/idallocator"
+	"github.com/Applifier/golang-backend-assignment/mailbox"
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// Option is to configure optional server behaviour in New
+type Option func(*Server)
+
+// WithMaxFrameSize sets the largest frame the server accepts from its clients, bigger frames are rejected
+func WithMaxFrameSize(maxFrameSize uint32) Option {
+	return func(server *Server) {
+		server.protocolParserProducer = &protocol.ProtocolParserProducer{MaxFrameSize: maxFrameSize}
+	}
+}
+
+// WithHeartbeat makes the server ping the clients supporting heartbeats every interval, clients which do not send
+// anything for more than maxMissed heartbeats are disconnected. The clients without heartbeats are not pinged, but
+// they are disconnected as well if they stay silent that long, so half-open connections do not stay around.
+func WithHeartbeat(interval time.Duration, maxMissed int) Option {
+	return func(server *Server) {
+		server.heartbeatInterval = interval
+		server.maxMissedHeartbeats = maxMissed
+	}
+}
+
+// WithHandshakeTimeout sets how long a new connection is given to complete the handshake, and to authenticate if
+// the server requires it, before it is disconnected. A zero timeout waits forever.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(server *Server) {
+		server.handshakeTimeout = timeout
+	}
+}
+
+// WithIDAllocator sets the allocator giving ids to the connected clients, ids are monotonic by default
+func WithIDAllocator(idAllocator idallocator.IIDAllocator) Option {
+	return func(server *Server) {
+		server.idAllocator = idAllocator
+	}
+}
+
+// WithOutboundQueueSize sets how many frames can wait to be written to a client
+func WithOutboundQueueSize(size int) Option {
+	return func(server *Server) {
+		server.outboundQueueSize = size
+	}
+}
+
+// WithSlowConsumerPolicy sets what happens when the outbound queue of a client is full, senders wait by default
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(server *Server) {
+		server.slowConsumerPolicy = policy
+	}
+}
+
+// WithMailbox makes the server keep the messages sent to nicks nobody has in the mailbox, they are delivered
+// when a client takes the nick. Without a mailbox such messages are rejected. Anybody could take a nick to read
+// its mailbox, so the mailbox needs WithAuthenticator and WithIdentityNicks, where only the authenticated identity
+// has its nick. Start returns ErrMailboxNeedsIdentityNicks without them.
+func WithMailbox(mailbox mailbox.IMailbox) Option {
+	return func(server *Server) {
+		server.mailbox = mailbox
+	}
+}
+
+// WithMessageStore makes the server record the messages it routes in the store, so the clients can scroll back
+// their history. Without a store history is not available.
+func WithMessageStore(store IMessageStore) Option {
+	return func(server *Server) {
+		server.messageStore = store
+	}
+}
+
+// WithAuthenticator makes the clients authenticate with the authenticator right after the handshake. Until they do,
+// they cannot send other commands and the other clients do not see them. Clients which fail to authenticate are disconnected.
+func WithAuthenticator(authenticator auth.Authenticator) Option {
+	return func(server *Server) {
+		server.authenticator = authenticator
+	}
+}
+
+// WithIdentityNicks makes the identity a client authenticates as its nick, so the other clients see the identity instead
+// of the anonymous id. The clients cannot change their nicks then, and an identity can only be connected once.
+func WithIdentityNicks() Option {
+	return func(server *Server) {
+		server.identityNicks = true
+	}
+}
+
+// WithDataStreamerProducer sets the transport the server listens with, plain TCP by default. With a TLS transport
+// verifying client certificates, the clients are authenticated as the identity in their certificates.
+func WithDataStreamerProducer(producer datastream.IDataStreamerProducer) Option {
+	return func(server *Server) {
+		server.dataStreamer = producer.Produce()
+	}
+}
+
+// WithHTTPAPI makes Start also serve the HTTP API on the address, so scripts can list the clients and send messages
+// with JSON. The messages come from APISenderID, and the requests authenticate if the server has an authenticator.
+func WithHTTPAPI(laddr net.Addr) Option {
+	return func(server *Server) {
+		server.httpAddr = laddr
+	}
+}
+
+// WithGateway makes Start also listen on the address with the transport of the producer, e.g. WebSocket for the
+// browsers next to TCP. The clients of every transport are ordinary clients and can message each other.
+func WithGateway(laddr net.Addr, producer datastream.IDataStreamerProducer) Option {
+	return func(server *Server) {
+		server.gateways = append(server.gateways, &gateway{laddr: laddr, dataStreamer: producer.Produce()})
+	}
+}
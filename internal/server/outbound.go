@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultOutboundQueueSize is the number of frames which can wait to be written to a client
+const defaultOutboundQueueSize = 256
+
+var (
+	// errOutboundQueueClosed is returned when a frame is queued for a client which is disconnecting
+	errOutboundQueueClosed = errors.New("outbound queue closed")
+	// errOutboundQueueFull is returned when a frame cannot be queued without waiting
+	errOutboundQueueFull = errors.New("outbound queue full")
+)
+
+// outboundQueue holds the frames waiting to be written to a client by its writer goroutine
+type outboundQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	frames   [][]byte
+	capacity int
+	closed   bool
+}
+
+func newOutboundQueue(capacity int) *outboundQueue {
+	queue := &outboundQueue{capacity: capacity}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// push queues the frame, it waits while the queue is full
+func (t *outboundQueue) push(frame []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.frames) >= t.capacity && !t.closed {
+		t.cond.Wait()
+	}
+	if t.closed {
+		return errOutboundQueueClosed
+	}
+
+	t.frames = append(t.frames, frame)
+	t.cond.Broadcast()
+	return nil
+}
+
+// offer queues the frame if there is room for it without waiting
+func (t *outboundQueue) offer(frame []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return errOutboundQueueClosed
+	}
+	if len(t.frames) >= t.capacity {
+		return errOutboundQueueFull
+	}
+
+	t.frames = append(t.frames, frame)
+	t.cond.Broadcast()
+	return nil
+}
+
+// pushDropOldest queues the frame without waiting, the oldest frames are dropped to make room for it.
+// It returns the number of dropped frames.
+func (t *outboundQueue) pushDropOldest(frame []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, errOutboundQueueClosed
+	}
+
+	dropped := 0
+	for len(t.frames) >= t.capacity && len(t.frames) > 0 {
+		t.frames = t.frames[1:]
+		dropped = dropped + 1
+	}
+
+	t.frames = append(t.frames, frame)
+	t.cond.Broadcast()
+	return dropped, nil
+}
+
+// closeWith drops the queued frames and closes the queue, so the given frame is the last one written.
+// It returns the number of dropped frames, and false if the queue was already closed.
+func (t *outboundQueue) closeWith(frame []byte) (int, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, false
+	}
+
+	dropped := len(t.frames)
+	t.frames = [][]byte{frame}
+	t.closed = true
+	t.cond.Broadcast()
+	return dropped, true
+}
+
+// closeAfter queues the frame even if the queue is full and closes the queue, so the given frame
+// is written after the queued ones as the last one. It returns false if the queue was already closed.
+func (t *outboundQueue) closeAfter(frame []byte) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	t.frames = append(t.frames, frame)
+	t.closed = true
+	t.cond.Broadcast()
+	return true
+}
+
+// popAll waits until there are frames and takes all of them. The frames queued before close
+// are still returned, it returns false once the queue is closed and empty.
+func (t *outboundQueue) popAll() ([][]byte, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.frames) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if len(t.frames) == 0 {
+		return nil, false
+	}
+
+	frames := t.frames
+	t.frames = nil
+	t.cond.Broadcast()
+	return frames, true
+}
+
+// close stops accepting frames and wakes up everybody waiting for the queue
+func (t *outboundQueue) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	t.cond.Broadcast()
+}
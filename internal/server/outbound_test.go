@@ -0,0 +1,115 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundQueueShouldReturnFramesInOrder(t *testing.T) {
+	queue := newOutboundQueue(2)
+
+	assert.Nil(t, queue.push([]byte{1}))
+	assert.Nil(t, queue.push([]byte{2}))
+
+	frames, ok := queue.popAll()
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{{1}, {2}}, frames)
+}
+
+func TestOutboundQueuePushShouldWaitWhileQueueIsFull(t *testing.T) {
+	queue := newOutboundQueue(1)
+	assert.Nil(t, queue.push([]byte{1}))
+	assert.Equal(t, errOutboundQueueFull, queue.offer([]byte{2}))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.push([]byte{2})
+	}()
+
+	select {
+	case <-pushed:
+		assert.Fail(t, "push should wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	frames, _ := queue.popAll()
+	assert.Equal(t, [][]byte{{1}}, frames)
+	assert.Nil(t, <-pushed)
+}
+
+func TestOutboundQueueShouldGiveQueuedFramesAfterClose(t *testing.T) {
+	queue := newOutboundQueue(2)
+	assert.Nil(t, queue.push([]byte{1}))
+
+	queue.close()
+	assert.Equal(t, errOutboundQueueClosed, queue.push([]byte{2}))
+	assert.Equal(t, errOutboundQueueClosed, queue.offer([]byte{2}))
+
+	frames, ok := queue.popAll()
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{{1}}, frames)
+
+	frames, ok = queue.popAll()
+	assert.False(t, ok)
+	assert.Nil(t, frames)
+}
+
+func TestOutboundQueueCloseShouldWakeUpWaitingPush(t *testing.T) {
+	queue := newOutboundQueue(1)
+	assert.Nil(t, queue.push([]byte{1}))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.push([]byte{2})
+	}()
+	time.Sleep(20 * time.Millisecond) // to ensure above routine is waiting
+
+	queue.close()
+	assert.Equal(t, errOutboundQueueClosed, <-pushed)
+}
+
+func TestOutboundQueuePushDropOldestShouldMakeRoomForNewFrame(t *testing.T) {
+	queue := newOutboundQueue(2)
+	assert.Nil(t, queue.push([]byte{1}))
+	assert.Nil(t, queue.push([]byte{2}))
+
+	dropped, err := queue.pushDropOldest([]byte{3})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dropped)
+
+	frames, _ := queue.popAll()
+	assert.Equal(t, [][]byte{{2}, {3}}, frames)
+}
+
+func TestOutboundQueueCloseWithShouldReplaceQueuedFrames(t *testing.T) {
+	queue := newOutboundQueue(2)
+	assert.Nil(t, queue.push([]byte{1}))
+	assert.Nil(t, queue.push([]byte{2}))
+
+	dropped, ok := queue.closeWith([]byte{3})
+	assert.True(t, ok)
+	assert.Equal(t, 2, dropped)
+
+	_, ok = queue.closeWith([]byte{4})
+	assert.False(t, ok)
+
+	frames, _ := queue.popAll()
+	assert.Equal(t, [][]byte{{3}}, frames)
+	_, ok = queue.popAll()
+	assert.False(t, ok)
+}
+
+func TestOutboundQueueCloseAfterShouldKeepQueuedFrames(t *testing.T) {
+	queue := newOutboundQueue(1)
+	assert.Nil(t, queue.push([]byte{1}))
+
+	assert.True(t, queue.closeAfter([]byte{2}))
+	assert.False(t, queue.closeAfter([]byte{3}))
+
+	frames, _ := queue.popAll()
+	assert.Equal(t, [][]byte{{1}, {2}}, frames)
+	_, ok := queue.popAll()
+	assert.False(t, ok)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// roomRegistry keeps the members of the rooms, a room exists as long as it has members.
+// The zero value is ready to use.
+type roomRegistry struct {
+	mutex sync.Mutex
+	rooms map[string]map[*client]struct{}
+}
+
+// join adds the client to the room, creating the room if needed
+func (t *roomRegistry) join(room string, member *client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.rooms == nil {
+		t.rooms = make(map[string]map[*client]struct{})
+	}
+
+	members, ok := t.rooms[room]
+	if !ok {
+		members = make(map[*client]struct{})
+		t.rooms[room] = members
+	}
+	members[member] = struct{}{}
+}
+
+// leave removes the client from the room, it returns false if the client is not a member
+func (t *roomRegistry) leave(room string, member *client) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.removeMember(room, member)
+}
+
+// leaveAll removes the client from all its rooms
+func (t *roomRegistry) leaveAll(member *client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for room := range t.rooms {
+		t.removeMember(room, member)
+	}
+}
+
+func (t *roomRegistry) removeMember(room string, member *client) bool {
+	members, ok := t.rooms[room]
+	if !ok {
+		return false
+	}
+	if _, ok := members[member]; !ok {
+		return false
+	}
+
+	delete(members, member)
+	if len(members) == 0 {
+		delete(t.rooms, room)
+	}
+	return true
+}
+
+// members returns the members of the room, and false if the given client is not one of them
+func (t *roomRegistry) members(room string, member *client) ([]*client, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.rooms[room][member]; !ok {
+		return nil, false
+	}
+
+	members := make([]*client, 0, len(t.rooms[room]))
+	for check := range t.rooms[room] {
+		members = append(members, check)
+	}
+	return members, true
+}
+
+// list returns the names of the rooms in order
+func (t *roomRegistry) list() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rooms := make([]string, 0, len(t.rooms))
+	for room := range t.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
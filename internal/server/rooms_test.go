@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomRegistryShouldKeepMembers(t *testing.T) {
+	rooms := roomRegistry{}
+	first := &client{id: 1}
+	second := &client{id: 2}
+
+	rooms.join("general", first)
+	rooms.join("general", second)
+	rooms.join("random", first)
+
+	members, ok := rooms.members("general", first)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []*client{first, second}, members)
+	assert.Equal(t, []string{"general", "random"}, rooms.list())
+
+	_, ok = rooms.members("random", second)
+	assert.False(t, ok)
+}
+
+func TestRoomRegistryShouldRemoveEmptyRooms(t *testing.T) {
+	rooms := roomRegistry{}
+	first := &client{id: 1}
+	second := &client{id: 2}
+
+	rooms.join("general", first)
+	rooms.join("general", second)
+	rooms.join("random", first)
+
+	assert.True(t, rooms.leave("random", first))
+	assert.False(t, rooms.leave("random", first))
+	assert.Equal(t, []string{"general"}, rooms.list())
+
+	rooms.leaveAll(first)
+	members, ok := rooms.members("general", second)
+	assert.True(t, ok)
+	assert.Equal(t, []*client{second}, members)
+
+	rooms.leaveAll(second)
+	assert.Empty(t, rooms.list())
+}
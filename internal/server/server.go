@@ -1,15 +1,28 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Applifier/golang-backend-assignment/auth"
 	"github.com/Applifier/golang-backend-assignment/channels"
 
 	"github.com/Applifier/golang-backend-assignment/datastream"
 
+	"github.com/Applifier/golang-backend-assignment/idallocator"
+	"github.com/Applifier/golang-backend-assignment/mailbox"
+
 	"github.com/Applifier/golang-backend-assignment/protocol"
 )
 
@@ -17,21 +30,103 @@ import (
 type client struct {
 	dataStreamer datastream.IDataStreamer
 	id           uint64
+	version      uint16
+	// capabilities are written once by the handshake and read by the goroutines of the other clients, so they are accessed atomically
+	capabilities     protocol.Capability
+	missedHeartbeats int32
+	outbound         *outboundQueue
+	writerDone       chan struct{}
+	// handshaking is set under the client mutex of the server from the accept until the client completes the handshake,
+	// the other clients cannot see the client until then
+	handshaking bool
+	// identity is set under the client mutex of the server once the client authenticates
+	identity string
+	// connectionKey tells the connection apart from the ones before, the history of a client without identity is kept under it
+	connectionKey string
+}
+
+// has reports whether the client negotiated all the given capabilities
+func (t *client) has(capability protocol.Capability) bool {
+	capabilities := protocol.Capability(atomic.LoadUint32((*uint32)(&t.capabilities)))
+	return capabilities.Has(capability)
+}
+
+func (t *client) setCapabilities(capabilities protocol.Capability) {
+	atomic.StoreUint32((*uint32)(&t.capabilities), uint32(capabilities))
 }
 
 // Server struct
 type Server struct {
+	// counters are accessed atomically, they come first to be 64 bit aligned
+	droppedFrames           uint64
+	slowConsumerDisconnects uint64
+	lastMessageID           uint64
+
 	dataStreamer           datastream.IDataStreamer
+	addr                   net.Addr
+	gateways               []*gateway
+	httpAddr               net.Addr
+	httpServer             *http.Server
 	clients                []*client
 	clientIDs              []uint64
 	clientMutex            *sync.Mutex
 	commandChannels        channels.ICommandChannels
 	protocolParser         protocol.IProtocolParser
 	protocolParserProducer protocol.IProtocolParserProducer
+	heartbeatInterval      time.Duration
+	maxMissedHeartbeats    int
+	handshakeTimeout       time.Duration
+	idAllocator            idallocator.IIDAllocator
+	outboundQueueSize      int
+	slowConsumerPolicy     SlowConsumerPolicy
+	shuttingDown           bool
+	// runID and connections make the connection keys of the clients, connections is counted under the client mutex
+	runID             string
+	connections       uint64
+	closeListenerOnce sync.Once
+	handlers          sync.WaitGroup
+	rooms             roomRegistry
+	topics            subscriptionTrie
+	nicks             nickDirectory
+	mailbox           mailbox.IMailbox
+	// mailboxMutex makes taking a nick and looking it up to put a message in its mailbox atomic,
+	// so no message is put in a mailbox which is already taken
+	mailboxMutex sync.Mutex
+	messageStore IMessageStore
+	// authenticator is set if the clients must authenticate before anything else,
+	// identityNicks makes the authenticated identity the nick of the client
+	authenticator auth.Authenticator
+	identityNicks bool
 }
 
+// gateway is a transport the server listens on next to its data streamer
+type gateway struct {
+	laddr        net.Addr
+	dataStreamer datastream.IDataStreamer
+}
+
+// errShuttingDown is returned when a client connects while the server is shutting down
+var errShuttingDown = errors.New("server is shutting down")
+
+// errIdentityConnected is returned when a client authenticates as an identity which is already connected with its nick
+var errIdentityConnected = errors.New("identity is already connected")
+
+// errNoMailbox is the reason a message to an offline nick is rejected when the server has no mailbox
+var errNoMailbox = errors.New("no mailbox")
+
+// ErrMailboxNeedsIdentityNicks is returned by Start when the server has a mailbox but not WithAuthenticator and
+// WithIdentityNicks, anybody could take a nick to read its mailbox then
+var ErrMailboxNeedsIdentityNicks = errors.New("mailbox needs authenticated identity nicks")
+
+// flushTimeout is how long a disconnecting client is given to receive its queued frames
+const flushTimeout = 5 * time.Second
+
+// defaultHandshakeTimeout is how long a new connection is given to complete the handshake, and to authenticate
+// if the server requires it
+const defaultHandshakeTimeout = 10 * time.Second
+
 // New is to create new server and return
-func New() *Server {
+func New(options ...Option) *Server {
 	commandChannelsProducer := channels.CommandChannelsProducer{}
 	commandChannels := commandChannelsProducer.Produce()
 
@@ -40,58 +135,186 @@ func New() *Server {
 
 	protocolParserProducer := &protocol.ProtocolParserProducer{}
 
-	return &Server{
+	server := &Server{
 		commandChannels:        commandChannels,
 		clientMutex:            &sync.Mutex{},
 		protocolParserProducer: protocolParserProducer,
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
+		outboundQueueSize:      defaultOutboundQueueSize,
+		handshakeTimeout:       defaultHandshakeTimeout,
+		runID:                  newRunID(),
 		dataStreamer:           dataStreamer}
+
+	for _, option := range options {
+		option(server)
+	}
+	return server
+}
+
+// checkOptions returns the error of the options which cannot be used together
+func (server *Server) checkOptions() error {
+	if server.mailbox != nil && (server.authenticator == nil || !server.identityNicks) {
+		return ErrMailboxNeedsIdentityNicks
+	}
+	return nil
+}
+
+// newRunID returns a random id telling the runs of the server apart, the connections of the clients without identity
+// are only recognized within the run
+func newRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
 }
 
 // Start function starts the server and make it ready to accept connections
-func (server *Server) Start(laddr *net.TCPAddr) error {
+func (server *Server) Start(laddr net.Addr) error {
+
+	if err := server.checkOptions(); err != nil {
+		log.Print(err)
+		return err
+	}
 
 	listener, err := server.dataStreamer.CreateListener(laddr)
 	if err != nil {
 		log.Print(err)
 		return err
 	}
-	server.dataStreamer = listener
 
-	go server.listen()
+	gatewayListeners := make([]datastream.IDataStreamer, 0, len(server.gateways))
+	closeListeners := func() {
+		listener.CloseListener()
+		for _, created := range gatewayListeners {
+			created.CloseListener()
+		}
+	}
+	for _, gateway := range server.gateways {
+		gatewayListener, err := gateway.dataStreamer.CreateListener(gateway.laddr)
+		if err != nil {
+			log.Print(err)
+			closeListeners()
+			return err
+		}
+		gatewayListeners = append(gatewayListeners, gatewayListener)
+	}
+
+	if server.httpAddr != nil {
+		httpListener, err := net.Listen(server.httpAddr.Network(), server.httpAddr.String())
+		if err != nil {
+			log.Print(err)
+			closeListeners()
+			return err
+		}
+		server.httpAddr = httpListener.Addr()
+		server.httpServer = &http.Server{Handler: server.httpHandler()}
+		go server.httpServer.Serve(httpListener)
+	}
+
+	server.dataStreamer = listener
+	server.addr = boundAddr(listener, laddr)
+	go server.listen(listener)
+	for i, gateway := range server.gateways {
+		gateway.dataStreamer = gatewayListeners[i]
+		gateway.laddr = boundAddr(gateway.dataStreamer, gateway.laddr)
+		go server.listen(gateway.dataStreamer)
+	}
 	return nil
 
 }
 
-func (server *Server) listen() error {
-	defer server.Stop()
+// boundAddr returns the address the listener is bound to, or the address it was created with if it cannot tell
+func boundAddr(listener datastream.IDataStreamer, laddr net.Addr) net.Addr {
+	if addrListener, ok := listener.(datastream.IAddrDataStreamer); ok {
+		return addrListener.Addr()
+	}
+	return laddr
+}
+
+// Addr returns the address the server listens on once it is started, with the port the system picked for port 0
+func (server *Server) Addr() net.Addr {
+	return server.addr
+}
+
+// GatewayAddrs returns the addresses the gateways listen on once the server is started, in the order they were added
+func (server *Server) GatewayAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(server.gateways))
+	for _, gateway := range server.gateways {
+		addrs = append(addrs, gateway.laddr)
+	}
+	return addrs
+}
+
+// HTTPAddr returns the address the HTTP API is served on once the server is started, nil without the HTTP API
+func (server *Server) HTTPAddr() net.Addr {
+	return server.httpAddr
+}
+
+// listen accepts the connections of the listener, the clients of all the listeners are served alike
+func (server *Server) listen(listener datastream.IDataStreamer) error {
 	for {
-		clientStreamer, err := server.dataStreamer.Accept()
+		clientStreamer, err := listener.Accept()
 
 		if err != nil {
+			// the listener is closed by Stop or Shutdown, they take care of the connections
+			if server.isShuttingDown() {
+				return nil
+			}
 			log.Print(err)
+			server.Stop()
 			return err
 		} else {
-			client := server.createClient(clientStreamer)
-			go server.serve(client)
+			client, err := server.createClient(clientStreamer)
+			if err != nil {
+				log.Printf("Cannot create client: %v", err)
+				clientStreamer.CloseConnection()
+				continue
+			}
+			go func() {
+				defer server.handlers.Done()
+				server.serve(client)
+			}()
 		}
 
 	}
 }
 
-func (server *Server) createClient(clientStreamer datastream.IDataStreamer) *client {
+// createClient adds the client of the connection, the other clients see it once it completes the handshake
+func (server *Server) createClient(clientStreamer datastream.IDataStreamer) (*client, error) {
 	server.clientMutex.Lock()
 	defer server.clientMutex.Unlock()
-	clientID := uint64(len(server.clients) + 1)
+
+	if server.shuttingDown {
+		return nil, errShuttingDown
+	}
+
+	clientID, err := server.idAllocator.Allocate()
+	if err != nil {
+		return nil, err
+	}
+
+	outboundQueueSize := server.outboundQueueSize
+	if outboundQueueSize <= 0 {
+		outboundQueueSize = defaultOutboundQueueSize
+	}
 
 	client := &client{
 		dataStreamer: clientStreamer,
 		id:           clientID,
+		outbound:     newOutboundQueue(outboundQueueSize),
+		writerDone:   make(chan struct{}),
+		handshaking:  true,
 	}
+	server.connections++
+	client.connectionKey = fmt.Sprintf("connection:%s:%d", server.runID, server.connections)
 
 	server.clients = append(server.clients, client)
 	server.clientIDs = append(server.clientIDs, client.id)
 
-	return client
+	// Shutdown waits for the client to be served
+	server.handlers.Add(1)
+	return client, nil
 }
 
 // serve function is to read streamed data from connected client and turn it to meaningful commands
@@ -100,7 +323,22 @@ func (server *Server) serve(client *client) {
 	// create new parser for this client only
 	protocolParser := server.protocolParserProducer.Produce()
 
+	// frames to this client are written by its own goroutine, so a slow client does not block the others
+	go server.write(client)
+
 	defer server.remove(client)
+	defer server.flush(client)
+
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+
+	// the client must not stay invisible forever, it is disconnected if it is not admitted in time
+	if server.handshakeTimeout > 0 {
+		deadline := time.AfterFunc(server.handshakeTimeout, func() {
+			server.checkHandshake(client)
+		})
+		defer deadline.Stop()
+	}
 
 	for {
 		data, err := client.dataStreamer.ReadByte()
@@ -114,87 +352,950 @@ func (server *Server) serve(client *client) {
 			break
 		}
 
+		// anything coming from the client shows the connection is alive
+		atomic.StoreInt32(&client.missedHeartbeats, 0)
+
 		command, err := protocolParser.ParseStreamedData(data)
 
+		// the parser skips the rest of oversized and malformed frames, so we can go on reading. The rejection goes
+		// to the request of the frame, so the client waiting for the response gets it.
+		if frameError, ok := err.(protocol.FrameError); ok {
+			log.Printf("Rejected frame from client %d: %v", client.id, err)
+			code := protocol.ErrorCodeMalformedCommand
+			if frameError.Err == protocol.ErrFrameTooLarge {
+				code = protocol.ErrorCodeFrameTooLarge
+			}
+			server.sendError(client, frameError.RequestID, code, frameError.CommandType, err.Error())
+			continue
+		}
+
+		// unknown commands are read completely, so we can go on reading as well
+		if unknownCommandError, ok := err.(protocol.UnknownCommandError); ok {
+			log.Printf("Rejected command from client %d: %v", client.id, err)
+			server.sendError(client, unknownCommandError.RequestID, protocol.ErrorCodeUnknownCommand, unknownCommandError.CommandType, err.Error())
+			continue
+		}
+
 		if err != nil {
 			log.Printf("Parse error %v", err)
 			break
 		}
 
 		if command != nil {
+			// nothing else is accepted until the client completes the handshake
+			if client.version == 0 {
+				err = server.handleHelloCommand(client, command)
+				if err == protocol.ErrUnsupportedVersion {
+					log.Printf("Handshake error %v", err)
+					server.sendError(client, 0, protocol.ErrorCodeUnsupportedVersion, protocol.CommandTypeHello, err.Error())
+					break
+				}
+				if err != nil {
+					log.Printf("Handshake error %v", err)
+					server.sendError(client, 0, protocol.ErrorCodeHandshakeRequired, protocol.CommandTypeUnknown, err.Error())
+					break
+				}
+
+				// every client is checked, the ones which do not support heartbeats must send something else in time
+				if server.heartbeatInterval > 0 {
+					go server.heartbeat(client, stopHeartbeat)
+				}
+
+				// a verified client certificate authenticates the client without AUTH
+				if identity := peerIdentity(client); identity != "" {
+					err = server.authenticateWithCertificate(client, identity)
+					if err != nil {
+						log.Printf("Authentication error for client %d: %v", client.id, err)
+						break
+					}
+				}
+				continue
+			}
+
+			// and nothing but authentication until the client authenticates, if the server requires it
+			if server.authenticator != nil && !server.isAdmitted(client) {
+				err = server.handleAuthCommand(client, command)
+				if err != nil {
+					log.Printf("Authentication error for client %d: %v", client.id, err)
+					break
+				}
+				continue
+			}
+
 			switch v := command.(type) {
 			case protocol.WhoAmICommand:
-				server.handleWhoAmICommand(client)
+				server.handleWhoAmICommand(client, v)
 				break
 			case protocol.ListClientsCommand:
-				server.handleListClientsCommand(client)
+				server.handleListClientsCommand(client, v)
 				break
 			case protocol.SendMessageCommand:
-				server.handleSendMessageCommand(client, command.(protocol.SendMessageCommand))
+				server.handleSendMessageCommand(client, v)
+				break
+			case protocol.PingCommand:
+				server.handlePingCommand(client)
+				break
+			case protocol.PongCommand:
+				// the client is alive, nothing else to do
+				break
+			case protocol.JoinRoomCommand:
+				server.handleJoinRoomCommand(client, v)
+				break
+			case protocol.LeaveRoomCommand:
+				server.handleLeaveRoomCommand(client, v)
+				break
+			case protocol.ListRoomsCommand:
+				server.handleListRoomsCommand(client, v)
+				break
+			case protocol.RoomMessageCommand:
+				server.handleRoomMessageCommand(client, v)
+				break
+			case protocol.BroadcastCommand:
+				server.handleBroadcastCommand(client, v)
+				break
+			case protocol.SubscribeCommand:
+				server.handleSubscribeCommand(client, v)
+				break
+			case protocol.UnsubscribeCommand:
+				server.handleUnsubscribeCommand(client, v)
+				break
+			case protocol.PublishCommand:
+				server.handlePublishCommand(client, v)
+				break
+			case protocol.SendToNickCommand:
+				server.handleSendToNickCommand(client, v)
+				break
+			case protocol.SetNickCommand:
+				server.handleSetNickCommand(client, v)
+				break
+			case protocol.LookupCommand:
+				server.handleLookupCommand(client, v)
+				break
+			case protocol.ListUsersCommand:
+				server.handleListUsersCommand(client, v)
+				break
+			case protocol.HistoryCommand:
+				server.handleHistoryCommand(client, v)
+				break
+			case protocol.AuthCommand:
+				server.sendError(client, v.RequestID, protocol.ErrorCodeNotAllowed, protocol.CommandTypeAuth, "already authenticated")
 				break
 			default:
 				log.Printf("Unknown command: %v", v)
+				server.sendError(client, correlationID(v), protocol.ErrorCodeUnknownCommand, protocol.CommandTypeUnknown, fmt.Sprintf("unexpected command %T", v))
 				break
 			}
 		}
 	}
 }
 
-// Stop accepting connections and close the existing ones
+// correlationID returns the request id of the command, or zero if it is not a request
+func correlationID(command interface{}) uint32 {
+	if correlated, ok := command.(protocol.ICorrelatedCommand); ok {
+		return correlated.CorrelationID()
+	}
+	return 0
+}
+
+// heartbeat checks the client every heartbeat interval until stop is closed or the client is disconnected
+func (server *Server) heartbeat(client *client, stop <-chan struct{}) {
+	ticker := time.NewTicker(server.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !server.checkHeartbeat(client) {
+			return
+		}
+	}
+}
+
+// checkHandshake disconnects the client if it has not completed the handshake, or authenticated if the server
+// requires it
+func (server *Server) checkHandshake(client *client) {
+	if server.isAdmitted(client) {
+		return
+	}
+
+	log.Printf("Client %d was not admitted in %v, disconnecting", client.id, server.handshakeTimeout)
+	// serve stops reading and removes the client once the connection is closed
+	client.dataStreamer.CloseConnection()
+}
+
+// checkHeartbeat pings the client if it supports heartbeats, or disconnects it and returns false if nothing came
+// from it for more than max missed heartbeats
+func (server *Server) checkHeartbeat(client *client) bool {
+	missed := atomic.AddInt32(&client.missedHeartbeats, 1)
+	if int(missed) > server.maxMissedHeartbeats {
+		log.Printf("Client %d missed %d heartbeats, disconnecting", client.id, missed-1)
+		// serve stops reading and removes the client once the connection is closed
+		client.dataStreamer.CloseConnection()
+		return false
+	}
+
+	// a client which cannot even take a ping will be disconnected when it misses enough of them
+	if client.has(protocol.CapabilityHeartbeat) {
+		ping := protocol.PingCommand{}
+		client.outbound.offer(ping.ToByteArray())
+	}
+	return true
+}
+
+// write writes the queued frames of the client to its connection until the queue is closed and empty
+func (server *Server) write(client *client) {
+	defer close(client.writerDone)
+
+	for {
+		frames, ok := client.outbound.popAll()
+		if !ok {
+			return
+		}
+
+		err := server.writeFrames(client, frames)
+		if err != nil {
+			log.Printf("Write error to client %d: %v", client.id, err)
+			// nothing can be written anymore, serve stops reading once the connection is closed
+			client.outbound.close()
+			client.dataStreamer.CloseConnection()
+			return
+		}
+	}
+}
+
+// writeFrames writes the frames and flushes them together
+func (server *Server) writeFrames(client *client, frames [][]byte) error {
+	for _, frame := range frames {
+		_, err := client.dataStreamer.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return client.dataStreamer.Flush()
+}
+
+// flush stops queueing frames to the client and waits for the writer to write the ones already queued
+func (server *Server) flush(client *client) {
+	client.outbound.close()
+
+	select {
+	case <-client.writerDone:
+	case <-time.After(flushTimeout):
+		log.Printf("Client %d did not take its queued frames in %v", client.id, flushTimeout)
+	}
+}
+
+// Stop accepting connections and close the existing ones without waiting for the queued frames
 func (server *Server) Stop() error {
+	server.stopAccepting()
+
 	server.clientMutex.Lock()
 	defer server.clientMutex.Unlock()
-	server.dataStreamer.CloseListener()
 	for i := 0; i < len(server.clients); i++ {
 		server.clients[i].dataStreamer.CloseConnection()
 	}
 	return nil
 }
 
+// Shutdown stops accepting connections, tells the clients the server is going away, and closes
+// their connections once their queued frames are written. If the context is done before all the
+// clients are served, the remaining connections are closed and the context error is returned.
+// It can be called more than once.
+func (server *Server) Shutdown(ctx context.Context) error {
+	clients := server.stopAccepting()
+
+	// nothing is queued after going away, and the connection is closed once it is written
+	goAway := protocol.GoAwayCommand{Reason: "server is shutting down"}
+	served := make(chan struct{})
+	for _, connected := range clients {
+		connected.outbound.closeAfter(goAway.ToByteArray())
+		go func(connected *client) {
+			select {
+			case <-connected.writerDone:
+				connected.dataStreamer.CloseConnection()
+			case <-served:
+			}
+		}(connected)
+	}
+
+	go func() {
+		server.handlers.Wait()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
+
+// stopAccepting closes the listeners once, and returns the clients connected until then
+func (server *Server) stopAccepting() []*client {
+	server.clientMutex.Lock()
+	server.shuttingDown = true
+	clients := append([]*client{}, server.clients...)
+	server.clientMutex.Unlock()
+
+	server.closeListenerOnce.Do(func() {
+		server.dataStreamer.CloseListener()
+		for _, gateway := range server.gateways {
+			gateway.dataStreamer.CloseListener()
+		}
+		if server.httpServer != nil {
+			server.httpServer.Close()
+		}
+	})
+	return clients
+}
+
+func (server *Server) isShuttingDown() bool {
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
+
+	return server.shuttingDown
+}
+
 // remove the connected client
 func (server *Server) remove(client *client) {
 	server.clientMutex.Lock()
-	defer server.clientMutex.Unlock()
+	removed := false
+	admitted := server.admitted(client)
 
 	// remove the connections from the clients array
 	for i, check := range server.clients {
 		if check == client {
 			server.clients = append(server.clients[:i], server.clients[i+1:]...)
 			server.clientIDs = append(server.clientIDs[:i], server.clientIDs[i+1:]...)
+			server.idAllocator.Release(client.id)
+			removed = true
 		}
 	}
+	server.clientMutex.Unlock()
+
+	server.rooms.leaveAll(client)
+	server.topics.unsubscribeAll(client)
+	server.nicks.remove(client)
 
 	client.dataStreamer.CloseConnection()
+
+	if removed && admitted {
+		server.announcePresence(client, protocol.PresenceLeft)
+	}
+}
+
+// announcePresence tells the other clients which opted in for presence that the client joined or left.
+// Nothing is announced while shutting down, all the clients are leaving then.
+func (server *Server) announcePresence(subject *client, event protocol.PresenceEvent) {
+	if server.isShuttingDown() {
+		return
+	}
+
+	presence := protocol.PresenceCommand{Event: event, ClientID: subject.id}
+	message := presence.ToByteArray()
+	for _, other := range server.connectedClients() {
+		if other != subject && other.has(protocol.CapabilityPresence) {
+			server.sendMessageToClient(other, message)
+		}
+	}
 }
 
-// ListClientIDs return the connected clients ids
+// ListClientIDs return the connected clients ids, the clients which have not completed the handshake
+// or authenticated yet are not listed
 func (server *Server) ListClientIDs() []uint64 {
-	return server.clientIDs
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
+
+	clientIDs := []uint64{}
+	for _, client := range server.clients {
+		if server.admitted(client) {
+			clientIDs = append(clientIDs, client.id)
+		}
+	}
+	return clientIDs
+}
+
+// admitted tells if the client can take part in the chat, which it can after the handshake, and after authenticating
+// if the server requires it. It must be called with the client mutex locked.
+func (server *Server) admitted(client *client) bool {
+	return !client.handshaking && (server.authenticator == nil || client.identity != "")
 }
 
-func (server *Server) sendMessageToClient(client *client, message []byte) {
+func (server *Server) isAdmitted(client *client) bool {
 	server.clientMutex.Lock()
 	defer server.clientMutex.Unlock()
-	client.dataStreamer.Write(message)
-	client.dataStreamer.Flush()
+
+	return server.admitted(client)
+}
+
+// sendMessageToClient queues the frame for the client, it returns false if the frame is dropped
+func (server *Server) sendMessageToClient(client *client, message []byte) bool {
+	// clients without extended frame support cannot read frames bigger than 64 KiB
+	if message[0]&protocol.FrameFlagExtended != 0 && !client.has(protocol.CapabilityExtendedFrames) {
+		log.Printf("Client %d does not support extended frames, dropping %d bytes", client.id, len(message))
+		return false
+	}
+
+	// the writer goroutine of the client writes it
+	err := server.enqueue(client, message)
+	if err != nil {
+		log.Printf("Dropping frame to client %d: %v", client.id, err)
+		return false
+	}
+	return true
+}
+
+// handleHelloCommand negotiates the protocol version and capabilities with the client, the other clients see it
+// from then on unless it must authenticate
+func (server *Server) handleHelloCommand(client *client, command interface{}) error {
+	hello, ok := command.(protocol.HelloCommand)
+	if !ok {
+		return protocol.ErrHandshakeRequired
+	}
+
+	if hello.Version < protocol.MinProtocolVersion {
+		return protocol.ErrUnsupportedVersion
+	}
+
+	// speak the highest version both sides know, with the capabilities both sides have
+	client.version = hello.Version
+	if client.version > protocol.ProtocolVersion {
+		client.version = protocol.ProtocolVersion
+	}
+	capabilities := hello.Capabilities & protocol.SupportedCapabilities
+	client.setCapabilities(capabilities)
+
+	welcome := protocol.WelcomeCommand{Version: client.version, Capabilities: capabilities}
+	server.sendMessageToClient(client, welcome.ToByteArray())
+
+	server.clientMutex.Lock()
+	client.handshaking = false
+	server.clientMutex.Unlock()
+
+	// clients which must authenticate are announced once they do
+	if server.authenticator == nil {
+		server.announcePresence(client, protocol.PresenceJoined)
+	}
+	return nil
+}
+
+// handleAuthCommand authenticates the client with its credentials. Once it is authenticated, the other clients
+// can see it and it can send commands. If identity nicks are configured, the identity becomes its nick.
+func (server *Server) handleAuthCommand(client *client, command interface{}) error {
+	authCommand, ok := command.(protocol.AuthCommand)
+	if !ok {
+		server.sendError(client, correlationID(command), protocol.ErrorCodeAuthenticationRequired, protocol.CommandTypeUnknown, protocol.ErrAuthenticationRequired.Error())
+		return protocol.ErrAuthenticationRequired
+	}
+
+	identity, err := server.authenticator.Authenticate(auth.Credentials{Scheme: authCommand.Scheme, Username: authCommand.Username, Secret: authCommand.Secret})
+	if err == nil && identity == "" {
+		err = auth.ErrInvalidCredentials
+	}
+	if err != nil {
+		server.sendError(client, authCommand.RequestID, protocol.ErrorCodeAuthenticationFailed, protocol.CommandTypeAuth, err.Error())
+		return err
+	}
+
+	messages, err := server.setIdentity(client, identity)
+	if err != nil {
+		server.sendError(client, authCommand.RequestID, protocol.ErrorCodeAuthenticationFailed, protocol.CommandTypeAuth, fmt.Sprintf("%q: %v", identity, err))
+		return err
+	}
+
+	reply := protocol.AuthCommand{RequestID: authCommand.RequestID, Scheme: authCommand.Scheme, Identity: identity}
+	server.sendMessageToClient(client, reply.ToByteArray())
+
+	server.introduce(client, identity, messages)
+	return nil
+}
+
+// authenticateWithCertificate authenticates the client as the identity of its certificate, like AUTH would
+func (server *Server) authenticateWithCertificate(client *client, identity string) error {
+	messages, err := server.setIdentity(client, identity)
+	if err != nil {
+		server.sendError(client, 0, protocol.ErrorCodeAuthenticationFailed, protocol.CommandTypeUnknown, fmt.Sprintf("%q: %v", identity, err))
+		return err
+	}
+
+	server.introduce(client, identity, messages)
+	return nil
 }
 
-func (server *Server) handleWhoAmICommand(client *client) {
-	command := protocol.WhoAmICommand{ClientID: client.id}
+// setIdentity gives the authenticated identity to the client. If identity nicks are configured, the identity becomes
+// the nick of the client and the messages waiting in the mailbox of the nick are returned.
+func (server *Server) setIdentity(client *client, identity string) ([]mailbox.Message, error) {
+	var messages []mailbox.Message
+	if server.identityNicks {
+		var ok bool
+		if _, messages, ok = server.takeNick(client, identity); !ok {
+			return nil, errIdentityConnected
+		}
+	}
+
+	server.clientMutex.Lock()
+	client.identity = identity
+	server.clientMutex.Unlock()
+	return messages, nil
+}
+
+// introduce passes the mailbox messages to the client which got its identity, and tells the other clients about it.
+// Clients which had to authenticate are only announced now.
+func (server *Server) introduce(client *client, identity string, messages []mailbox.Message) {
+	if server.identityNicks {
+		server.nickTaken(client, "", identity, messages)
+	}
+	if server.authenticator != nil {
+		server.announcePresence(client, protocol.PresenceJoined)
+	}
+}
+
+// peerIdentity returns the identity the connection of the client proves, like the name in a verified client certificate
+func peerIdentity(client *client) string {
+	peer, ok := client.dataStreamer.(datastream.IPeerIdentity)
+	if !ok {
+		return ""
+	}
+
+	identity, err := peer.PeerIdentity()
+	if err != nil {
+		log.Printf("Cannot get the identity of client %d: %v", client.id, err)
+		return ""
+	}
+	return identity
+}
+
+func (server *Server) handlePingCommand(client *client) {
+	pong := protocol.PongCommand{}
+	server.sendMessageToClient(client, pong.ToByteArray())
+}
+
+func (server *Server) handleWhoAmICommand(client *client, query protocol.WhoAmICommand) {
+	command := protocol.WhoAmICommand{RequestID: query.RequestID, ClientID: client.id}
 	server.sendMessageToClient(client, command.ToByteArray())
 }
 
-func (server *Server) handleListClientsCommand(client *client) {
-	command := protocol.ListClientsCommand{ConnectedClients: server.clientIDs}
+func (server *Server) handleListClientsCommand(client *client, query protocol.ListClientsCommand) {
+	command := protocol.ListClientsCommand{RequestID: query.RequestID, ConnectedClients: server.ListClientIDs()}
 	server.sendMessageToClient(client, command.ToByteArray(client.id))
 }
 
+// handleSendMessageCommand passes the message to the recipients. If the client waits for the result of the
+// message, it gets which recipients the message is queued for, otherwise it is only told about the unknown ones.
 func (server *Server) handleSendMessageCommand(client *client, command protocol.SendMessageCommand) {
-	msgFromClientCommand := protocol.MessageFromClient{Body: command.Body, SenderID: client.id}
-	for i := 0; i < len(command.Recipients); i++ {
-		recipient := server.getClientByID(command.Recipients[i])
-		server.sendMessageToClient(recipient, msgFromClientCommand.ToByteArray())
+	messageID, delivered, failed, unknownRecipients := server.sendMessage(client, command.Recipients, command.Body)
+
+	if command.RequestID != 0 {
+		result := protocol.SendResultCommand{RequestID: command.RequestID, MessageID: messageID, Delivered: delivered, Failed: failed}
+		server.sendMessageToClient(client, result.ToByteArray())
+		return
+	}
+
+	if len(unknownRecipients) > 0 {
+		server.sendError(client, command.RequestID, protocol.ErrorCodeUnknownRecipient, protocol.CommandTypeSendMessage, fmt.Sprintf("unknown recipients %v", unknownRecipients))
+	}
+}
+
+// sendMessage passes the message of the sender to the recipients and records it. It returns the id of the message,
+// the recipients it is queued for and the ones it is not, the failed ones include the unknown ones.
+func (server *Server) sendMessage(sender *client, recipients []uint64, body []byte) (uint64, []uint64, []uint64, []uint64) {
+	messageID := atomic.AddUint64(&server.lastMessageID, 1)
+	message := server.messageFromClient(sender, body)
+
+	var unknownRecipients, delivered, failed []uint64
+	var deliveredClients []*client
+	for i := 0; i < len(recipients); i++ {
+		recipient := server.connectedClient(recipients[i])
+		if recipient == nil {
+			unknownRecipients = append(unknownRecipients, recipients[i])
+			failed = append(failed, recipients[i])
+			continue
+		}
+
+		if server.sendMessageToClient(recipient, message(recipient)) {
+			delivered = append(delivered, recipient.id)
+			deliveredClients = append(deliveredClients, recipient)
+		} else {
+			failed = append(failed, recipient.id)
+		}
 	}
+
+	server.record(sender, deliveredClients, "", body, time.Now())
+	return messageID, delivered, failed, unknownRecipients
+}
+
+// handleBroadcastCommand passes the message to all the clients connected at the moment except the sender
+func (server *Server) handleBroadcastCommand(sender *client, command protocol.BroadcastCommand) {
+	message := server.messageFromClient(sender, command.Body)
+	var delivered []*client
+	for _, recipient := range server.connectedClients() {
+		if recipient != sender && server.sendMessageToClient(recipient, message(recipient)) {
+			delivered = append(delivered, recipient)
+		}
+	}
+	server.record(sender, delivered, "", command.Body, time.Now())
+}
+
+// messageFromClient encodes the message of the sender, the returned function gives the frame for a recipient.
+// The nick of the sender is only sent to the recipients which support nicks.
+func (server *Server) messageFromClient(sender *client, body []byte) func(recipient *client) []byte {
+	msgFromClientCommand := protocol.MessageFromClient{Body: body, SenderID: sender.id}
+	message := msgFromClientCommand.ToByteArray()
+
+	msgFromClientCommand.SenderNick = server.nicks.nick(sender)
+	if sender.id == APISenderID {
+		// the HTTP API cannot take a nick, it sends as its identity
+		msgFromClientCommand.SenderNick = sender.identity
+	}
+	if msgFromClientCommand.SenderNick == "" {
+		return func(recipient *client) []byte {
+			return message
+		}
+	}
+
+	messageWithNick := msgFromClientCommand.ToByteArray()
+	return func(recipient *client) []byte {
+		if recipient.has(protocol.CapabilityNicknames) {
+			return messageWithNick
+		}
+		return message
+	}
+}
+
+// handleSetNickCommand gives the nick to the client, passes it the messages waiting in the mailbox of the nick
+// and tells the other clients about the change
+func (server *Server) handleSetNickCommand(client *client, command protocol.SetNickCommand) {
+	if server.identityNicks {
+		server.sendError(client, command.RequestID, protocol.ErrorCodeNotAllowed, protocol.CommandTypeSetNick, "the nick is the authenticated identity")
+		return
+	}
+
+	oldNick, messages, ok := server.takeNick(client, command.Nick)
+	if !ok {
+		server.sendError(client, command.RequestID, protocol.ErrorCodeNickTaken, protocol.CommandTypeSetNick, fmt.Sprintf("nick %q is taken", command.Nick))
+		return
+	}
+	server.sendMessageToClient(client, command.ToByteArray())
+
+	if oldNick != command.Nick {
+		server.nickTaken(client, oldNick, command.Nick, messages)
+	}
+}
+
+// takeNick gives the nick to the client and takes the messages waiting in the mailbox of the nick,
+// it returns false if another client has the nick
+func (server *Server) takeNick(client *client, nick string) (string, []mailbox.Message, bool) {
+	server.mailboxMutex.Lock()
+	defer server.mailboxMutex.Unlock()
+
+	oldNick, ok := server.nicks.set(client, nick)
+	if !ok || oldNick == nick || server.mailbox == nil {
+		return oldNick, nil, ok
+	}
+
+	messages, err := server.mailbox.Take(nick)
+	if err != nil {
+		log.Printf("Cannot take the mailbox of %q: %v", nick, err)
+	}
+	return oldNick, messages, true
+}
+
+// nickTaken passes the messages taken from the mailbox of the new nick to the client and tells the other clients about the change
+func (server *Server) nickTaken(client *client, oldNick string, nick string, messages []mailbox.Message) {
+	for _, message := range messages {
+		msgFromClientCommand := protocol.MessageFromClient{SenderID: message.SenderID, Body: message.Body}
+		if client.has(protocol.CapabilityNicknames) {
+			msgFromClientCommand.SenderNick = message.SenderNick
+		}
+		if server.sendMessageToClient(client, msgFromClientCommand.ToByteArray()) {
+			// the mailbox is only kept for identity nicks, so the nick of the sender is its identity
+			server.recordMessage(HistoryRecord{
+				Message:       protocol.HistoryMessage{Time: message.Time, SenderID: message.SenderID, Recipients: []uint64{client.id}, Body: message.Body},
+				SenderKey:     identityKey(message.SenderNick),
+				RecipientKeys: server.historyKeys(client),
+			})
+		}
+	}
+
+	nickChanged := protocol.NickChangedCommand{ClientID: client.id, OldNick: oldNick, Nick: nick}
+	message := nickChanged.ToByteArray()
+	for _, other := range server.connectedClients() {
+		if other != client && other.has(protocol.CapabilityNicknames) {
+			server.sendMessageToClient(other, message)
+		}
+	}
+}
+
+// handleSendToNickCommand passes the message to the client with the nick, or keeps it in the mailbox of the nick
+// if nobody has the nick. A message kept in the mailbox is neither delivered nor failed in the result.
+func (server *Server) handleSendToNickCommand(sender *client, command protocol.SendToNickCommand) {
+	server.mailboxMutex.Lock()
+	recipient := server.nicks.lookup(command.Nick)
+	if recipient != nil {
+		server.mailboxMutex.Unlock()
+		if server.sendMessageToClient(recipient, server.messageFromClient(sender, command.Body)(recipient)) {
+			server.record(sender, []*client{recipient}, "", command.Body, time.Now())
+			server.sendResult(sender, command.RequestID, []uint64{recipient.id}, nil)
+		} else {
+			server.sendResult(sender, command.RequestID, nil, []uint64{recipient.id})
+		}
+		return
+	}
+
+	err := errNoMailbox
+	if server.mailbox != nil {
+		err = server.mailbox.Put(command.Nick, mailbox.Message{SenderID: sender.id, SenderNick: server.nicks.nick(sender), Body: command.Body})
+	}
+	server.mailboxMutex.Unlock()
+
+	if err != nil {
+		server.sendError(sender, command.RequestID, protocol.ErrorCodeNotDelivered, protocol.CommandTypeSendToNick, fmt.Sprintf("%q is offline: %v", command.Nick, err))
+		return
+	}
+	server.sendResult(sender, command.RequestID, nil, nil)
+}
+
+// sendResult tells the client which waits for the result of its message which recipients the message is queued for
+func (server *Server) sendResult(client *client, requestID uint32, delivered []uint64, failed []uint64) {
+	if requestID == 0 {
+		return
+	}
+
+	result := protocol.SendResultCommand{RequestID: requestID, MessageID: atomic.AddUint64(&server.lastMessageID, 1), Delivered: delivered, Failed: failed}
+	server.sendMessageToClient(client, result.ToByteArray())
+}
+
+// handleLookupCommand finds the client by nick, or by id if the query has no nick
+func (server *Server) handleLookupCommand(requester *client, query protocol.LookupCommand) {
+	var found *client
+	if query.Nick != "" {
+		found = server.nicks.lookup(query.Nick)
+	} else {
+		found = server.connectedClient(query.ClientID)
+	}
+
+	if found == nil {
+		server.sendError(requester, query.RequestID, protocol.ErrorCodeNotFound, protocol.CommandTypeLookup, fmt.Sprintf("no client with nick %q or id %d", query.Nick, query.ClientID))
+		return
+	}
+
+	command := protocol.LookupCommand{RequestID: query.RequestID, ClientID: found.id, Nick: server.nicks.nick(found)}
+	server.sendMessageToClient(requester, command.ToByteArray())
+}
+
+// handleListUsersCommand lists the other clients with their nicks, like handleListClientsCommand lists their ids
+func (server *Server) handleListUsersCommand(client *client, query protocol.ListUsersCommand) {
+	var users []protocol.User
+	for _, other := range server.connectedClients() {
+		if other != client {
+			users = append(users, protocol.User{ID: other.id, Nick: server.nicks.nick(other)})
+		}
+	}
+
+	command := protocol.ListUsersCommand{RequestID: query.RequestID, Users: users}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+// connectedClients returns the clients connected at the moment, except the ones which have not authenticated yet.
+// Sending can wait for a slow client, so the list is copied instead of being locked while sending.
+func (server *Server) connectedClients() []*client {
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
+
+	clients := make([]*client, 0, len(server.clients))
+	for _, client := range server.clients {
+		if server.admitted(client) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (server *Server) handleJoinRoomCommand(client *client, command protocol.JoinRoomCommand) {
+	server.rooms.join(command.Room, client)
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+func (server *Server) handleLeaveRoomCommand(client *client, command protocol.LeaveRoomCommand) {
+	if !server.rooms.leave(command.Room, client) {
+		server.sendError(client, command.RequestID, protocol.ErrorCodeNotInRoom, protocol.CommandTypeLeaveRoom, fmt.Sprintf("not in room %q", command.Room))
+		return
+	}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+func (server *Server) handleListRoomsCommand(client *client, query protocol.ListRoomsCommand) {
+	command := protocol.ListRoomsCommand{RequestID: query.RequestID, Rooms: server.rooms.list()}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+// handleRoomMessageCommand passes the message to the other members of the room, only members can send to a room.
+// If the sender waits for the result, it gets which members the message is queued for.
+func (server *Server) handleRoomMessageCommand(sender *client, command protocol.RoomMessageCommand) {
+	members, ok := server.rooms.members(command.Room, sender)
+	if !ok {
+		server.sendError(sender, command.RequestID, protocol.ErrorCodeNotInRoom, protocol.CommandTypeRoomMessage, fmt.Sprintf("not in room %q", command.Room))
+		return
+	}
+
+	roomMessage := protocol.RoomMessageCommand{Room: command.Room, SenderID: sender.id, Body: command.Body}
+	message := roomMessage.ToByteArray()
+	var delivered, failed []uint64
+	var deliveredMembers []*client
+	for _, member := range members {
+		if member == sender {
+			continue
+		}
+		if server.sendMessageToClient(member, message) {
+			delivered = append(delivered, member.id)
+			deliveredMembers = append(deliveredMembers, member)
+		} else {
+			failed = append(failed, member.id)
+		}
+	}
+	server.record(sender, deliveredMembers, command.Room, command.Body, time.Now())
+	server.sendResult(sender, command.RequestID, delivered, failed)
+}
+
+// record keeps the message of the sender in the history if it reached any recipient
+func (server *Server) record(sender *client, recipients []*client, room string, body []byte, at time.Time) {
+	if len(recipients) == 0 || server.messageStore == nil {
+		return
+	}
+
+	message := protocol.HistoryMessage{Time: at, SenderID: sender.id, Room: room, Body: body}
+	for _, recipient := range recipients {
+		message.Recipients = append(message.Recipients, recipient.id)
+	}
+	keys := server.historyKeys(append([]*client{sender}, recipients...)...)
+	server.recordMessage(HistoryRecord{Message: message, SenderKey: keys[0], RecipientKeys: keys[1:]})
+}
+
+func (server *Server) recordMessage(record HistoryRecord) {
+	if server.messageStore == nil {
+		return
+	}
+
+	if _, err := server.messageStore.Append(record); err != nil {
+		log.Printf("Cannot record message of client %d: %v", record.Message.SenderID, err)
+	}
+}
+
+// historyKeys returns the keys the history of the clients is kept under, the authenticated identity of a client
+// or its connection if it has none. Client ids are given to other clients later, so they cannot be the keys.
+func (server *Server) historyKeys(clients ...*client) []string {
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
+
+	keys := make([]string, len(clients))
+	for i, client := range clients {
+		keys[i] = client.connectionKey
+		if client.identity != "" {
+			keys[i] = identityKey(client.identity)
+		}
+	}
+	return keys
+}
+
+// identityKey is the history key of the clients authenticated as the identity
+func identityKey(identity string) string {
+	return "identity:" + identity
+}
+
+// handleHistoryCommand returns a page of the messages the client sent or received, and the cursor of the next page.
+// Only the members of a room can read its history.
+func (server *Server) handleHistoryCommand(client *client, query protocol.HistoryCommand) {
+	if server.messageStore == nil {
+		server.sendError(client, query.RequestID, protocol.ErrorCodeHistoryUnavailable, protocol.CommandTypeHistory, "history is not kept")
+		return
+	}
+
+	if query.Query.Room != "" {
+		if _, ok := server.rooms.members(query.Query.Room, client); !ok {
+			server.sendError(client, query.RequestID, protocol.ErrorCodeNotInRoom, protocol.CommandTypeHistory, fmt.Sprintf("not in room %q", query.Query.Room))
+			return
+		}
+	}
+
+	limit := int(query.Query.Limit)
+	if limit == 0 || limit > protocol.MaxHistoryLimit {
+		limit = protocol.MaxHistoryLimit
+	}
+
+	// the id of the peer is only its id while it is connected, its messages are found by its key
+	filter := HistoryFilter{Participant: server.historyKeys(client)[0], Room: query.Query.Room}
+	if query.Query.Peer != 0 {
+		peer := server.connectedClient(query.Query.Peer)
+		if peer == nil {
+			server.sendError(client, query.RequestID, protocol.ErrorCodeUnknownRecipient, protocol.CommandTypeHistory, fmt.Sprintf("peer %d is not connected", query.Query.Peer))
+			return
+		}
+		filter.Peer = server.historyKeys(peer)[0]
+	}
+
+	// one more message tells if there is a next page
+	messages, err := server.messageStore.Query(filter, query.Query.Before, limit+1)
+	if err != nil {
+		log.Printf("Cannot read history for client %d: %v", client.id, err)
+		server.sendError(client, query.RequestID, protocol.ErrorCodeHistoryUnavailable, protocol.CommandTypeHistory, err.Error())
+		return
+	}
+
+	command := protocol.HistoryCommand{RequestID: query.RequestID, Query: query.Query, Messages: messages}
+	if len(messages) > limit {
+		command.Messages = messages[:limit]
+		command.Next = messages[limit-1].ID
+	}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+func (server *Server) handleSubscribeCommand(client *client, command protocol.SubscribeCommand) {
+	server.topics.subscribe(command.Pattern, client)
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+func (server *Server) handleUnsubscribeCommand(client *client, command protocol.UnsubscribeCommand) {
+	if !server.topics.unsubscribe(command.Pattern, client) {
+		server.sendError(client, command.RequestID, protocol.ErrorCodeNotSubscribed, protocol.CommandTypeUnsubscribe, fmt.Sprintf("not subscribed to %q", command.Pattern))
+		return
+	}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+// handlePublishCommand passes the message to the other clients subscribed to the topic,
+// a client with several matching patterns gets the message once
+func (server *Server) handlePublishCommand(client *client, command protocol.PublishCommand) {
+	topicMessage := protocol.TopicMessageCommand{Topic: command.Topic, SenderID: client.id, Body: command.Body}
+	message := topicMessage.ToByteArray()
+	for _, subscriber := range server.topics.match(command.Topic) {
+		if subscriber != client {
+			server.sendMessageToClient(subscriber, message)
+		}
+	}
+}
+
+// sendError tells the client that its command is rejected, requestID is the request id of the rejected command if any
+func (server *Server) sendError(client *client, requestID uint32, code protocol.ErrorCode, refCommandType protocol.CommandType, message string) {
+	command := protocol.ErrorCommand{RequestID: requestID, Code: code, RefCommandType: refCommandType, Message: message}
+	server.sendMessageToClient(client, command.ToByteArray())
+}
+
+// connectedClient returns the connected client with the id, or nil if there is none or it has not authenticated yet
+func (server *Server) connectedClient(clientID uint64) *client {
+	server.clientMutex.Lock()
+	defer server.clientMutex.Unlock()
+
+	client := server.getClientByID(clientID)
+	if client == nil || !server.admitted(client) {
+		return nil
+	}
+	return client
 }
 
 func (server *Server) getClientByID(clientID uint64) *client {
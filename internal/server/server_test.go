@@ -1,15 +1,21 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Applifier/golang-backend-assignment/auth"
 	"github.com/Applifier/golang-backend-assignment/channels"
 	"github.com/Applifier/golang-backend-assignment/datastream"
+	"github.com/Applifier/golang-backend-assignment/idallocator"
+	"github.com/Applifier/golang-backend-assignment/mailbox"
 	"github.com/Applifier/golang-backend-assignment/protocol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -27,8 +33,27 @@ var (
 		Recipients: []uint64{uint64(1)},
 		Body:       []byte("hello"),
 	}
+	fakeHelloCommand = protocol.HelloCommand{
+		Version:      protocol.ProtocolVersion,
+		Capabilities: protocol.SupportedCapabilities,
+	}
 )
 
+// newFakeClient creates a client which completed the handshake with the capabilities, its frames stay in its outbound queue
+func newFakeClient(dataStreamer datastream.IDataStreamer, id uint64, capabilities ...protocol.Capability) *client {
+	fakeClient := &client{
+		dataStreamer:  dataStreamer,
+		id:            id,
+		outbound:      newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:    make(chan struct{}),
+		connectionKey: fmt.Sprintf("connection:test:%d", id),
+	}
+	for _, capability := range capabilities {
+		fakeClient.capabilities |= capability
+	}
+	return fakeClient
+}
+
 func TestNewMethodShouldCreateNewServerInstance(t *testing.T) {
 	server := New()
 	assert.NotNil(t, server)
@@ -45,6 +70,7 @@ func TestStartFunctionShouldReturnNoErrorIfListenerIsCreated(t *testing.T) {
 		commandChannels:        fakeCommandChannels,
 		dataStreamer:           fakeDataStreamer,
 		protocolParserProducer: fakeProtocolParserProducer,
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
 		clientMutex:            &sync.Mutex{}}
 
 	fakeDataStreamer.On("CreateListener", mock.Anything).Return(fakeDataStreamer, nil).Once()
@@ -83,6 +109,68 @@ func TestStartFunctionShouldReturnErrorIfListenerCannotCreated(t *testing.T) {
 	assert.Error(t, response)
 }
 
+func TestStartFunctionShouldListenOnGatewaysAndStopThemWithTheServer(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeGateway := new(datastream.MockTcpDataStream)
+	fakeGatewayListener := new(datastream.MockTcpDataStream)
+	fakeGatewayAddress := net.TCPAddr{Port: 8080}
+	fakeDataStreamerProducer := new(datastream.MockDataStreamerProducer)
+	fakeGatewayProducer := new(datastream.MockDataStreamerProducer)
+	fakeDataStreamerProducer.On("Produce").Return(fakeDataStreamer)
+	fakeGatewayProducer.On("Produce").Return(fakeGateway)
+	server := New(WithDataStreamerProducer(fakeDataStreamerProducer), WithGateway(&fakeGatewayAddress, fakeGatewayProducer))
+
+	var accepting sync.WaitGroup
+	accepting.Add(2)
+	stopped := make(chan struct{})
+	fakeDataStreamer.On("CreateListener", &fakeAddress).Return(fakeListener, nil).Once()
+	fakeGateway.On("CreateListener", &fakeGatewayAddress).Return(fakeGatewayListener, nil).Once()
+	// the listeners fail to accept once they are closed
+	fakeListener.On("Accept").Return(fakeListener, errors.New("listener closed")).Run(func(args mock.Arguments) {
+		accepting.Done()
+		<-stopped
+	}).Once()
+	fakeGatewayListener.On("Accept").Return(fakeGatewayListener, errors.New("listener closed")).Run(func(args mock.Arguments) {
+		accepting.Done()
+		<-stopped
+	}).Once()
+	fakeListener.On("CloseListener").Return(nil).Once()
+	fakeGatewayListener.On("CloseListener").Return(nil).Once()
+
+	assert.Nil(t, server.Start(&fakeAddress))
+	accepting.Wait()
+	assert.Nil(t, server.Stop())
+	close(stopped)
+
+	fakeDataStreamer.AssertExpectations(t)
+	fakeGateway.AssertExpectations(t)
+	fakeListener.AssertExpectations(t)
+	fakeGatewayListener.AssertExpectations(t)
+}
+
+func TestStartFunctionShouldCloseTheListenerIfGatewayCannotListen(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeGateway := new(datastream.MockTcpDataStream)
+	fakeDataStreamerProducer := new(datastream.MockDataStreamerProducer)
+	fakeGatewayProducer := new(datastream.MockDataStreamerProducer)
+	fakeDataStreamerProducer.On("Produce").Return(fakeDataStreamer)
+	fakeGatewayProducer.On("Produce").Return(fakeGateway)
+	server := New(WithDataStreamerProducer(fakeDataStreamerProducer), WithGateway(&net.TCPAddr{Port: 8080}, fakeGatewayProducer))
+
+	fakeListenerError := errors.New("address already in use")
+	fakeDataStreamer.On("CreateListener", &fakeAddress).Return(fakeListener, nil).Once()
+	fakeGateway.On("CreateListener", mock.Anything).Return(fakeGateway, fakeListenerError).Once()
+	fakeListener.On("CloseListener").Return(nil).Once()
+
+	assert.Equal(t, fakeListenerError, server.Start(&fakeAddress))
+	fakeListener.AssertExpectations(t)
+	fakeListener.AssertNotCalled(t, "Accept")
+}
+
 func TestAcceptFunctionShouldCreateClientObjectAndSetClientID(t *testing.T) {
 
 	fakeDataStreamer := new(datastream.MockTcpDataStream)
@@ -92,9 +180,11 @@ func TestAcceptFunctionShouldCreateClientObjectAndSetClientID(t *testing.T) {
 		commandChannels:        fakeCommandChannels,
 		dataStreamer:           fakeDataStreamer,
 		protocolParserProducer: fakeProtocolParserProducer,
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
 		clientMutex:            &sync.Mutex{}}
 
-	response := server.createClient(fakeDataStreamer)
+	response, err := server.createClient(fakeDataStreamer)
+	assert.Nil(t, err)
 	assert.Equal(t, response.id, uint64(1))
 	assert.Equal(t, response.dataStreamer, fakeDataStreamer)
 }
@@ -114,6 +204,8 @@ func TestServeFunctionShouldCloseConnectionIfEOFRead(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), io.EOF).Once()
@@ -140,6 +232,8 @@ func TestServeFunctionShouldCloseConnectionIfReadError(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), errors.New("read error")).Once()
@@ -166,6 +260,8 @@ func TestServeFunctionShouldCloseConnectionIfParseError(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil).Once()
@@ -193,10 +289,16 @@ func TestServeFunctionShouldSendWhoAmICommandIfReceiveWhoAmICommand(t *testing.T
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil)
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeHelloCommand, nil).Once()
 	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeWhoAmICommand, nil)
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWelcome))
+	}).Once()
 	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
 
 	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
@@ -217,10 +319,14 @@ func TestServeFunctionShouldSendConnectedClientsIfReceiveListClientsCommand(t *t
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	fakeClient2 := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	server := &Server{
 		commandChannels:        fakeCommandChannels,
@@ -232,7 +338,11 @@ func TestServeFunctionShouldSendConnectedClientsIfReceiveListClientsCommand(t *t
 		clientMutex:            &sync.Mutex{}}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil)
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeHelloCommand, nil).Once()
 	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeConnectedClientsCommand, nil)
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWelcome))
+	}).Once()
 	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
 
 	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
@@ -253,6 +363,8 @@ func TestServeFunctionShouldSendMessageIfReceiveSendMessageCommand(t *testing.T)
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	server := &Server{
 		commandChannels:        fakeCommandChannels,
@@ -261,10 +373,15 @@ func TestServeFunctionShouldSendMessageIfReceiveSendMessageCommand(t *testing.T)
 		protocolParserProducer: fakeProtocolParserProducer,
 		clients:                []*client{fakeClient},
 		clientIDs:              []uint64{fakeClient.id},
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
 		clientMutex:            &sync.Mutex{}}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil)
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeHelloCommand, nil).Once()
 	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeSendMsgCommand, nil)
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWelcome))
+	}).Once()
 	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
 
 	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
@@ -285,6 +402,8 @@ func TestServeFunctionShouldNotSendMessageIfReceivedCommandIsNotKnown(t *testing
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	server := &Server{
 		commandChannels:        fakeCommandChannels,
@@ -293,11 +412,20 @@ func TestServeFunctionShouldNotSendMessageIfReceivedCommandIsNotKnown(t *testing
 		protocolParserProducer: fakeProtocolParserProducer,
 		clients:                []*client{fakeClient},
 		clientIDs:              []uint64{fakeClient.id},
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
 		clientMutex:            &sync.Mutex{}}
 
 	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil)
 	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeHelloCommand, nil).Once()
 	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return("UnknownCommand", nil)
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWelcome))
+	}).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeError))
+	})
+	fakeDataStreamer.On("Flush", mock.Anything).Return(nil)
 
 	go server.serve(fakeClient)
 	time.Sleep(20 * time.Millisecond) // to ensure above routine started
@@ -309,6 +437,8 @@ func TestListClientIDs(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	fakeClientIDs := []uint64{fakeClient.id}
@@ -331,10 +461,14 @@ func TestStopShouldCloseListenerAndCloseExistingConnections(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	fakeClient2 := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	server := &Server{
@@ -354,6 +488,7 @@ func TestStopShouldCloseListenerAndCloseExistingConnections(t *testing.T) {
 
 func TestRemoveFunctionShouldRemoveClientFromTheClients(t *testing.T) {
 
+	fakeIDAllocator := new(idallocator.MockIDAllocator)
 	fakeCommandChannels := new(channels.MockCommandChannels)
 	fakeProtocolParser := new(protocol.MockProtocolParser)
 	fakeProtocolParserProducer := new(protocol.MockProtocolParserProducer)
@@ -361,10 +496,14 @@ func TestRemoveFunctionShouldRemoveClientFromTheClients(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	fakeClient2 := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	server := &Server{
@@ -374,11 +513,14 @@ func TestRemoveFunctionShouldRemoveClientFromTheClients(t *testing.T) {
 		protocolParserProducer: fakeProtocolParserProducer,
 		clients:                []*client{fakeClient, fakeClient2},
 		clientIDs:              []uint64{fakeClient.id, fakeClient2.id},
+		idAllocator:            fakeIDAllocator,
 		clientMutex:            &sync.Mutex{}}
 
 	fakeDataStreamer.On("CloseConnection").Return(nil).Twice()
+	fakeIDAllocator.On("Release", fakeClient.id).Once()
 	server.remove(fakeClient)
 
+	fakeIDAllocator.AssertExpectations(t)
 	assert.Equal(t, len(server.clients), 1)
 	assert.Equal(t, len(server.clientIDs), 1)
 	assert.Equal(t, server.clients[0], fakeClient2)
@@ -390,10 +532,14 @@ func TestGetClientByIDShouldReturnNilIfClientCannotFound(t *testing.T) {
 	fakeClient := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 	fakeClient2 := &client{
 		dataStreamer: fakeDataStreamer,
 		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
 	}
 
 	server := &Server{
@@ -407,3 +553,1151 @@ func TestGetClientByIDShouldReturnNilIfClientCannotFound(t *testing.T) {
 
 	assert.Nil(t, response)
 }
+
+func TestNewWithMaxFrameSizeShouldConfigureProtocolParserProducer(t *testing.T) {
+	server := New(WithMaxFrameSize(1024))
+	assert.Equal(t, &protocol.ProtocolParserProducer{MaxFrameSize: 1024}, server.protocolParserProducer)
+}
+
+func TestServeFunctionShouldCloseConnectionIfFirstCommandIsNotHello(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeProtocolParserProducer := new(protocol.MockProtocolParserProducer)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer:           fakeDataStreamer,
+		protocolParserProducer: fakeProtocolParserProducer,
+		clients:                []*client{fakeClient},
+		clientIDs:              []uint64{fakeClient.id},
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
+		clientMutex:            &sync.Mutex{}}
+
+	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeWhoAmICommand, nil).Once()
+	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeError))
+	}).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	server.serve(fakeClient)
+
+	fakeDataStreamer.AssertExpectations(t)
+	assert.Empty(t, server.clients)
+}
+
+func TestHandleHelloCommandShouldNegotiateVersionAndCapabilities(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clientMutex:  &sync.Mutex{}}
+
+	expectedWelcome := protocol.WelcomeCommand{Version: protocol.ProtocolVersion, Capabilities: protocol.CapabilityExtendedFrames}
+
+	err := server.handleHelloCommand(fakeClient, protocol.HelloCommand{
+		Version:      protocol.ProtocolVersion + 1,
+		Capabilities: protocol.CapabilityExtendedFrames | protocol.Capability(1<<31),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.ProtocolVersion, fakeClient.version)
+	assert.Equal(t, protocol.CapabilityExtendedFrames, fakeClient.capabilities)
+	assert.Equal(t, [][]byte{expectedWelcome.ToByteArray()}, fakeClient.outbound.frames)
+}
+
+func TestHandleHelloCommandShouldRejectUnsupportedVersion(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clientMutex:  &sync.Mutex{}}
+
+	err := server.handleHelloCommand(fakeClient, protocol.HelloCommand{Version: protocol.MinProtocolVersion - 1})
+
+	assert.Equal(t, protocol.ErrUnsupportedVersion, err)
+	assert.Equal(t, uint16(0), fakeClient.version)
+}
+
+func TestSendMessageCommandShouldSendErrorForUnknownRecipients(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeRecipientDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	fakeRecipient := &client{
+		dataStreamer: fakeRecipientDataStreamer,
+		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient, fakeRecipient},
+		clientIDs:    []uint64{fakeClient.id, fakeRecipient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	expectedMessage := protocol.MessageFromClient{SenderID: fakeClient.id, Body: []byte("hello")}
+	expectedError := protocol.ErrorCommand{
+		Code:           protocol.ErrorCodeUnknownRecipient,
+		RefCommandType: protocol.CommandTypeSendMessage,
+		Message:        "unknown recipients [5]",
+	}
+
+	server.handleSendMessageCommand(fakeClient, protocol.SendMessageCommand{Recipients: []uint64{2, 5}, Body: []byte("hello")})
+
+	assert.Equal(t, [][]byte{expectedMessage.ToByteArray()}, fakeRecipient.outbound.frames)
+	assert.Equal(t, [][]byte{expectedError.ToByteArray()}, fakeClient.outbound.frames)
+	fakeRecipientDataStreamer.AssertNotCalled(t, "Write", mock.Anything)
+}
+
+func TestNewWithHeartbeatShouldConfigureHeartbeat(t *testing.T) {
+	server := New(WithHeartbeat(time.Second, 3))
+	assert.Equal(t, time.Second, server.heartbeatInterval)
+	assert.Equal(t, 3, server.maxMissedHeartbeats)
+}
+
+func TestServeFunctionShouldAnswerPingWithPong(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeProtocolParser := new(protocol.MockProtocolParser)
+	fakeProtocolParserProducer := new(protocol.MockProtocolParserProducer)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer:           fakeDataStreamer,
+		protocolParserProducer: fakeProtocolParserProducer,
+		clients:                []*client{fakeClient},
+		clientIDs:              []uint64{fakeClient.id},
+		idAllocator:            &idallocator.MonotonicIDAllocator{},
+		clientMutex:            &sync.Mutex{}}
+
+	pong := protocol.PongCommand{}
+	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), nil).Times(3)
+	fakeDataStreamer.On("ReadByte", mock.Anything).Return(byte(0), io.EOF).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(fakeHelloCommand, nil).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(protocol.PingCommand{}, nil).Once()
+	fakeProtocolParser.On("ParseStreamedData", mock.Anything).Return(protocol.PongCommand{}, nil).Once()
+	fakeProtocolParserProducer.On("Produce").Return(fakeProtocolParser).Once()
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, args.Get(0).([]byte)[0], byte(protocol.CommandTypeWelcome))
+	}).Once()
+	fakeDataStreamer.On("Write", pong.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil)
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	server.serve(fakeClient)
+
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestHeartbeatShouldDisconnectClientMissingHeartbeats(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		capabilities: protocol.CapabilityHeartbeat,
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer:        fakeDataStreamer,
+		clients:             []*client{fakeClient},
+		clientIDs:           []uint64{fakeClient.id},
+		clientMutex:         &sync.Mutex{},
+		heartbeatInterval:   time.Millisecond,
+		maxMissedHeartbeats: 2}
+
+	ping := protocol.PingCommand{}
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	server.heartbeat(fakeClient, make(chan struct{}))
+
+	assert.Equal(t, [][]byte{ping.ToByteArray(), ping.ToByteArray()}, fakeClient.outbound.frames)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestHeartbeatShouldDisconnectSilentClientWithoutHeartbeats(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := newFakeClient(fakeDataStreamer, 1)
+	server := &Server{
+		dataStreamer:        fakeDataStreamer,
+		clients:             []*client{fakeClient},
+		clientIDs:           []uint64{fakeClient.id},
+		clientMutex:         &sync.Mutex{},
+		heartbeatInterval:   time.Millisecond,
+		maxMissedHeartbeats: 2}
+
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	server.heartbeat(fakeClient, make(chan struct{}))
+
+	// the client cannot answer pings, so it is not sent any
+	assert.Empty(t, fakeClient.outbound.frames)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestHeartbeatShouldNotDisconnectClientAnsweringHeartbeats(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		capabilities: protocol.CapabilityHeartbeat,
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer:        fakeDataStreamer,
+		clientMutex:         &sync.Mutex{},
+		heartbeatInterval:   time.Millisecond,
+		maxMissedHeartbeats: 1}
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, server.checkHeartbeat(fakeClient))
+		// the client answers the ping
+		atomic.StoreInt32(&fakeClient.missedHeartbeats, 0)
+	}
+
+	assert.Len(t, fakeClient.outbound.frames, 5)
+	fakeDataStreamer.AssertNotCalled(t, "CloseConnection")
+}
+
+func TestCreateClientShouldNotGiveIDOfConnectedClientAfterDisconnect(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+
+	fakeDataStreamer.On("CloseConnection").Return(nil)
+	first, _ := server.createClient(fakeDataStreamer)
+	second, _ := server.createClient(fakeDataStreamer)
+	server.remove(first)
+	third, err := server.createClient(fakeDataStreamer)
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, second.id, third.id)
+	assert.Equal(t, []uint64{second.id, third.id}, server.clientIDs)
+}
+
+func TestCreateClientShouldHideClientUntilHandshake(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	sender, _ := server.createClient(fakeDataStreamer)
+	assert.NoError(t, server.handleHelloCommand(sender, protocol.HelloCommand{Version: protocol.ProtocolVersion}))
+	newcomer, _ := server.createClient(fakeDataStreamer)
+
+	assert.Equal(t, []uint64{sender.id}, server.ListClientIDs())
+	assert.Nil(t, server.connectedClient(newcomer.id))
+	server.handleBroadcastCommand(sender, protocol.BroadcastCommand{Body: []byte("hello")})
+	assert.Empty(t, newcomer.outbound.frames)
+
+	assert.NoError(t, server.handleHelloCommand(newcomer, protocol.HelloCommand{Version: protocol.ProtocolVersion}))
+	assert.Equal(t, []uint64{sender.id, newcomer.id}, server.ListClientIDs())
+	assert.Equal(t, newcomer, server.connectedClient(newcomer.id))
+}
+
+func TestCreateClientShouldReturnErrorIfIDCannotBeAllocated(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeIDAllocator := new(idallocator.MockIDAllocator)
+	server := New(WithIDAllocator(fakeIDAllocator))
+
+	fakeIDAllocator.On("Allocate").Return(uint64(0), idallocator.ErrIDsExhausted).Once()
+	response, err := server.createClient(fakeDataStreamer)
+
+	assert.Nil(t, response)
+	assert.Equal(t, idallocator.ErrIDsExhausted, err)
+	assert.Empty(t, server.ListClientIDs())
+}
+
+func TestNewWithOutboundQueueSizeShouldConfigureOutboundQueues(t *testing.T) {
+	server := New(WithOutboundQueueSize(8))
+	assert.Equal(t, 8, server.outboundQueueSize)
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	response, err := server.createClient(fakeDataStreamer)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, response.outbound.capacity)
+}
+
+func TestStartShouldRejectMailboxWithoutAuthenticatedIdentityNicks(t *testing.T) {
+	fakeMailbox := new(mailbox.MockMailbox)
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+
+	// nothing is listened on
+	server := New(WithMailbox(fakeMailbox))
+	server.dataStreamer = fakeDataStreamer
+	assert.Equal(t, ErrMailboxNeedsIdentityNicks, server.Start(&fakeAddress))
+	server = New(WithMailbox(fakeMailbox), WithAuthenticator(new(auth.MockAuthenticator)))
+	server.dataStreamer = fakeDataStreamer
+	assert.Equal(t, ErrMailboxNeedsIdentityNicks, server.Start(&fakeAddress))
+	fakeDataStreamer.AssertNotCalled(t, "CreateListener", mock.Anything)
+
+	assert.NoError(t, New(WithMailbox(fakeMailbox), WithAuthenticator(new(auth.MockAuthenticator)), WithIdentityNicks()).checkOptions())
+}
+
+func TestSendMessageToClientShouldNotWaitForSlowRecipient(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeSlowDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	fakeSlowClient := &client{
+		dataStreamer: fakeSlowDataStreamer,
+		id:           uint64(2),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient, fakeSlowClient},
+		clientIDs:    []uint64{fakeClient.id, fakeSlowClient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	unblock := make(chan time.Time)
+	written := make(chan []byte, 1)
+	fakeSlowDataStreamer.On("Write", mock.Anything).Return(0, nil).WaitUntil(unblock)
+	fakeSlowDataStreamer.On("Flush").Return(nil)
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, nil).Run(func(args mock.Arguments) {
+		written <- args.Get(0).([]byte)
+	})
+	fakeDataStreamer.On("Flush").Return(nil)
+
+	go server.write(fakeClient)
+	go server.write(fakeSlowClient)
+
+	message := []byte{byte(protocol.CommandTypeMessageFromClient), 3, 0}
+	server.sendMessageToClient(fakeSlowClient, message)
+	server.sendMessageToClient(fakeClient, message)
+
+	select {
+	case frame := <-written:
+		assert.Equal(t, message, frame)
+	case <-time.After(time.Second):
+		assert.Fail(t, "message is blocked by the slow recipient")
+	}
+	close(unblock)
+}
+
+func TestWriteShouldCloseConnectionIfWriteFails(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clientMutex:  &sync.Mutex{}}
+
+	fakeDataStreamer.On("Write", mock.Anything).Return(0, errors.New("write error")).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	fakeClient.outbound.push([]byte{byte(protocol.CommandTypePing), 3, 0})
+	server.write(fakeClient)
+
+	fakeDataStreamer.AssertExpectations(t)
+	assert.Equal(t, errOutboundQueueClosed, fakeClient.outbound.push([]byte{byte(protocol.CommandTypePing), 3, 0}))
+}
+
+func TestShutdownShouldFlushQueuedFramesAndSayGoingAway(t *testing.T) {
+
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	server.dataStreamer = fakeListener
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+
+	goAway := protocol.GoAwayCommand{Reason: "server is shutting down"}
+	fakeListener.On("CloseListener").Return(nil).Once()
+	fakeDataStreamer.On("Write", fakeMessageFromClientCommand.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Write", goAway.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil)
+	var served sync.Once
+	fakeDataStreamer.On("CloseConnection").Return(nil).Run(func(args mock.Arguments) {
+		// serving the client ends once its connection is closed
+		served.Do(server.handlers.Done)
+	})
+
+	server.sendMessageToClient(fakeClient, fakeMessageFromClientCommand.ToByteArray())
+	go server.write(fakeClient)
+
+	err := server.Shutdown(context.Background())
+	assert.Nil(t, err)
+	fakeListener.AssertExpectations(t)
+	fakeDataStreamer.AssertExpectations(t)
+
+	// shutting down again is safe
+	err = server.Shutdown(context.Background())
+	assert.Nil(t, err)
+	fakeListener.AssertNumberOfCalls(t, "CloseListener", 1)
+}
+
+func TestShutdownShouldCloseConnectionsWhenContextIsDone(t *testing.T) {
+
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	server.dataStreamer = fakeListener
+	server.createClient(fakeDataStreamer)
+
+	fakeListener.On("CloseListener").Return(nil).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+
+	// the writer of the client never takes the frames
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	fakeDataStreamer.AssertExpectations(t)
+}
+
+func TestCreateClientShouldReturnErrorWhileShuttingDown(t *testing.T) {
+
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	server.dataStreamer = fakeListener
+
+	fakeListener.On("CloseListener").Return(nil).Once()
+	assert.Nil(t, server.Shutdown(context.Background()))
+
+	response, err := server.createClient(fakeDataStreamer)
+	assert.Nil(t, response)
+	assert.Equal(t, errShuttingDown, err)
+}
+
+func TestListenShouldNotStopAgainAfterShutdown(t *testing.T) {
+
+	fakeListener := new(datastream.MockTcpDataStream)
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	server.dataStreamer = fakeListener
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	fakeClient.outbound.closeAfter(nil)
+
+	fakeListener.On("CloseListener").Return(nil).Once()
+	fakeListener.On("Accept").Return(fakeListener, errors.New("listener closed")).Once()
+
+	server.stopAccepting()
+	err := server.listen(fakeListener)
+
+	assert.Nil(t, err)
+	fakeListener.AssertExpectations(t)
+	fakeDataStreamer.AssertNotCalled(t, "CloseConnection")
+}
+
+func TestRoomCommandsShouldManageMembership(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient},
+		clientIDs:    []uint64{fakeClient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	join := protocol.JoinRoomCommand{RequestID: 1, Room: "general"}
+	list := protocol.ListRoomsCommand{RequestID: 2, Rooms: []string{"general"}}
+	leave := protocol.LeaveRoomCommand{RequestID: 3, Room: "general"}
+	notInRoom := protocol.ErrorCommand{
+		RequestID:      4,
+		Code:           protocol.ErrorCodeNotInRoom,
+		RefCommandType: protocol.CommandTypeLeaveRoom,
+		Message:        `not in room "general"`,
+	}
+
+	server.handleJoinRoomCommand(fakeClient, join)
+	server.handleListRoomsCommand(fakeClient, protocol.ListRoomsCommand{RequestID: 2})
+	server.handleLeaveRoomCommand(fakeClient, leave)
+	server.handleLeaveRoomCommand(fakeClient, protocol.LeaveRoomCommand{RequestID: 4, Room: "general"})
+
+	assert.Equal(t, [][]byte{join.ToByteArray(), list.ToByteArray(), leave.ToByteArray(), notInRoom.ToByteArray()}, fakeClient.outbound.frames)
+	assert.Empty(t, server.rooms.list())
+}
+
+func TestRoomMessageCommandShouldFanOutToOtherMembers(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1)
+	member := newFakeClient(fakeDataStreamer, 2)
+	outsider := newFakeClient(fakeDataStreamer, 3)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, member, outsider},
+		clientIDs:    []uint64{sender.id, member.id, outsider.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.rooms.join("general", sender)
+	server.rooms.join("general", member)
+	server.handleRoomMessageCommand(sender, protocol.RoomMessageCommand{RequestID: 4, Room: "general", Body: []byte("hello")})
+	server.handleRoomMessageCommand(outsider, protocol.RoomMessageCommand{RequestID: 5, Room: "general", Body: []byte("hello")})
+
+	expectedMessage := protocol.RoomMessageCommand{Room: "general", SenderID: sender.id, Body: []byte("hello")}
+	expectedError := protocol.ErrorCommand{
+		RequestID:      5,
+		Code:           protocol.ErrorCodeNotInRoom,
+		RefCommandType: protocol.CommandTypeRoomMessage,
+		Message:        `not in room "general"`,
+	}
+	expectedResult := protocol.SendResultCommand{RequestID: 4, MessageID: 1, Delivered: []uint64{member.id}}
+	assert.Equal(t, [][]byte{expectedResult.ToByteArray()}, sender.outbound.frames)
+	assert.Equal(t, [][]byte{expectedMessage.ToByteArray()}, member.outbound.frames)
+	assert.Equal(t, [][]byte{expectedError.ToByteArray()}, outsider.outbound.frames)
+}
+
+func TestRemoveFunctionShouldRemoveClientFromItsRooms(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	server.rooms.join("general", fakeClient)
+
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	server.remove(fakeClient)
+
+	assert.Empty(t, server.rooms.list())
+}
+
+func TestBroadcastCommandShouldSendMessageToAllOtherClients(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1)
+	first := newFakeClient(fakeDataStreamer, 2)
+	second := newFakeClient(fakeDataStreamer, 3)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, first, second},
+		clientIDs:    []uint64{sender.id, first.id, second.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.handleBroadcastCommand(sender, protocol.BroadcastCommand{Body: []byte("hello")})
+
+	expected := protocol.MessageFromClient{SenderID: sender.id, Body: []byte("hello")}
+	assert.Empty(t, sender.outbound.frames)
+	assert.Equal(t, [][]byte{expected.ToByteArray()}, first.outbound.frames)
+	assert.Equal(t, [][]byte{expected.ToByteArray()}, second.outbound.frames)
+}
+
+func TestTopicCommandsShouldManageSubscriptions(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient},
+		clientIDs:    []uint64{fakeClient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	subscribe := protocol.SubscribeCommand{RequestID: 1, Pattern: "alerts.*"}
+	unsubscribe := protocol.UnsubscribeCommand{RequestID: 2, Pattern: "alerts.*"}
+	notSubscribed := protocol.ErrorCommand{
+		RequestID:      3,
+		Code:           protocol.ErrorCodeNotSubscribed,
+		RefCommandType: protocol.CommandTypeUnsubscribe,
+		Message:        `not subscribed to "alerts.*"`,
+	}
+
+	server.handleSubscribeCommand(fakeClient, subscribe)
+	assert.Equal(t, []*client{fakeClient}, server.topics.match("alerts.disk"))
+	server.handleUnsubscribeCommand(fakeClient, unsubscribe)
+	server.handleUnsubscribeCommand(fakeClient, protocol.UnsubscribeCommand{RequestID: 3, Pattern: "alerts.*"})
+
+	assert.Equal(t, [][]byte{subscribe.ToByteArray(), unsubscribe.ToByteArray(), notSubscribed.ToByteArray()}, fakeClient.outbound.frames)
+	assert.Empty(t, server.topics.match("alerts.disk"))
+}
+
+func TestPublishCommandShouldSendMessageToOtherSubscribers(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	publisher := newFakeClient(fakeDataStreamer, 1)
+	subscriber := newFakeClient(fakeDataStreamer, 2)
+	other := newFakeClient(fakeDataStreamer, 3)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{publisher, subscriber, other},
+		clientIDs:    []uint64{publisher.id, subscriber.id, other.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.topics.subscribe("alerts.>", publisher)
+	server.topics.subscribe("alerts.*", subscriber)
+	server.topics.subscribe("alerts.disk", subscriber)
+	server.topics.subscribe("metrics.*", other)
+	server.handlePublishCommand(publisher, protocol.PublishCommand{Topic: "alerts.disk", Body: []byte("full")})
+
+	expected := protocol.TopicMessageCommand{Topic: "alerts.disk", SenderID: publisher.id, Body: []byte("full")}
+	assert.Empty(t, publisher.outbound.frames)
+	assert.Equal(t, [][]byte{expected.ToByteArray()}, subscriber.outbound.frames)
+	assert.Empty(t, other.outbound.frames)
+}
+
+func TestRemoveFunctionShouldRemoveClientSubscriptions(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	server.topics.subscribe("alerts.*", fakeClient)
+
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	server.remove(fakeClient)
+
+	assert.Empty(t, server.topics.match("alerts.disk"))
+}
+
+func TestSetNickCommandShouldNotifyClientsSupportingNicks(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := newFakeClient(fakeDataStreamer, 1, protocol.SupportedCapabilities)
+	other := newFakeClient(fakeDataStreamer, 2, protocol.SupportedCapabilities)
+	legacy := newFakeClient(fakeDataStreamer, 3, 0)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient, other, legacy},
+		clientIDs:    []uint64{fakeClient.id, other.id, legacy.id},
+		clientMutex:  &sync.Mutex{}}
+
+	setNick := protocol.SetNickCommand{RequestID: 1, Nick: "alice"}
+	server.handleSetNickCommand(fakeClient, setNick)
+	server.handleSetNickCommand(fakeClient, protocol.SetNickCommand{RequestID: 2, Nick: "alice"})
+	server.handleSetNickCommand(other, protocol.SetNickCommand{RequestID: 3, Nick: "alice"})
+
+	nickChanged := protocol.NickChangedCommand{ClientID: fakeClient.id, Nick: "alice"}
+	setNickAgain := protocol.SetNickCommand{RequestID: 2, Nick: "alice"}
+	nickTaken := protocol.ErrorCommand{
+		RequestID:      3,
+		Code:           protocol.ErrorCodeNickTaken,
+		RefCommandType: protocol.CommandTypeSetNick,
+		Message:        `nick "alice" is taken`,
+	}
+	assert.Equal(t, [][]byte{setNick.ToByteArray(), setNickAgain.ToByteArray()}, fakeClient.outbound.frames)
+	assert.Equal(t, [][]byte{nickChanged.ToByteArray(), nickTaken.ToByteArray()}, other.outbound.frames)
+	assert.Empty(t, legacy.outbound.frames)
+}
+
+func TestLookupCommandShouldFindClientsByNickAndID(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := newFakeClient(fakeDataStreamer, 1)
+	alice := newFakeClient(fakeDataStreamer, 2)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient, alice},
+		clientIDs:    []uint64{fakeClient.id, alice.id},
+		clientMutex:  &sync.Mutex{}}
+	server.nicks.set(alice, "alice")
+
+	server.handleLookupCommand(fakeClient, protocol.LookupCommand{RequestID: 1, Nick: "alice"})
+	server.handleLookupCommand(fakeClient, protocol.LookupCommand{RequestID: 2, ClientID: alice.id})
+	server.handleLookupCommand(fakeClient, protocol.LookupCommand{RequestID: 3, Nick: "bob"})
+
+	byNick := protocol.LookupCommand{RequestID: 1, ClientID: alice.id, Nick: "alice"}
+	byID := protocol.LookupCommand{RequestID: 2, ClientID: alice.id, Nick: "alice"}
+	notFound := protocol.ErrorCommand{
+		RequestID:      3,
+		Code:           protocol.ErrorCodeNotFound,
+		RefCommandType: protocol.CommandTypeLookup,
+		Message:        `no client with nick "bob" or id 0`,
+	}
+	assert.Equal(t, [][]byte{byNick.ToByteArray(), byID.ToByteArray(), notFound.ToByteArray()}, fakeClient.outbound.frames)
+}
+
+func TestListUsersCommandShouldReturnOtherClientsWithNicks(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := newFakeClient(fakeDataStreamer, 1)
+	alice := newFakeClient(fakeDataStreamer, 2)
+	anonymous := newFakeClient(fakeDataStreamer, 3)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient, alice, anonymous},
+		clientIDs:    []uint64{fakeClient.id, alice.id, anonymous.id},
+		clientMutex:  &sync.Mutex{}}
+	server.nicks.set(alice, "alice")
+
+	server.handleListUsersCommand(fakeClient, protocol.ListUsersCommand{RequestID: 1})
+
+	expected := protocol.ListUsersCommand{RequestID: 1, Users: []protocol.User{{ID: 2, Nick: "alice"}, {ID: 3}}}
+	assert.Equal(t, [][]byte{expected.ToByteArray()}, fakeClient.outbound.frames)
+}
+
+func TestSendMessageCommandShouldCarryNickToClientsSupportingNicks(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1, protocol.SupportedCapabilities)
+	recipient := newFakeClient(fakeDataStreamer, 2, protocol.SupportedCapabilities)
+	legacy := newFakeClient(fakeDataStreamer, 3, 0)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, recipient, legacy},
+		clientIDs:    []uint64{sender.id, recipient.id, legacy.id},
+		clientMutex:  &sync.Mutex{}}
+	server.nicks.set(sender, "alice")
+
+	server.handleSendMessageCommand(sender, protocol.SendMessageCommand{Recipients: []uint64{2, 3}, Body: []byte("hello")})
+
+	withNick := protocol.MessageFromClient{SenderID: sender.id, SenderNick: "alice", Body: []byte("hello")}
+	withoutNick := protocol.MessageFromClient{SenderID: sender.id, Body: []byte("hello")}
+	assert.Equal(t, [][]byte{withNick.ToByteArray()}, recipient.outbound.frames)
+	assert.Equal(t, [][]byte{withoutNick.ToByteArray()}, legacy.outbound.frames)
+}
+
+func TestRemoveFunctionShouldFreeClientNick(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	server.nicks.set(fakeClient, "alice")
+
+	fakeDataStreamer.On("CloseConnection").Return(nil).Once()
+	server.remove(fakeClient)
+
+	assert.Nil(t, server.nicks.lookup("alice"))
+}
+
+func TestCreateClientAndRemoveShouldAnnouncePresenceToClientsOptedIn(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	watcher, _ := server.createClient(fakeDataStreamer)
+	server.handleHelloCommand(watcher, protocol.HelloCommand{Version: protocol.ProtocolVersion, Capabilities: protocol.SupportedCapabilities})
+	other, _ := server.createClient(fakeDataStreamer)
+	server.handleHelloCommand(other, protocol.HelloCommand{Version: protocol.ProtocolVersion})
+
+	// a client is announced once it completes the handshake
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	assert.Len(t, watcher.outbound.frames, 2)
+	server.handleHelloCommand(fakeClient, protocol.HelloCommand{Version: protocol.ProtocolVersion})
+	fakeDataStreamer.On("CloseConnection").Return(nil)
+	server.remove(fakeClient)
+	// removing again does not announce again
+	server.remove(fakeClient)
+
+	// a client which never completed the handshake is not announced at all
+	silent, _ := server.createClient(fakeDataStreamer)
+	server.remove(silent)
+
+	otherJoined := protocol.PresenceCommand{Event: protocol.PresenceJoined, ClientID: other.id}
+	joined := protocol.PresenceCommand{Event: protocol.PresenceJoined, ClientID: fakeClient.id}
+	left := protocol.PresenceCommand{Event: protocol.PresenceLeft, ClientID: fakeClient.id}
+	assert.Equal(t, [][]byte{otherJoined.ToByteArray(), joined.ToByteArray(), left.ToByteArray()}, watcher.outbound.frames[1:])
+	assert.Len(t, other.outbound.frames, 1)
+}
+
+func TestRemoveShouldNotAnnouncePresenceWhileShuttingDown(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	server := New()
+	watcher, _ := server.createClient(fakeDataStreamer)
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	watcher.capabilities = protocol.SupportedCapabilities
+
+	fakeDataStreamer.On("CloseConnection").Return(nil)
+	server.shuttingDown = true
+	server.remove(fakeClient)
+
+	assert.Empty(t, watcher.outbound.frames)
+}
+
+func TestSendMessageCommandWithRequestIDShouldReturnSendResult(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1)
+	recipient := newFakeClient(fakeDataStreamer, 2)
+	disconnecting := newFakeClient(fakeDataStreamer, 3)
+	disconnecting.outbound.close()
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, recipient, disconnecting},
+		clientIDs:    []uint64{sender.id, recipient.id, disconnecting.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.handleSendMessageCommand(sender, protocol.SendMessageCommand{RequestID: 7, Recipients: []uint64{2, 3, 4}, Body: []byte("hello")})
+	server.handleSendMessageCommand(sender, protocol.SendMessageCommand{RequestID: 8, Recipients: []uint64{2}, Body: []byte("hello")})
+
+	first := protocol.SendResultCommand{RequestID: 7, MessageID: 1, Delivered: []uint64{2}, Failed: []uint64{3, 4}}
+	second := protocol.SendResultCommand{RequestID: 8, MessageID: 2, Delivered: []uint64{2}}
+	assert.Equal(t, [][]byte{first.ToByteArray(), second.ToByteArray()}, sender.outbound.frames)
+	assert.Len(t, recipient.outbound.frames, 2)
+}
+
+func TestSendToNickCommandShouldKeepMessageUntilNickIsTaken(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1, protocol.SupportedCapabilities)
+	recipient := newFakeClient(fakeDataStreamer, 2, protocol.SupportedCapabilities)
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, recipient},
+		clientIDs:    []uint64{sender.id, recipient.id},
+		clientMutex:  &sync.Mutex{},
+		mailbox:      mailbox.NewMemoryMailbox(mailbox.Limits{})}
+	server.nicks.set(sender, "alice")
+
+	server.handleSendToNickCommand(sender, protocol.SendToNickCommand{RequestID: 3, Nick: "bob", Body: []byte("offline")})
+	setNick := protocol.SetNickCommand{RequestID: 1, Nick: "bob"}
+	server.handleSetNickCommand(recipient, setNick)
+	server.handleSendToNickCommand(sender, protocol.SendToNickCommand{RequestID: 4, Nick: "bob", Body: []byte("online")})
+
+	offline := protocol.MessageFromClient{SenderID: sender.id, SenderNick: "alice", Body: []byte("offline")}
+	online := protocol.MessageFromClient{SenderID: sender.id, SenderNick: "alice", Body: []byte("online")}
+	assert.Equal(t, [][]byte{setNick.ToByteArray(), offline.ToByteArray(), online.ToByteArray()}, recipient.outbound.frames)
+
+	// the message kept in the mailbox is neither delivered nor failed
+	kept := protocol.SendResultCommand{RequestID: 3, MessageID: 1}
+	nickChanged := protocol.NickChangedCommand{ClientID: recipient.id, Nick: "bob"}
+	delivered := protocol.SendResultCommand{RequestID: 4, MessageID: 2, Delivered: []uint64{recipient.id}}
+	assert.Equal(t, [][]byte{kept.ToByteArray(), nickChanged.ToByteArray(), delivered.ToByteArray()}, sender.outbound.frames)
+}
+
+func TestSendToNickCommandShouldBeRejectedIfMessageCannotBeKept(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeMailbox := new(mailbox.MockMailbox)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient},
+		clientIDs:    []uint64{fakeClient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.handleSendToNickCommand(fakeClient, protocol.SendToNickCommand{RequestID: 1, Nick: "bob", Body: []byte("hello")})
+
+	fakeMailbox.On("Put", "bob", mailbox.Message{SenderID: 1, Body: []byte("hello")}).Return(mailbox.ErrMailboxFull).Once()
+	server.mailbox = fakeMailbox
+	server.handleSendToNickCommand(fakeClient, protocol.SendToNickCommand{RequestID: 2, Nick: "bob", Body: []byte("hello")})
+
+	noMailbox := protocol.ErrorCommand{
+		RequestID:      1,
+		Code:           protocol.ErrorCodeNotDelivered,
+		RefCommandType: protocol.CommandTypeSendToNick,
+		Message:        `"bob" is offline: no mailbox`,
+	}
+	mailboxFull := protocol.ErrorCommand{
+		RequestID:      2,
+		Code:           protocol.ErrorCodeNotDelivered,
+		RefCommandType: protocol.CommandTypeSendToNick,
+		Message:        `"bob" is offline: Mailbox full`,
+	}
+	assert.Equal(t, [][]byte{noMailbox.ToByteArray(), mailboxFull.ToByteArray()}, fakeClient.outbound.frames)
+	fakeMailbox.AssertExpectations(t)
+}
+
+func TestHistoryCommandShouldPageTheRoutedMessages(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	sender := newFakeClient(fakeDataStreamer, 1)
+	recipient := newFakeClient(fakeDataStreamer, 2)
+	store := NewMemoryMessageStore()
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{sender, recipient},
+		clientIDs:    []uint64{sender.id, recipient.id},
+		clientMutex:  &sync.Mutex{},
+		messageStore: store}
+
+	server.handleSendMessageCommand(sender, protocol.SendMessageCommand{Recipients: []uint64{2, 42}, Body: []byte("first")})
+	server.handleBroadcastCommand(sender, protocol.BroadcastCommand{Body: []byte("second")})
+	server.rooms.join("general", sender)
+	server.rooms.join("general", recipient)
+	server.handleRoomMessageCommand(recipient, protocol.RoomMessageCommand{Room: "general", Body: []byte("third")})
+
+	recorded, err := store.Query(HistoryFilter{Participant: recipient.connectionKey}, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"second", "first"}, bodies(recorded))
+	assert.Equal(t, []uint64{2}, recorded[1].Recipients)
+
+	recipient.outbound.frames = nil
+	query := protocol.HistoryQuery{Limit: 1}
+	server.handleHistoryCommand(recipient, protocol.HistoryCommand{RequestID: 1, Query: query})
+	query.Before = recorded[0].ID
+	server.handleHistoryCommand(recipient, protocol.HistoryCommand{RequestID: 2, Query: query})
+
+	firstPage := protocol.HistoryCommand{RequestID: 1, Query: protocol.HistoryQuery{Limit: 1}, Messages: recorded[:1], Next: recorded[0].ID}
+	lastPage := protocol.HistoryCommand{RequestID: 2, Query: query, Messages: recorded[1:]}
+	assert.Equal(t, [][]byte{firstPage.ToByteArray(), lastPage.ToByteArray()}, recipient.outbound.frames)
+
+	sender.outbound.frames = nil
+	server.handleHistoryCommand(sender, protocol.HistoryCommand{RequestID: 3, Query: protocol.HistoryQuery{Room: "general"}})
+	roomMessages, err := store.Query(HistoryFilter{Room: "general"}, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"third"}, bodies(roomMessages))
+	roomPage := protocol.HistoryCommand{RequestID: 3, Query: protocol.HistoryQuery{Room: "general"}, Messages: roomMessages}
+	assert.Equal(t, [][]byte{roomPage.ToByteArray()}, sender.outbound.frames)
+}
+
+func TestHistoryCommandShouldBeRejectedWithoutStoreMembershipOrPeer(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(defaultOutboundQueueSize),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer: fakeDataStreamer,
+		clients:      []*client{fakeClient},
+		clientIDs:    []uint64{fakeClient.id},
+		clientMutex:  &sync.Mutex{}}
+
+	server.handleHistoryCommand(fakeClient, protocol.HistoryCommand{RequestID: 1})
+	server.messageStore = NewMemoryMessageStore()
+	server.handleHistoryCommand(fakeClient, protocol.HistoryCommand{RequestID: 2, Query: protocol.HistoryQuery{Room: "general"}})
+	server.handleHistoryCommand(fakeClient, protocol.HistoryCommand{RequestID: 3, Query: protocol.HistoryQuery{Peer: 2}})
+
+	unavailable := protocol.ErrorCommand{
+		RequestID:      1,
+		Code:           protocol.ErrorCodeHistoryUnavailable,
+		RefCommandType: protocol.CommandTypeHistory,
+		Message:        "history is not kept",
+	}
+	notInRoom := protocol.ErrorCommand{
+		RequestID:      2,
+		Code:           protocol.ErrorCodeNotInRoom,
+		RefCommandType: protocol.CommandTypeHistory,
+		Message:        `not in room "general"`,
+	}
+	// the id of a client which is gone may be given to somebody else, so it tells nothing about the messages
+	unknownPeer := protocol.ErrorCommand{
+		RequestID:      3,
+		Code:           protocol.ErrorCodeUnknownRecipient,
+		RefCommandType: protocol.CommandTypeHistory,
+		Message:        "peer 2 is not connected",
+	}
+	assert.Equal(t, [][]byte{unavailable.ToByteArray(), notInRoom.ToByteArray(), unknownPeer.ToByteArray()}, fakeClient.outbound.frames)
+}
+
+func TestHandleAuthCommandShouldAdmitClientWithItsIdentityAsNick(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeAuthenticator := new(auth.MockAuthenticator)
+	server := New(WithAuthenticator(fakeAuthenticator), WithIdentityNicks())
+	watcher, _ := server.createClient(fakeDataStreamer)
+	watcher.handshaking = false
+	watcher.identity = "bob"
+	watcher.capabilities = protocol.SupportedCapabilities
+	newcomer, _ := server.createClient(fakeDataStreamer)
+	newcomer.handshaking = false
+
+	assert.Equal(t, []uint64{watcher.id}, server.ListClientIDs())
+	assert.Nil(t, server.connectedClient(newcomer.id))
+
+	credentials := auth.Credentials{Scheme: protocol.AuthSchemeToken, Secret: "token"}
+	fakeAuthenticator.On("Authenticate", credentials).Return("alice", nil).Once()
+	err := server.handleAuthCommand(newcomer, protocol.AuthCommand{RequestID: 1, Scheme: protocol.AuthSchemeToken, Secret: "token"})
+	assert.NoError(t, err)
+	server.handleSetNickCommand(newcomer, protocol.SetNickCommand{RequestID: 2, Nick: "carol"})
+
+	assert.Equal(t, []uint64{watcher.id, newcomer.id}, server.ListClientIDs())
+	assert.Equal(t, "alice", server.nicks.nick(newcomer))
+
+	authenticated := protocol.AuthCommand{RequestID: 1, Scheme: protocol.AuthSchemeToken, Identity: "alice"}
+	notAllowed := protocol.ErrorCommand{
+		RequestID:      2,
+		Code:           protocol.ErrorCodeNotAllowed,
+		RefCommandType: protocol.CommandTypeSetNick,
+		Message:        "the nick is the authenticated identity",
+	}
+	assert.Equal(t, [][]byte{authenticated.ToByteArray(), notAllowed.ToByteArray()}, newcomer.outbound.frames)
+
+	nickChanged := protocol.NickChangedCommand{ClientID: newcomer.id, Nick: "alice"}
+	joined := protocol.PresenceCommand{Event: protocol.PresenceJoined, ClientID: newcomer.id}
+	assert.Equal(t, [][]byte{nickChanged.ToByteArray(), joined.ToByteArray()}, watcher.outbound.frames)
+	fakeAuthenticator.AssertExpectations(t)
+}
+
+func TestHandleAuthCommandShouldRejectOtherCommandsAndInvalidCredentials(t *testing.T) {
+
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeAuthenticator := new(auth.MockAuthenticator)
+	server := New(WithAuthenticator(fakeAuthenticator))
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+
+	err := server.handleAuthCommand(fakeClient, protocol.WhoAmICommand{RequestID: 7})
+	assert.Equal(t, protocol.ErrAuthenticationRequired, err)
+
+	credentials := auth.Credentials{Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "wrong"}
+	fakeAuthenticator.On("Authenticate", credentials).Return("", auth.ErrInvalidCredentials).Once()
+	err = server.handleAuthCommand(fakeClient, protocol.AuthCommand{RequestID: 1, Scheme: protocol.AuthSchemePassword, Username: "alice", Secret: "wrong"})
+	assert.Equal(t, auth.ErrInvalidCredentials, err)
+
+	required := protocol.ErrorCommand{
+		RequestID:      7,
+		Code:           protocol.ErrorCodeAuthenticationRequired,
+		RefCommandType: protocol.CommandTypeUnknown,
+		Message:        protocol.ErrAuthenticationRequired.Error(),
+	}
+	failed := protocol.ErrorCommand{
+		RequestID:      1,
+		Code:           protocol.ErrorCodeAuthenticationFailed,
+		RefCommandType: protocol.CommandTypeAuth,
+		Message:        auth.ErrInvalidCredentials.Error(),
+	}
+	assert.Equal(t, [][]byte{required.ToByteArray(), failed.ToByteArray()}, fakeClient.outbound.frames)
+	assert.False(t, server.isAdmitted(fakeClient))
+	fakeAuthenticator.AssertExpectations(t)
+}
+
+// fakePeerDataStream is a data streamer whose connection proves an identity, like a TLS connection with a client certificate
+type fakePeerDataStream struct {
+	datastream.MockTcpDataStream
+	identity string
+}
+
+func (t *fakePeerDataStream) PeerIdentity() (string, error) {
+	return t.identity, nil
+}
+
+func TestAuthenticateWithCertificateShouldAdmitClientAsPeerIdentity(t *testing.T) {
+
+	fakeDataStreamer := &fakePeerDataStream{identity: "alice"}
+	server := New(WithAuthenticator(new(auth.MockAuthenticator)), WithIdentityNicks())
+	fakeClient, _ := server.createClient(fakeDataStreamer)
+	fakeClient.handshaking = false
+	other, _ := server.createClient(&fakePeerDataStream{identity: "alice"})
+
+	identity := peerIdentity(fakeClient)
+	assert.Equal(t, "alice", identity)
+	assert.NoError(t, server.authenticateWithCertificate(fakeClient, identity))
+	assert.Equal(t, errIdentityConnected, server.authenticateWithCertificate(other, peerIdentity(other)))
+
+	assert.Equal(t, []uint64{fakeClient.id}, server.ListClientIDs())
+	assert.Equal(t, "alice", server.nicks.nick(fakeClient))
+	assert.Empty(t, fakeClient.outbound.frames)
+}
+
+// connectToServer connects to the server over the memory network and says hello
+func connectToServer(t *testing.T, transport datastream.IDataStreamerProducer, capabilities protocol.Capability) datastream.IDataStreamer {
+	conn, err := transport.Produce().CreateConnection(&fakeAddress)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	hello := protocol.HelloCommand{Version: protocol.ProtocolVersion, Capabilities: capabilities}
+	conn.Write(hello.ToByteArray())
+	conn.Flush()
+	return conn
+}
+
+// readCommandFromServer reads the connection until a command is parsed
+func readCommandFromServer(t *testing.T, conn datastream.IDataStreamer, parser protocol.IProtocolParser) interface{} {
+	for {
+		data, err := conn.ReadByte()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		command, err := parser.ParseStreamedData(data)
+		assert.NoError(t, err)
+		if command != nil {
+			return command
+		}
+	}
+}
+
+func TestServeShouldAnswerRejectedFramesToTheirRequests(t *testing.T) {
+
+	transport := &datastream.MemoryDataStreamProducer{Network: datastream.NewMemoryNetwork()}
+	server := New(WithDataStreamerProducer(transport), WithMaxFrameSize(1024))
+	assert.Nil(t, server.Start(&fakeAddress))
+	defer server.Stop()
+
+	conn := connectToServer(t, transport, 0)
+	defer conn.CloseConnection()
+	tooLarge := protocol.SendMessageCommand{RequestID: 7, Recipients: []uint64{1}, Body: make([]byte, 4096)}
+	conn.Write(tooLarge.ToByteArray())
+	// a request of a command the server does not know, like the ones of newer clients
+	conn.Write([]byte{50 | protocol.FrameFlagRequestID, 7, 0, 8, 0, 0, 0})
+	malformed := protocol.JoinRoomCommand{RequestID: 9}
+	conn.Write(malformed.ToByteArray())
+	conn.Flush()
+
+	parser := (&protocol.ProtocolParserProducer{}).Produce()
+	assert.IsType(t, protocol.WelcomeCommand{}, readCommandFromServer(t, conn, parser))
+	assert.Equal(t, protocol.ErrorCommand{
+		RequestID:      7,
+		Code:           protocol.ErrorCodeFrameTooLarge,
+		RefCommandType: protocol.CommandTypeSendMessage,
+		Message:        protocol.ErrFrameTooLarge.Error(),
+	}, readCommandFromServer(t, conn, parser))
+	assert.Equal(t, protocol.ErrorCommand{
+		RequestID:      8,
+		Code:           protocol.ErrorCodeUnknownCommand,
+		RefCommandType: protocol.CommandType(50),
+		Message:        "Unknown command 50",
+	}, readCommandFromServer(t, conn, parser))
+	assert.Equal(t, protocol.ErrorCommand{
+		RequestID:      9,
+		Code:           protocol.ErrorCodeMalformedCommand,
+		RefCommandType: protocol.CommandTypeJoinRoom,
+		Message:        protocol.ErrMalformedCommand.Error(),
+	}, readCommandFromServer(t, conn, parser))
+}
+
+func TestServeShouldDisconnectClientWhichDoesNotHandshakeInTime(t *testing.T) {
+
+	transport := &datastream.MemoryDataStreamProducer{Network: datastream.NewMemoryNetwork()}
+	server := New(WithDataStreamerProducer(transport), WithHandshakeTimeout(50*time.Millisecond))
+	assert.Nil(t, server.Start(&fakeAddress))
+	defer server.Stop()
+
+	conn, err := transport.Produce().CreateConnection(&fakeAddress)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.CloseConnection()
+
+	_, err = conn.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Empty(t, server.ListClientIDs())
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// SlowConsumerPolicy decides what happens to a frame when the outbound queue of its recipient is full
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock makes the sender wait until the recipient has room for the frame
+	SlowConsumerBlock SlowConsumerPolicy = iota
+	// SlowConsumerDropOldest drops the oldest queued frames of the recipient to make room for the frame
+	SlowConsumerDropOldest
+	// SlowConsumerDropNew drops the frame
+	SlowConsumerDropNew
+	// SlowConsumerDisconnect disconnects the recipient with an error frame
+	SlowConsumerDisconnect
+)
+
+func (t SlowConsumerPolicy) String() string {
+	switch t {
+	case SlowConsumerBlock:
+		return "block"
+	case SlowConsumerDropOldest:
+		return "drop oldest"
+	case SlowConsumerDropNew:
+		return "drop new"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// SlowConsumerStats counts what the slow consumer policy did to the slow clients
+type SlowConsumerStats struct {
+	// DroppedFrames is the number of frames which were never written to their recipients
+	DroppedFrames uint64
+	// Disconnects is the number of clients disconnected for being slow
+	Disconnects uint64
+}
+
+// SlowConsumerStats returns the drops and disconnects since the server is created
+func (server *Server) SlowConsumerStats() SlowConsumerStats {
+	return SlowConsumerStats{
+		DroppedFrames: atomic.LoadUint64(&server.droppedFrames),
+		Disconnects:   atomic.LoadUint64(&server.slowConsumerDisconnects),
+	}
+}
+
+// enqueue queues the frame to the client following the slow consumer policy of the server
+func (server *Server) enqueue(client *client, frame []byte) error {
+	switch server.slowConsumerPolicy {
+	case SlowConsumerDropOldest:
+		dropped, err := client.outbound.pushDropOldest(frame)
+		server.countDropped(client, dropped)
+		return err
+	case SlowConsumerDropNew:
+		err := client.outbound.offer(frame)
+		if err == errOutboundQueueFull {
+			server.countDropped(client, 1)
+		}
+		return err
+	case SlowConsumerDisconnect:
+		err := client.outbound.offer(frame)
+		if err == errOutboundQueueFull {
+			server.disconnectSlowConsumer(client)
+		}
+		return err
+	}
+	return client.outbound.push(frame)
+}
+
+func (server *Server) countDropped(client *client, dropped int) {
+	if dropped > 0 {
+		log.Printf("Client %d is too slow, dropped %d frames", client.id, dropped)
+		atomic.AddUint64(&server.droppedFrames, uint64(dropped))
+	}
+}
+
+// disconnectSlowConsumer drops the frame which did not fit and replaces the queued frames of the client
+// with an error frame, then closes the connection once it is written or the client does not take it in time
+func (server *Server) disconnectSlowConsumer(client *client) {
+	rejection := protocol.ErrorCommand{
+		Code:           protocol.ErrorCodeSlowConsumer,
+		RefCommandType: protocol.CommandTypeUnknown,
+		Message:        "client is too slow to read its messages",
+	}
+	dropped, ok := client.outbound.closeWith(rejection.ToByteArray())
+	if !ok {
+		// it is already disconnecting
+		return
+	}
+
+	log.Printf("Client %d is too slow, disconnecting", client.id)
+	server.countDropped(client, dropped+1)
+	atomic.AddUint64(&server.slowConsumerDisconnects, 1)
+
+	go func() {
+		select {
+		case <-client.writerDone:
+		case <-time.After(flushTimeout):
+		}
+		// serve stops reading and removes the client once the connection is closed
+		client.dataStreamer.CloseConnection()
+	}()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Applifier/golang-backend-assignment/datastream"
+	"github.com/Applifier/golang-backend-assignment/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	fakeFirstFrame  = []byte{byte(protocol.CommandTypeMessageFromClient), 3, 0}
+	fakeSecondFrame = []byte{byte(protocol.CommandTypeMessageFromClient), 4, 0, 1}
+)
+
+func newSlowConsumerTestServer(policy SlowConsumerPolicy) (*Server, *client, *datastream.MockTcpDataStream) {
+	fakeDataStreamer := new(datastream.MockTcpDataStream)
+	fakeClient := &client{
+		dataStreamer: fakeDataStreamer,
+		id:           uint64(1),
+		outbound:     newOutboundQueue(1),
+		writerDone:   make(chan struct{}),
+	}
+	server := &Server{
+		dataStreamer:       fakeDataStreamer,
+		clients:            []*client{fakeClient},
+		clientIDs:          []uint64{fakeClient.id},
+		clientMutex:        &sync.Mutex{},
+		slowConsumerPolicy: policy}
+	return server, fakeClient, fakeDataStreamer
+}
+
+func TestNewWithSlowConsumerPolicyShouldConfigurePolicy(t *testing.T) {
+	server := New(WithSlowConsumerPolicy(SlowConsumerDropNew))
+	assert.Equal(t, SlowConsumerDropNew, server.slowConsumerPolicy)
+	assert.Equal(t, SlowConsumerBlock, New().slowConsumerPolicy)
+}
+
+func TestSlowConsumerBlockShouldWaitForRoom(t *testing.T) {
+	server, fakeClient, _ := newSlowConsumerTestServer(SlowConsumerBlock)
+	server.sendMessageToClient(fakeClient, fakeFirstFrame)
+
+	sent := make(chan bool)
+	go func() {
+		server.sendMessageToClient(fakeClient, fakeSecondFrame)
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		assert.Fail(t, "sender should wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	frames, _ := fakeClient.outbound.popAll()
+	assert.Equal(t, [][]byte{fakeFirstFrame}, frames)
+	<-sent
+	assert.Equal(t, SlowConsumerStats{}, server.SlowConsumerStats())
+}
+
+func TestSlowConsumerDropOldestShouldDropQueuedFrame(t *testing.T) {
+	server, fakeClient, _ := newSlowConsumerTestServer(SlowConsumerDropOldest)
+	server.sendMessageToClient(fakeClient, fakeFirstFrame)
+	server.sendMessageToClient(fakeClient, fakeSecondFrame)
+
+	assert.Equal(t, [][]byte{fakeSecondFrame}, fakeClient.outbound.frames)
+	assert.Equal(t, SlowConsumerStats{DroppedFrames: 1}, server.SlowConsumerStats())
+}
+
+func TestSlowConsumerDropNewShouldDropNewFrame(t *testing.T) {
+	server, fakeClient, _ := newSlowConsumerTestServer(SlowConsumerDropNew)
+	server.sendMessageToClient(fakeClient, fakeFirstFrame)
+	server.sendMessageToClient(fakeClient, fakeSecondFrame)
+
+	assert.Equal(t, [][]byte{fakeFirstFrame}, fakeClient.outbound.frames)
+	assert.Equal(t, SlowConsumerStats{DroppedFrames: 1}, server.SlowConsumerStats())
+}
+
+func TestSlowConsumerDisconnectShouldSendErrorAndCloseConnection(t *testing.T) {
+	server, fakeClient, fakeDataStreamer := newSlowConsumerTestServer(SlowConsumerDisconnect)
+
+	expectedError := protocol.ErrorCommand{
+		Code:           protocol.ErrorCodeSlowConsumer,
+		RefCommandType: protocol.CommandTypeUnknown,
+		Message:        "client is too slow to read its messages",
+	}
+	closed := make(chan bool)
+	fakeDataStreamer.On("Write", expectedError.ToByteArray()).Return(0, nil).Once()
+	fakeDataStreamer.On("Flush").Return(nil).Once()
+	fakeDataStreamer.On("CloseConnection").Return(nil).Run(func(args mock.Arguments) {
+		close(closed)
+	}).Once()
+
+	server.sendMessageToClient(fakeClient, fakeFirstFrame)
+	server.sendMessageToClient(fakeClient, fakeSecondFrame)
+	// the client is already disconnecting
+	server.sendMessageToClient(fakeClient, fakeSecondFrame)
+
+	go server.write(fakeClient)
+	<-closed
+
+	fakeDataStreamer.AssertExpectations(t)
+	assert.Equal(t, SlowConsumerStats{DroppedFrames: 2, Disconnects: 1}, server.SlowConsumerStats())
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Applifier/golang-backend-assignment/protocol"
+)
+
+// subscriptionTrie keeps the topic patterns the clients subscribed to, every node is one level of the patterns.
+// The zero value is ready to use.
+type subscriptionTrie struct {
+	mutex sync.Mutex
+	root  topicNode
+	// patterns are the patterns of every subscriber, to remove them when the subscriber disconnects
+	patterns map[*client]map[string]struct{}
+}
+
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[*client]struct{}
+}
+
+// subscribe adds the subscription of the client, subscribing to the same pattern again does nothing
+func (t *subscriptionTrie) subscribe(pattern string, subscriber *client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	node := &t.root
+	for _, level := range strings.Split(pattern, protocol.TopicSeparator) {
+		if node.children == nil {
+			node.children = make(map[string]*topicNode)
+		}
+		child, ok := node.children[level]
+		if !ok {
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	if node.subscribers == nil {
+		node.subscribers = make(map[*client]struct{})
+	}
+	node.subscribers[subscriber] = struct{}{}
+
+	if t.patterns == nil {
+		t.patterns = make(map[*client]map[string]struct{})
+	}
+	if t.patterns[subscriber] == nil {
+		t.patterns[subscriber] = make(map[string]struct{})
+	}
+	t.patterns[subscriber][pattern] = struct{}{}
+}
+
+// unsubscribe removes the subscription of the client, it returns false if the client is not subscribed to the pattern
+func (t *subscriptionTrie) unsubscribe(pattern string, subscriber *client) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.removeSubscription(pattern, subscriber)
+}
+
+// unsubscribeAll removes all the subscriptions of the client
+func (t *subscriptionTrie) unsubscribeAll(subscriber *client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for pattern := range t.patterns[subscriber] {
+		t.removeSubscription(pattern, subscriber)
+	}
+}
+
+func (t *subscriptionTrie) removeSubscription(pattern string, subscriber *client) bool {
+	if _, ok := t.patterns[subscriber][pattern]; !ok {
+		return false
+	}
+
+	delete(t.patterns[subscriber], pattern)
+	if len(t.patterns[subscriber]) == 0 {
+		delete(t.patterns, subscriber)
+	}
+	removeFromNode(&t.root, strings.Split(pattern, protocol.TopicSeparator), subscriber)
+	return true
+}
+
+// removeFromNode removes the subscriber from the node of the levels and drops the nodes left empty,
+// it returns true if the given node is empty
+func removeFromNode(node *topicNode, levels []string, subscriber *client) bool {
+	if len(levels) == 0 {
+		delete(node.subscribers, subscriber)
+	} else if child, ok := node.children[levels[0]]; ok && removeFromNode(child, levels[1:], subscriber) {
+		delete(node.children, levels[0])
+	}
+	return len(node.subscribers) == 0 && len(node.children) == 0
+}
+
+// match returns the clients with a pattern matching the topic, every client once
+func (t *subscriptionTrie) match(topic string) []*client {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	matched := make(map[*client]struct{})
+	matchNode(&t.root, strings.Split(topic, protocol.TopicSeparator), matched)
+
+	subscribers := make([]*client, 0, len(matched))
+	for subscriber := range matched {
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers
+}
+
+func matchNode(node *topicNode, levels []string, matched map[*client]struct{}) {
+	if len(levels) == 0 {
+		for subscriber := range node.subscribers {
+			matched[subscriber] = struct{}{}
+		}
+		return
+	}
+
+	if child, ok := node.children[levels[0]]; ok {
+		matchNode(child, levels[1:], matched)
+	}
+	if child, ok := node.children[protocol.TopicWildcard]; ok {
+		matchNode(child, levels[1:], matched)
+	}
+	// the rest wildcard is always the last level of a pattern and there is at least one level left
+	if child, ok := node.children[protocol.TopicWildcardRest]; ok {
+		for subscriber := range child.subscribers {
+			matched[subscriber] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionTrieShouldMatchWildcards(t *testing.T) {
+	topics := subscriptionTrie{}
+	exact := &client{id: 1}
+	oneLevel := &client{id: 2}
+	rest := &client{id: 3}
+	other := &client{id: 4}
+
+	topics.subscribe("alerts.disk", exact)
+	topics.subscribe("alerts.*", oneLevel)
+	topics.subscribe("alerts.>", rest)
+	topics.subscribe("metrics.*", other)
+
+	assert.ElementsMatch(t, []*client{exact, oneLevel, rest}, topics.match("alerts.disk"))
+	assert.ElementsMatch(t, []*client{oneLevel, rest}, topics.match("alerts.cpu"))
+	assert.ElementsMatch(t, []*client{rest}, topics.match("alerts.disk.full"))
+	assert.Empty(t, topics.match("alerts"))
+	assert.Empty(t, topics.match("logs.disk"))
+}
+
+func TestSubscriptionTrieShouldMatchClientOnce(t *testing.T) {
+	topics := subscriptionTrie{}
+	subscriber := &client{id: 1}
+
+	topics.subscribe("alerts.disk", subscriber)
+	topics.subscribe("alerts.*", subscriber)
+	topics.subscribe("*.disk", subscriber)
+
+	assert.Equal(t, []*client{subscriber}, topics.match("alerts.disk"))
+}
+
+func TestSubscriptionTrieShouldRemoveSubscriptions(t *testing.T) {
+	topics := subscriptionTrie{}
+	first := &client{id: 1}
+	second := &client{id: 2}
+
+	topics.subscribe("alerts.*", first)
+	topics.subscribe("alerts.disk", first)
+	topics.subscribe("alerts.*", second)
+
+	assert.True(t, topics.unsubscribe("alerts.*", first))
+	assert.False(t, topics.unsubscribe("alerts.*", first))
+	assert.ElementsMatch(t, []*client{first, second}, topics.match("alerts.disk"))
+	assert.Equal(t, []*client{second}, topics.match("alerts.cpu"))
+
+	topics.unsubscribeAll(first)
+	topics.unsubscribeAll(second)
+	assert.Empty(t, topics.match("alerts.disk"))
+	assert.Empty(t, topics.root.children)
+	assert.Empty(t, topics.patterns)
+}
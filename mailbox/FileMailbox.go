@@ -0,0 +1,205 @@
+package mailbox
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCorruptMailbox is returned when a mailbox file cannot be read back
+var errCorruptMailbox = errors.New("corrupt mailbox file")
+
+// mailboxFileExtension is the extension of the files keeping the messages of an identity
+const mailboxFileExtension = ".mbox"
+
+// FileMailbox keeps the messages of every identity in a file in the directory, so they survive server restarts
+type FileMailbox struct {
+	mutex     sync.Mutex
+	dir       string
+	limits    Limits
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewFileMailbox creates a mailbox keeping its files in the directory, the directory is created if needed
+func NewFileMailbox(dir string, limits Limits) (*FileMailbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileMailbox{
+		dir:       dir,
+		limits:    limits,
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}, nil
+}
+
+// Put stores the message for the identity
+func (t *FileMailbox) Put(identity string, message Message) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	if message.Time.IsZero() {
+		message.Time = now
+	}
+	if err := t.sweep(now); err != nil {
+		return err
+	}
+
+	path := t.path(identity)
+	messages, err := readMessages(path)
+	if err != nil {
+		return err
+	}
+
+	messages = t.limits.prune(messages, now)
+	if !t.limits.allows(messages, message) {
+		return ErrMailboxFull
+	}
+	return writeMessages(path, append(messages, message))
+}
+
+// Take removes the messages of the identity and returns them
+func (t *FileMailbox) Take(identity string) ([]Message, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	path := t.path(identity)
+	messages, err := readMessages(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return t.limits.prune(messages, t.now()), nil
+}
+
+// sweep drops the expired messages of the identities which do not connect again
+func (t *FileMailbox) sweep(now time.Time) error {
+	if !t.limits.sweepDue(t.lastSweep, now) {
+		return nil
+	}
+
+	t.lastSweep = now
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*"+mailboxFileExtension))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		messages, err := readMessages(path)
+		if err != nil {
+			return err
+		}
+		if err := writeMessages(path, t.limits.prune(messages, now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the file of the identity, the identity is hex encoded since it can have any character
+func (t *FileMailbox) path(identity string) string {
+	return filepath.Join(t.dir, hex.EncodeToString([]byte(identity))+mailboxFileExtension)
+}
+
+// readMessages reads the messages of a mailbox file, a missing file has no messages
+func readMessages(path string) ([]Message, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for len(data) > 0 {
+		message, rest, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		data = rest
+	}
+	return messages, nil
+}
+
+// writeMessages replaces the mailbox file with the messages, the file is removed if there is no message.
+// The messages are written to a temporary file first, so a crash does not leave a half written mailbox.
+func writeMessages(path string, messages []Message) error {
+	if len(messages) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var data []byte
+	for _, message := range messages {
+		data = append(data, encodeMessage(message)...)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), strings.TrimSuffix(filepath.Base(path), mailboxFileExtension)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// encodeMessage writes time (8 bytes) + sender id (8 bytes) + sender nick length (2 bytes) + sender nick
+// + body length (4 bytes) + body
+func encodeMessage(message Message) []byte {
+	data := make([]byte, 18, 22+len(message.SenderNick)+len(message.Body))
+	binary.LittleEndian.PutUint64(data[0:8], uint64(message.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(data[8:16], message.SenderID)
+	binary.LittleEndian.PutUint16(data[16:18], uint16(len(message.SenderNick)))
+	data = append(data, message.SenderNick...)
+
+	bodyLength := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bodyLength, uint32(len(message.Body)))
+	data = append(data, bodyLength...)
+	return append(data, message.Body...)
+}
+
+func decodeMessage(data []byte) (Message, []byte, error) {
+	if len(data) < 18 {
+		return Message{}, nil, errCorruptMailbox
+	}
+
+	nickEnd := 18 + int(binary.LittleEndian.Uint16(data[16:18]))
+	if len(data) < nickEnd+4 {
+		return Message{}, nil, errCorruptMailbox
+	}
+
+	bodyEnd := nickEnd + 4 + int(binary.LittleEndian.Uint32(data[nickEnd:nickEnd+4]))
+	if len(data) < bodyEnd {
+		return Message{}, nil, errCorruptMailbox
+	}
+
+	message := Message{
+		Time:       time.Unix(0, int64(binary.LittleEndian.Uint64(data[0:8]))),
+		SenderID:   binary.LittleEndian.Uint64(data[8:16]),
+		SenderNick: string(data[18:nickEnd]),
+		Body:       data[nickEnd+4 : bodyEnd],
+	}
+	return message, data[bodyEnd:], nil
+}
@@ -0,0 +1,74 @@
+package mailbox
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMailboxFull is returned when the mailbox of the identity cannot take the message within its limits
+var ErrMailboxFull = errors.New("Mailbox full")
+
+// Message is a message waiting for its recipient to connect
+type Message struct {
+	SenderID   uint64
+	SenderNick string
+	Body       []byte
+	// Time is when the message is stored, Put sets it if it is zero
+	Time time.Time
+}
+
+// IMailbox keeps the messages sent to identities which are not connected, until they connect again
+type IMailbox interface {
+	// Put stores the message for the identity, it returns ErrMailboxFull if the message does not fit in the limits
+	Put(identity string, message Message) error
+	// Take removes the messages of the identity and returns them, the oldest first
+	Take(identity string) ([]Message, error)
+}
+
+// Limits bound the messages kept for every identity, zero means no limit
+type Limits struct {
+	// Retention is how long a message is kept, older messages are dropped
+	Retention time.Duration
+	// MaxMessages is the number of messages kept for an identity
+	MaxMessages int
+	// MaxBytes is the total size of the message bodies kept for an identity
+	MaxBytes int
+}
+
+// prune drops the messages older than the retention
+func (t Limits) prune(messages []Message, now time.Time) []Message {
+	if t.Retention <= 0 {
+		return messages
+	}
+
+	kept := messages[:0]
+	for _, message := range messages {
+		if now.Sub(message.Time) < t.Retention {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
+
+// allows tells if the message can be kept next to the messages already kept for the identity
+func (t Limits) allows(messages []Message, message Message) bool {
+	if t.MaxMessages > 0 && len(messages)+1 > t.MaxMessages {
+		return false
+	}
+
+	if t.MaxBytes > 0 {
+		size := len(message.Body)
+		for _, kept := range messages {
+			size = size + len(kept.Body)
+		}
+		if size > t.MaxBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// sweepDue tells if it is time to drop the expired messages of all the identities, which is done once per retention
+func (t Limits) sweepDue(lastSweep time.Time, now time.Time) bool {
+	return t.Retention > 0 && now.Sub(lastSweep) >= t.Retention
+}
@@ -0,0 +1,135 @@
+package mailbox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forEachMailbox runs the test for every mailbox implementation, with a clock the test can move
+func forEachMailbox(t *testing.T, limits Limits, test func(t *testing.T, mailbox IMailbox, clock *time.Time)) {
+	t.Run("memory", func(t *testing.T) {
+		clock := time.Unix(1000, 0)
+		mailbox := NewMemoryMailbox(limits)
+		mailbox.now = func() time.Time { return clock }
+		mailbox.lastSweep = clock
+		test(t, mailbox, &clock)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "mailbox")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		clock := time.Unix(1000, 0)
+		mailbox, err := NewFileMailbox(dir, limits)
+		require.NoError(t, err)
+		mailbox.now = func() time.Time { return clock }
+		mailbox.lastSweep = clock
+		test(t, mailbox, &clock)
+	})
+}
+
+func TestMailboxShouldReturnMessagesOnce(t *testing.T) {
+	forEachMailbox(t, Limits{}, func(t *testing.T, mailbox IMailbox, clock *time.Time) {
+		first := Message{SenderID: 1, SenderNick: "alice", Body: []byte("hello")}
+		second := Message{SenderID: 2, Body: []byte("hi")}
+		assert.Nil(t, mailbox.Put("bob", first))
+		assert.Nil(t, mailbox.Put("bob", second))
+		assert.Nil(t, mailbox.Put("carol", first))
+
+		first.Time = *clock
+		second.Time = *clock
+		messages, err := mailbox.Take("bob")
+		assert.Nil(t, err)
+		assert.Equal(t, []Message{first, second}, messages)
+
+		messages, err = mailbox.Take("bob")
+		assert.Nil(t, err)
+		assert.Empty(t, messages)
+
+		messages, err = mailbox.Take("carol")
+		assert.Nil(t, err)
+		assert.Equal(t, []Message{first}, messages)
+	})
+}
+
+func TestMailboxShouldDropExpiredMessages(t *testing.T) {
+	forEachMailbox(t, Limits{Retention: time.Minute}, func(t *testing.T, mailbox IMailbox, clock *time.Time) {
+		assert.Nil(t, mailbox.Put("bob", Message{Body: []byte("old")}))
+		*clock = clock.Add(30 * time.Second)
+		assert.Nil(t, mailbox.Put("bob", Message{Body: []byte("new")}))
+		*clock = clock.Add(45 * time.Second)
+
+		messages, err := mailbox.Take("bob")
+		assert.Nil(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, []byte("new"), messages[0].Body)
+	})
+}
+
+func TestMailboxShouldRejectMessagesOverLimits(t *testing.T) {
+	forEachMailbox(t, Limits{MaxMessages: 2, MaxBytes: 10}, func(t *testing.T, mailbox IMailbox, clock *time.Time) {
+		assert.Nil(t, mailbox.Put("bob", Message{Body: []byte("12345")}))
+		assert.Equal(t, ErrMailboxFull, mailbox.Put("bob", Message{Body: []byte("123456")}))
+		assert.Nil(t, mailbox.Put("bob", Message{Body: []byte("12345")}))
+		assert.Equal(t, ErrMailboxFull, mailbox.Put("bob", Message{}))
+
+		// the limits are for every identity
+		assert.Nil(t, mailbox.Put("carol", Message{Body: []byte("12345")}))
+
+		messages, err := mailbox.Take("bob")
+		assert.Nil(t, err)
+		assert.Len(t, messages, 2)
+	})
+}
+
+func TestMailboxShouldSweepIdentitiesWhichDoNotConnect(t *testing.T) {
+	forEachMailbox(t, Limits{Retention: time.Minute}, func(t *testing.T, mailbox IMailbox, clock *time.Time) {
+		assert.Nil(t, mailbox.Put("bob", Message{Body: []byte("old")}))
+		*clock = clock.Add(2 * time.Minute)
+		assert.Nil(t, mailbox.Put("carol", Message{Body: []byte("new")}))
+
+		switch v := mailbox.(type) {
+		case *MemoryMailbox:
+			assert.NotContains(t, v.messages, "bob")
+		case *FileMailbox:
+			_, err := os.Stat(v.path("bob"))
+			assert.True(t, os.IsNotExist(err))
+		}
+	})
+}
+
+func TestFileMailboxShouldKeepMessagesAcrossInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mailbox, err := NewFileMailbox(dir, Limits{})
+	require.NoError(t, err)
+	assert.Nil(t, mailbox.Put("bob", Message{SenderID: 1, Body: []byte("hello")}))
+
+	reopened, err := NewFileMailbox(dir, Limits{})
+	require.NoError(t, err)
+	messages, err := reopened.Take("bob")
+	assert.Nil(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("hello"), messages[0].Body)
+}
+
+func TestFileMailboxShouldReturnErrorForCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mailbox, err := NewFileMailbox(dir, Limits{})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(mailbox.path("bob"), []byte{1, 2, 3}, 0600))
+
+	_, err = mailbox.Take("bob")
+	assert.Equal(t, errCorruptMailbox, err)
+}
@@ -0,0 +1,76 @@
+package mailbox
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryMailbox keeps the messages in memory, they are lost when the server stops
+type MemoryMailbox struct {
+	mutex     sync.Mutex
+	limits    Limits
+	messages  map[string][]Message
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryMailbox creates an empty mailbox with the limits
+func NewMemoryMailbox(limits Limits) *MemoryMailbox {
+	return &MemoryMailbox{
+		limits:    limits,
+		messages:  make(map[string][]Message),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Put stores the message for the identity
+func (t *MemoryMailbox) Put(identity string, message Message) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	if message.Time.IsZero() {
+		message.Time = now
+	}
+	t.sweep(now)
+
+	messages := t.limits.prune(t.messages[identity], now)
+	if !t.limits.allows(messages, message) {
+		t.store(identity, messages)
+		return ErrMailboxFull
+	}
+
+	t.store(identity, append(messages, message))
+	return nil
+}
+
+// Take removes the messages of the identity and returns them
+func (t *MemoryMailbox) Take(identity string) ([]Message, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	messages := t.limits.prune(t.messages[identity], t.now())
+	delete(t.messages, identity)
+	return messages, nil
+}
+
+// sweep drops the expired messages of the identities which do not connect again
+func (t *MemoryMailbox) sweep(now time.Time) {
+	if !t.limits.sweepDue(t.lastSweep, now) {
+		return
+	}
+
+	t.lastSweep = now
+	for identity, messages := range t.messages {
+		t.store(identity, t.limits.prune(messages, now))
+	}
+}
+
+func (t *MemoryMailbox) store(identity string, messages []Message) {
+	if len(messages) == 0 {
+		delete(t.messages, identity)
+		return
+	}
+	t.messages[identity] = messages
+}
@@ -0,0 +1,20 @@
+package mailbox
+
+import (
+	"github.com/stretchr/testify/mock"
+)
+
+type MockMailbox struct {
+	mock.Mock
+}
+
+func (m *MockMailbox) Put(identity string, message Message) error {
+	args := m.Called(identity, message)
+	return args.Error(0)
+}
+
+func (m *MockMailbox) Take(identity string) ([]Message, error) {
+	args := m.Called(identity)
+	messages, _ := args.Get(0).([]Message)
+	return messages, args.Error(1)
+}
@@ -2,111 +2,498 @@ package protocol
 
 import (
 	"encoding/binary"
-	"errors"
+	"time"
 )
 
 const (
-	index_CommandTypeStart      = 0
-	index_CommandTypeEnd        = 1
-	index_MessageLengthStart    = 1
-	index_MessageLengthEnd      = 3
-	index_RecipientsLengthStart = 3
-	index_RecipientsLengthEnd   = 5
+	index_CommandTypeStart         = 0
+	index_CommandTypeEnd           = 1
+	index_MessageLengthStart       = 1
+	index_MessageLengthEnd         = 3
+	index_ExtendedMessageLengthEnd = 5
+	index_RecipientsLengthStart    = 0
+	index_RecipientsLengthEnd      = 2
 )
 
 type ProtocolParser struct {
-	messageLength uint16
-	index         uint16
-	command       []byte
-	commandType   CommandType
+	messageLength    uint32
+	messageLengthEnd uint32
+	headerLength     uint32
+	index            uint32
+	command          []byte
+	commandType      CommandType
+	maxFrameSize     uint32
+	discard          uint32
 }
 
 type ProtocolParserProducer struct {
+	// MaxFrameSize is the largest frame the produced parsers accept, DefaultMaxFrameSize if zero
+	MaxFrameSize uint32
 }
 
 func (t *ProtocolParserProducer) Produce() IProtocolParser {
+	maxFrameSize := t.MaxFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
 	return &ProtocolParser{
 		messageLength: 0,
 		index:         0,
+		maxFrameSize:  maxFrameSize,
 	}
 }
 
 // ParseStreamedData is to parse the byte data comes from server and convert it to meaningful internal commands
 func (t *ProtocolParser) ParseStreamedData(readedByte byte) (interface{}, error) {
 
-	// this is the first byte so we'll understand the command type here
+	// we are skipping the rest of a frame which was rejected for being too large
+	if t.discard > 0 {
+		t.discard = t.discard - 1
+		return nil, nil
+	}
+
+	// this is the first byte so we'll understand the command type and the frame format here
 	if t.index == index_CommandTypeStart {
-		t.commandType = CommandType(readedByte)
+		t.commandType = CommandType(readedByte &^ frameFlags)
+		t.messageLengthEnd = index_MessageLengthEnd
+		if readedByte&FrameFlagExtended != 0 {
+			t.messageLengthEnd = index_ExtendedMessageLengthEnd
+		}
+		t.headerLength = t.messageLengthEnd
+		if readedByte&FrameFlagRequestID != 0 {
+			t.headerLength = t.headerLength + CommandLengthRequestID
+		}
 	}
 
 	t.command = append(t.command, readedByte)
 	t.index = t.index + 1
 
-	if t.index >= index_MessageLengthEnd {
-		// 2nd and 3rd bytes are to store message length
-		t.messageLength = binary.LittleEndian.Uint16(t.command[index_MessageLengthStart:index_MessageLengthEnd])
-	} else {
-		return nil, nil
+	if t.index == t.messageLengthEnd {
+		if t.messageLengthEnd == index_ExtendedMessageLengthEnd {
+			// 2nd to 5th bytes are to store message length in the extended format
+			t.messageLength = binary.LittleEndian.Uint32(t.command[index_MessageLengthStart:index_ExtendedMessageLengthEnd])
+		} else {
+			// 2nd and 3rd bytes are to store message length
+			t.messageLength = uint32(binary.LittleEndian.Uint16(t.command[index_MessageLengthStart:index_MessageLengthEnd]))
+		}
+
+	}
+
+	// an oversized frame is rejected once its request id is read, so the rejection can be answered to the request
+	if t.index == t.headerLength && t.maxFrameSize > 0 && t.messageLength > t.maxFrameSize {
+		// skip the rest of the frame so the stream stays usable
+		frameError := FrameError{RequestID: t.requestID(), CommandType: t.commandType, Err: ErrFrameTooLarge}
+		t.discard = t.messageLength - t.index
+		t.clearState()
+		return nil, frameError
 	}
 
 	// if we are not complete yet, just add byte to array and return
-	if t.index < t.messageLength {
+	if t.index < t.headerLength || t.index < t.messageLength {
 		return nil, nil
 	}
 
-	if t.commandType == CommandTypeWhoAmI {
-		t.clearState()
-		if t.messageLength == 0 {
-			return WhoAmICommand{}, nil
+	requestID := t.requestID()
+	commandType := t.commandType
+	data := t.command[t.headerLength:]
+	t.clearState()
+
+	command, err := parseCommand(commandType, requestID, data)
+	if err == ErrMalformedCommand {
+		return nil, FrameError{RequestID: requestID, CommandType: commandType, Err: err}
+	}
+	return command, err
+}
+
+// requestID returns the request id following the message length if the frame has one, once the header is read
+func (t *ProtocolParser) requestID() uint32 {
+	if t.headerLength > t.messageLengthEnd {
+		return binary.LittleEndian.Uint32(t.command[t.messageLengthEnd:t.headerLength])
+	}
+	return 0
+}
+
+// parseCommand converts the data part of a complete frame to the command of given type
+func parseCommand(commandType CommandType, requestID uint32, data []byte) (interface{}, error) {
+	switch commandType {
+	case CommandTypeWhoAmI:
+		if len(data) < CommandLengthClient {
+			return WhoAmICommand{RequestID: requestID}, nil
 		}
 
 		return WhoAmICommand{
-			ClientID: binary.LittleEndian.Uint64(t.command[index_MessageLengthEnd : index_MessageLengthEnd+8]),
+			RequestID: requestID,
+			ClientID:  binary.LittleEndian.Uint64(data[0:8]),
 		}, nil
-	} else if t.commandType == CommandTypeListClients {
+	case CommandTypeListClients:
 		var clientIDs []uint64
 
-		for i := index_MessageLengthEnd + 8; i <= int(t.messageLength); i = i + 8 {
-			clientIDs = append(clientIDs, binary.LittleEndian.Uint64(t.command[i-8:i]))
+		for i := 8; i <= len(data); i = i + 8 {
+			clientIDs = append(clientIDs, binary.LittleEndian.Uint64(data[i-8:i]))
 		}
 
-		t.clearState()
 		return ListClientsCommand{
+			RequestID:        requestID,
 			ConnectedClients: clientIDs,
 		}, nil
-	} else if t.commandType == CommandTypeMessageFromClient {
-		sender := binary.LittleEndian.Uint64(t.command[index_MessageLengthEnd : index_MessageLengthEnd+8])
-		body := t.command[index_MessageLengthEnd+8:]
+	case CommandTypeMessageFromClient:
+		if len(data) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
 
-		t.clearState()
 		return MessageFromClient{
-			SenderID: sender,
-			Body:     body,
+			SenderID: binary.LittleEndian.Uint64(data[0:8]),
+			Body:     data[8:],
 		}, nil
-	} else if t.commandType == CommandTypeSendMessage {
-		// if message type is send message we store the recipient count in 4th and 5th bytes
-		recipientsCount := binary.LittleEndian.Uint16(t.command[index_RecipientsLengthStart:index_RecipientsLengthEnd])
+	case CommandTypeMessageFromClientWithNick:
+		if len(data) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		nick, rest, err := decodeString(data[8:])
+		if err != nil {
+			return nil, ErrMalformedCommand
+		}
+
+		return MessageFromClient{
+			SenderID:   binary.LittleEndian.Uint64(data[0:8]),
+			SenderNick: nick,
+			Body:       rest,
+		}, nil
+	case CommandTypeSendMessage:
+		if len(data) < index_RecipientsLengthEnd {
+			return nil, ErrMalformedCommand
+		}
+
+		// if message type is send message we store the recipient count in first 2 bytes of the data
+		recipientsCount := int(binary.LittleEndian.Uint16(data[index_RecipientsLengthStart:index_RecipientsLengthEnd]))
+		bodyStart := index_RecipientsLengthEnd + recipientsCount*8
+		if len(data) < bodyStart {
+			return nil, ErrMalformedCommand
+		}
 
 		var recipients []uint64
-		for i := index_RecipientsLengthEnd + 8; i < index_RecipientsLengthEnd+8+int(recipientsCount*8); i = i + 8 {
-			recipients = append(recipients, binary.LittleEndian.Uint64(t.command[i-8:i]))
+		for i := index_RecipientsLengthEnd + 8; i <= bodyStart; i = i + 8 {
+			recipients = append(recipients, binary.LittleEndian.Uint64(data[i-8:i]))
 		}
-		messageBody := t.command[index_RecipientsLengthEnd+(recipientsCount*8):]
 
-		t.clearState()
 		return SendMessageCommand{
+			RequestID:  requestID,
 			Recipients: recipients,
-			Body:       messageBody,
+			Body:       data[bodyStart:],
 		}, nil
-	} else {
-		t.clearState()
-		return nil, errors.New("Unknown Command Processed")
+	case CommandTypeHello, CommandTypeWelcome:
+		if len(data) < CommandLengthVersion+CommandLengthCapabilities {
+			return nil, ErrMalformedCommand
+		}
+
+		version := binary.LittleEndian.Uint16(data[0:2])
+		capabilities := Capability(binary.LittleEndian.Uint32(data[2:6]))
+		if commandType == CommandTypeHello {
+			return HelloCommand{Version: version, Capabilities: capabilities}, nil
+		}
+		return WelcomeCommand{Version: version, Capabilities: capabilities}, nil
+	case CommandTypeError:
+		if len(data) < CommandLengthErrorCode+CommandLengthType {
+			return nil, ErrMalformedCommand
+		}
+
+		return ErrorCommand{
+			RequestID:      requestID,
+			Code:           ErrorCode(binary.LittleEndian.Uint16(data[0:2])),
+			RefCommandType: CommandType(data[2]),
+			Message:        string(data[3:]),
+		}, nil
+	case CommandTypePing:
+		return PingCommand{}, nil
+	case CommandTypePong:
+		return PongCommand{}, nil
+	case CommandTypeGoAway:
+		return GoAwayCommand{Reason: string(data)}, nil
+	case CommandTypeJoinRoom, CommandTypeLeaveRoom:
+		room, rest, err := decodeString(data)
+		if err != nil || ValidateRoomName(room) != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		if commandType == CommandTypeJoinRoom {
+			return JoinRoomCommand{RequestID: requestID, Room: room}, nil
+		}
+		return LeaveRoomCommand{RequestID: requestID, Room: room}, nil
+	case CommandTypeListRooms:
+		var rooms []string
+		for len(data) > 0 {
+			room, rest, err := decodeString(data)
+			if err != nil {
+				return nil, ErrMalformedCommand
+			}
+			rooms = append(rooms, room)
+			data = rest
+		}
+
+		return ListRoomsCommand{RequestID: requestID, Rooms: rooms}, nil
+	case CommandTypeRoomMessage:
+		room, rest, err := decodeString(data)
+		if err != nil || ValidateRoomName(room) != nil || len(rest) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		return RoomMessageCommand{
+			RequestID: requestID,
+			Room:      room,
+			SenderID:  binary.LittleEndian.Uint64(rest[0:8]),
+			Body:      rest[8:],
+		}, nil
+	case CommandTypeBroadcast:
+		return BroadcastCommand{RequestID: requestID, Body: data}, nil
+	case CommandTypeSubscribe, CommandTypeUnsubscribe:
+		pattern, rest, err := decodeString(data)
+		if err != nil || ValidateTopicPattern(pattern) != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		if commandType == CommandTypeSubscribe {
+			return SubscribeCommand{RequestID: requestID, Pattern: pattern}, nil
+		}
+		return UnsubscribeCommand{RequestID: requestID, Pattern: pattern}, nil
+	case CommandTypePublish:
+		topic, rest, err := decodeString(data)
+		if err != nil || ValidateTopic(topic) != nil {
+			return nil, ErrMalformedCommand
+		}
+
+		return PublishCommand{RequestID: requestID, Topic: topic, Body: rest}, nil
+	case CommandTypeTopicMessage:
+		topic, rest, err := decodeString(data)
+		if err != nil || ValidateTopic(topic) != nil || len(rest) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		return TopicMessageCommand{
+			Topic:    topic,
+			SenderID: binary.LittleEndian.Uint64(rest[0:8]),
+			Body:     rest[8:],
+		}, nil
+	case CommandTypeSetNick:
+		nick, rest, err := decodeString(data)
+		if err != nil || ValidateNick(nick) != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		return SetNickCommand{RequestID: requestID, Nick: nick}, nil
+	case CommandTypeLookup:
+		if len(data) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		nick, rest, err := decodeString(data[8:])
+		if err != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		return LookupCommand{RequestID: requestID, ClientID: binary.LittleEndian.Uint64(data[0:8]), Nick: nick}, nil
+	case CommandTypeNickChanged:
+		if len(data) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		oldNick, rest, err := decodeString(data[8:])
+		if err != nil {
+			return nil, ErrMalformedCommand
+		}
+		nick, rest, err := decodeString(rest)
+		if err != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		return NickChangedCommand{ClientID: binary.LittleEndian.Uint64(data[0:8]), OldNick: oldNick, Nick: nick}, nil
+	case CommandTypeListUsers:
+		var users []User
+		for len(data) > 0 {
+			if len(data) < CommandLengthClient {
+				return nil, ErrMalformedCommand
+			}
+
+			nick, rest, err := decodeString(data[8:])
+			if err != nil {
+				return nil, ErrMalformedCommand
+			}
+			users = append(users, User{ID: binary.LittleEndian.Uint64(data[0:8]), Nick: nick})
+			data = rest
+		}
+
+		return ListUsersCommand{RequestID: requestID, Users: users}, nil
+	case CommandTypePresence:
+		if len(data) != 1+CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		return PresenceCommand{Event: PresenceEvent(data[0]), ClientID: binary.LittleEndian.Uint64(data[1:])}, nil
+	case CommandTypeSendToNick:
+		nick, rest, err := decodeString(data)
+		if err != nil || ValidateNick(nick) != nil {
+			return nil, ErrMalformedCommand
+		}
+
+		return SendToNickCommand{RequestID: requestID, Nick: nick, Body: rest}, nil
+	case CommandTypeSendResult:
+		if len(data) < CommandLengthClient {
+			return nil, ErrMalformedCommand
+		}
+
+		delivered, rest, err := decodeIDs(data[8:])
+		if err != nil {
+			return nil, ErrMalformedCommand
+		}
+		failed, rest, err := decodeIDs(rest)
+		if err != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		return SendResultCommand{
+			RequestID: requestID,
+			MessageID: binary.LittleEndian.Uint64(data[0:8]),
+			Delivered: delivered,
+			Failed:    failed,
+		}, nil
+	case CommandTypeAuth:
+		if len(data) < 1 {
+			return nil, ErrMalformedCommand
+		}
+
+		username, rest, err := decodeString(data[1:])
+		if err != nil {
+			return nil, ErrMalformedCommand
+		}
+		secret, rest, err := decodeString(rest)
+		if err != nil {
+			return nil, ErrMalformedCommand
+		}
+		identity, rest, err := decodeString(rest)
+		if err != nil || len(rest) > 0 {
+			return nil, ErrMalformedCommand
+		}
+
+		return AuthCommand{
+			RequestID: requestID,
+			Scheme:    AuthScheme(data[0]),
+			Username:  username,
+			Secret:    secret,
+			Identity:  identity,
+		}, nil
+	case CommandTypeHistory:
+		command, err := decodeHistoryCommand(requestID, data)
+		if err != nil {
+			return nil, err
+		}
+		return command, nil
+	}
+
+	return nil, UnknownCommandError{RequestID: requestID, CommandType: commandType}
+}
+
+// decodeHistoryCommand reads a HistoryCommand written by its ToByteArray
+func decodeHistoryCommand(requestID uint32, data []byte) (HistoryCommand, error) {
+	if len(data) < CommandLengthClient {
+		return HistoryCommand{}, ErrMalformedCommand
+	}
+
+	command := HistoryCommand{RequestID: requestID}
+	command.Query.Peer = binary.LittleEndian.Uint64(data[0:8])
+	room, rest, err := decodeString(data[8:])
+	if err != nil || len(rest) < 8+2+8+2 {
+		return HistoryCommand{}, ErrMalformedCommand
+	}
+	if room != "" && ValidateRoomName(room) != nil {
+		return HistoryCommand{}, ErrMalformedCommand
+	}
+	command.Query.Room = room
+	command.Query.Before = binary.LittleEndian.Uint64(rest[0:8])
+	command.Query.Limit = binary.LittleEndian.Uint16(rest[8:10])
+	command.Next = binary.LittleEndian.Uint64(rest[10:18])
+	count := int(binary.LittleEndian.Uint16(rest[18:20]))
+	rest = rest[20:]
+
+	for i := 0; i < count; i++ {
+		var message HistoryMessage
+		message, rest, err = decodeHistoryMessage(rest)
+		if err != nil {
+			return HistoryCommand{}, err
+		}
+		command.Messages = append(command.Messages, message)
+	}
+	if len(rest) > 0 {
+		return HistoryCommand{}, ErrMalformedCommand
+	}
+	return command, nil
+}
+
+// decodeHistoryMessage reads a message written by encodeHistoryMessage and returns the data after it
+func decodeHistoryMessage(data []byte) (HistoryMessage, []byte, error) {
+	if len(data) < 8+8+CommandLengthClient {
+		return HistoryMessage{}, nil, ErrMalformedCommand
+	}
+
+	message := HistoryMessage{
+		ID:       binary.LittleEndian.Uint64(data[0:8]),
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:16]))),
+		SenderID: binary.LittleEndian.Uint64(data[16:24]),
+	}
+
+	recipients, rest, err := decodeIDs(data[24:])
+	if err != nil {
+		return HistoryMessage{}, nil, ErrMalformedCommand
+	}
+	room, rest, err := decodeString(rest)
+	if err != nil || len(rest) < 4 {
+		return HistoryMessage{}, nil, ErrMalformedCommand
+	}
+
+	bodyEnd := 4 + int(binary.LittleEndian.Uint32(rest[0:4]))
+	if bodyEnd < 4 || len(rest) < bodyEnd {
+		return HistoryMessage{}, nil, ErrMalformedCommand
+	}
+	message.Recipients = recipients
+	message.Room = room
+	message.Body = rest[4:bodyEnd]
+	return message, rest[bodyEnd:], nil
+}
+
+// decodeString reads a string written by encodeString and returns the data after it
+func decodeString(data []byte) (string, []byte, error) {
+	if len(data) < CommandLengthStringLength {
+		return "", nil, ErrMalformedCommand
 	}
 
+	end := CommandLengthStringLength + int(binary.LittleEndian.Uint16(data[0:CommandLengthStringLength]))
+	if len(data) < end {
+		return "", nil, ErrMalformedCommand
+	}
+	return string(data[CommandLengthStringLength:end]), data[end:], nil
+}
+
+// decodeIDs reads the ids written by encodeIDs and returns the data after them
+func decodeIDs(data []byte) ([]uint64, []byte, error) {
+	if len(data) < CommandLengthRecipientsLength {
+		return nil, nil, ErrMalformedCommand
+	}
+
+	end := CommandLengthRecipientsLength + int(binary.LittleEndian.Uint16(data[0:CommandLengthRecipientsLength]))*8
+	if len(data) < end {
+		return nil, nil, ErrMalformedCommand
+	}
+
+	var ids []uint64
+	for i := CommandLengthRecipientsLength; i < end; i = i + 8 {
+		ids = append(ids, binary.LittleEndian.Uint64(data[i:i+8]))
+	}
+	return ids, data[end:], nil
 }
 
 func (t *ProtocolParser) clearState() {
-	// clear the array
-	t.command = t.command[:0]
+	// start a new array, parsed commands keep referencing the old one
+	t.command = nil
 	t.index = 0
+	t.messageLength = 0
 }
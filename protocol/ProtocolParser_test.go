@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -263,7 +264,7 @@ func TestUnknownCommandShouldReturnNil(t *testing.T) {
 	producer := ProtocolParserProducer{}
 	protocolParser := producer.Produce()
 
-	resp, err := protocolParser.ParseStreamedData(byte(5))
+	resp, err := protocolParser.ParseStreamedData(byte(CommandTypeUnknown))
 	assert.Nil(t, resp)
 	assert.Nil(t, err)
 
@@ -274,9 +275,36 @@ func TestUnknownCommandShouldReturnNil(t *testing.T) {
 	resp, err = protocolParser.ParseStreamedData(byte(0))
 	assert.Nil(t, resp)
 	assert.Error(t, err)
+	assert.Equal(t, UnknownCommandError{CommandType: CommandTypeUnknown}, err)
 
 }
 
+func TestRejectedFramesShouldCarryTheirRequestID(t *testing.T) {
+	producer := ProtocolParserProducer{MaxFrameSize: 64}
+	protocolParser := producer.Produce()
+
+	// the frame is only rejected once its request id is read
+	command := SendMessageCommand{RequestID: 7, Recipients: []uint64{2}, Body: make([]byte, 100)}
+	convertedBytes := command.ToByteArray()
+	for i := 0; i < len(convertedBytes); i++ {
+		_, err := protocolParser.ParseStreamedData(convertedBytes[i])
+		if i == 6 {
+			assert.Equal(t, FrameError{RequestID: 7, CommandType: CommandTypeSendMessage, Err: ErrFrameTooLarge}, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	var err error
+
+	// a newer client sends a request of a command this parser does not know
+	unknown := encodeFrame(CommandType(50), 8, []byte{1, 2, 3})
+	for i := 0; i < len(unknown); i++ {
+		_, err = protocolParser.ParseStreamedData(unknown[i])
+	}
+	assert.Equal(t, UnknownCommandError{RequestID: 8, CommandType: CommandType(50)}, err)
+}
+
 func TestWhoAmICommandToByteArray(t *testing.T) {
 	commandBytes := []byte{}
 
@@ -386,3 +414,455 @@ func TestCreateQueryCommand(t *testing.T) {
 
 	assert.Equal(t, commandBytes, convertedBytes)
 }
+
+func TestLargeMessageFromClientShouldUseExtendedFrame(t *testing.T) {
+	body := make([]byte, 70000)
+	command := MessageFromClient{SenderID: uint64(1), Body: body}
+	convertedBytes := command.ToByteArray()
+
+	messageLength := CommandLengthType + CommandLengthExtendedMessageLength + CommandLengthClient + len(body)
+
+	assert.Equal(t, byte(CommandTypeMessageFromClient)|FrameFlagExtended, convertedBytes[0])
+	assert.Equal(t, uint32(messageLength), binary.LittleEndian.Uint32(convertedBytes[1:5]))
+	assert.Equal(t, messageLength, len(convertedBytes))
+}
+
+func TestExtendedSendMessageCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := SendMessageCommand{Recipients: []uint64{uint64(1), uint64(2)}, Body: make([]byte, 70000)}
+	convertedBytes := command.ToByteArray()
+
+	for i := 0; i < len(convertedBytes)-1; i++ {
+		resp, err := protocolParser.ParseStreamedData(convertedBytes[i])
+		assert.Nil(t, resp)
+		assert.Nil(t, err)
+	}
+
+	resp, err := protocolParser.ParseStreamedData(convertedBytes[len(convertedBytes)-1])
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestFrameLargerThanMaxFrameSizeShouldBeRejectedAndSkipped(t *testing.T) {
+	producer := ProtocolParserProducer{MaxFrameSize: 100}
+	protocolParser := producer.Produce()
+
+	command := MessageFromClient{SenderID: uint64(1), Body: make([]byte, 200)}
+	convertedBytes := command.ToByteArray()
+
+	resp, err := protocolParser.ParseStreamedData(convertedBytes[0])
+	assert.Nil(t, resp)
+	assert.Nil(t, err)
+	resp, err = protocolParser.ParseStreamedData(convertedBytes[1])
+	assert.Nil(t, resp)
+	assert.Nil(t, err)
+	resp, err = protocolParser.ParseStreamedData(convertedBytes[2])
+	assert.Nil(t, resp)
+	assert.Equal(t, FrameError{CommandType: CommandTypeMessageFromClient, Err: ErrFrameTooLarge}, err)
+
+	for i := 3; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		assert.Nil(t, resp)
+		assert.Nil(t, err)
+	}
+
+	// next frame should be parsed as usual
+	whoAmICommand := WhoAmICommand{ClientID: 1}
+	whoAmIBytes := whoAmICommand.ToByteArray()
+	for i := 0; i < len(whoAmIBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(whoAmIBytes[i])
+	}
+	assert.Equal(t, whoAmICommand, resp)
+	assert.Nil(t, err)
+}
+
+func TestHelloCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := HelloCommand{Version: ProtocolVersion, Capabilities: CapabilityExtendedFrames}
+	convertedBytes := command.ToByteArray()
+	assert.Equal(t, byte(CommandTypeHello), convertedBytes[0])
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestWelcomeCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := WelcomeCommand{Version: ProtocolVersion, Capabilities: CapabilityExtendedFrames}
+	convertedBytes := command.ToByteArray()
+	assert.Equal(t, byte(CommandTypeWelcome), convertedBytes[0])
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestErrorCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := ErrorCommand{Code: ErrorCodeUnknownRecipient, RefCommandType: CommandTypeSendMessage, Message: "unknown recipients [5]"}
+	convertedBytes := command.ToByteArray()
+	assert.Equal(t, byte(CommandTypeError), convertedBytes[0])
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+	assert.EqualError(t, command, "server rejected command 3 with code 6: unknown recipients [5]")
+}
+
+func TestQueryCommandWithRequestIDShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := QueryCommand{RequestID: 42}
+	convertedBytes := command.CreateQueryCommand(CommandTypeListClients)
+
+	assert.Equal(t, byte(CommandTypeListClients)|FrameFlagRequestID, convertedBytes[0])
+	assert.Equal(t, uint16(7), binary.LittleEndian.Uint16(convertedBytes[1:3]))
+	assert.Equal(t, uint32(42), binary.LittleEndian.Uint32(convertedBytes[3:7]))
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, ListClientsCommand{RequestID: 42}, resp)
+	assert.Nil(t, err)
+}
+
+func TestResponsesShouldKeepRequestID(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []ICorrelatedCommand{
+		WhoAmICommand{RequestID: 1, ClientID: 5},
+		ListClientsCommand{RequestID: 2, ConnectedClients: []uint64{1, 2}},
+		ErrorCommand{RequestID: 3, Code: ErrorCodeUnknownCommand, RefCommandType: CommandTypeWhoAmI, Message: "error"},
+		SendMessageCommand{RequestID: 4, Recipients: []uint64{1}, Body: make([]byte, 70000)},
+	}
+
+	for _, command := range commands {
+		var convertedBytes []byte
+		switch v := command.(type) {
+		case WhoAmICommand:
+			convertedBytes = v.ToByteArray()
+		case ListClientsCommand:
+			convertedBytes = v.ToByteArray(0)
+		case ErrorCommand:
+			convertedBytes = v.ToByteArray()
+		case SendMessageCommand:
+			convertedBytes = v.ToByteArray()
+		}
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestPingAndPongCommandsShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	ping := PingCommand{}
+	pong := PongCommand{}
+	convertedBytes := append(ping.ToByteArray(), pong.ToByteArray()...)
+	assert.Equal(t, []byte{byte(CommandTypePing), 3, 0, byte(CommandTypePong), 3, 0}, convertedBytes)
+
+	var commands []interface{}
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err := protocolParser.ParseStreamedData(convertedBytes[i])
+		assert.Nil(t, err)
+		if resp != nil {
+			commands = append(commands, resp)
+		}
+	}
+	assert.Equal(t, []interface{}{ping, pong}, commands)
+}
+
+func TestGoAwayCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := GoAwayCommand{Reason: "server is shutting down"}
+	convertedBytes := command.ToByteArray()
+	assert.Equal(t, byte(CommandTypeGoAway), convertedBytes[0])
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestRoomCommandsShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []interface{}{
+		JoinRoomCommand{RequestID: 1, Room: "general"},
+		LeaveRoomCommand{RequestID: 2, Room: "general"},
+		ListRoomsCommand{RequestID: 3, Rooms: []string{"general", "random"}},
+		ListRoomsCommand{RequestID: 4},
+		RoomMessageCommand{Room: "general", SenderID: 5, Body: []byte("hello")},
+	}
+
+	for _, command := range commands {
+		var convertedBytes []byte
+		switch v := command.(type) {
+		case JoinRoomCommand:
+			convertedBytes = v.ToByteArray()
+		case LeaveRoomCommand:
+			convertedBytes = v.ToByteArray()
+		case ListRoomsCommand:
+			convertedBytes = v.ToByteArray()
+		case RoomMessageCommand:
+			convertedBytes = v.ToByteArray()
+		}
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestRoomCommandsWithInvalidRoomShouldBeMalformed(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	join := JoinRoomCommand{Room: ""}
+	message := RoomMessageCommand{Room: string(make([]byte, MaxRoomNameLength+1))}
+	for _, convertedBytes := range [][]byte{join.ToByteArray(), message.ToByteArray()} {
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			_, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, FrameError{CommandType: CommandType(convertedBytes[0]), Err: ErrMalformedCommand}, err)
+	}
+
+	assert.Equal(t, ErrInvalidRoomName, ValidateRoomName(""))
+	assert.Nil(t, ValidateRoomName("general"))
+}
+
+func TestBroadcastCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := BroadcastCommand{RequestID: 1, Body: []byte("hello")}
+	convertedBytes := command.ToByteArray()
+	assert.Equal(t, byte(CommandTypeBroadcast)|FrameFlagRequestID, convertedBytes[0])
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestNickCommandsShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []interface{}{
+		SetNickCommand{RequestID: 1, Nick: "alice"},
+		LookupCommand{RequestID: 2, Nick: "alice"},
+		LookupCommand{RequestID: 3, ClientID: 4, Nick: "alice"},
+		NickChangedCommand{ClientID: 4, Nick: "alice"},
+		NickChangedCommand{ClientID: 4, OldNick: "alice", Nick: "bob"},
+		ListUsersCommand{RequestID: 5, Users: []User{{ID: 4, Nick: "alice"}, {ID: 6}}},
+		ListUsersCommand{RequestID: 6},
+		MessageFromClient{SenderID: 4, SenderNick: "alice", Body: []byte("hello")},
+	}
+
+	for _, command := range commands {
+		var convertedBytes []byte
+		switch v := command.(type) {
+		case SetNickCommand:
+			convertedBytes = v.ToByteArray()
+		case LookupCommand:
+			convertedBytes = v.ToByteArray()
+		case NickChangedCommand:
+			convertedBytes = v.ToByteArray()
+		case ListUsersCommand:
+			convertedBytes = v.ToByteArray()
+		case MessageFromClient:
+			convertedBytes = v.ToByteArray()
+		}
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestMessageFromClientWithoutNickShouldUseTheOldCommandType(t *testing.T) {
+	withoutNick := MessageFromClient{SenderID: 4, Body: []byte("hello")}
+	withNick := MessageFromClient{SenderID: 4, SenderNick: "alice", Body: []byte("hello")}
+
+	assert.Equal(t, byte(CommandTypeMessageFromClient), withoutNick.ToByteArray()[0])
+	assert.Equal(t, byte(CommandTypeMessageFromClientWithNick), withNick.ToByteArray()[0])
+}
+
+func TestValidateNickShouldRejectSpacesAndControlCharacters(t *testing.T) {
+	assert.Nil(t, ValidateNick("alice"))
+	assert.Nil(t, ValidateNick("ömer_42"))
+
+	for _, nick := range []string{"", "al ice", "alice\n", "\x00", string([]byte{0xff}), string(make([]byte, MaxNickLength+1))} {
+		assert.Equal(t, ErrInvalidNick, ValidateNick(nick), nick)
+	}
+}
+
+func TestPresenceCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	for _, command := range []PresenceCommand{{Event: PresenceJoined, ClientID: 1}, {Event: PresenceLeft, ClientID: 2}} {
+		convertedBytes := command.ToByteArray()
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestSendResultCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []SendResultCommand{
+		{RequestID: 1, MessageID: 2, Delivered: []uint64{3, 4}, Failed: []uint64{5}},
+		{RequestID: 2, MessageID: 3},
+	}
+
+	for _, command := range commands {
+		convertedBytes := command.ToByteArray()
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestSendToNickCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := SendToNickCommand{RequestID: 1, Nick: "alice", Body: []byte("hello")}
+	convertedBytes := command.ToByteArray()
+
+	var resp interface{}
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, command, resp)
+	assert.Nil(t, err)
+}
+
+func TestHistoryCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []HistoryCommand{
+		{RequestID: 1, Query: HistoryQuery{Peer: 2, Before: 10, Limit: 5}},
+		{RequestID: 2, Query: HistoryQuery{Room: "general"}, Next: 3, Messages: []HistoryMessage{
+			{ID: 5, Time: time.Unix(0, 1500), SenderID: 1, Recipients: []uint64{2, 3}, Room: "general", Body: []byte("hello")},
+			{ID: 4, Time: time.Unix(0, 1000), SenderID: 2, Recipients: []uint64{1}, Body: []byte("hi")},
+		}},
+	}
+
+	for _, command := range commands {
+		convertedBytes := command.ToByteArray()
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestHistoryCommandWithMissingMessageShouldBeMalformed(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := HistoryCommand{Messages: []HistoryMessage{{ID: 1, Time: time.Unix(0, 0), Body: []byte("hello")}}}
+	convertedBytes := command.ToByteArray()
+	// drop the message but keep the message count
+	convertedBytes = encodeFrame(CommandTypeHistory, 7, convertedBytes[3:3+8+2+20])
+
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		_, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, FrameError{RequestID: 7, CommandType: CommandTypeHistory, Err: ErrMalformedCommand}, err)
+}
+
+func TestAuthCommandShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []AuthCommand{
+		{RequestID: 1, Scheme: AuthSchemePassword, Username: "alice", Secret: "secret"},
+		{Scheme: AuthSchemeToken, Secret: "token"},
+		{RequestID: 1, Scheme: AuthSchemePassword, Identity: "alice"},
+	}
+
+	for _, command := range commands {
+		convertedBytes := command.ToByteArray()
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
@@ -3,10 +3,29 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
 	UnknownCommand = errors.New("Unknown command")
+	// ErrFrameTooLarge is returned when a frame exceeds the configured max frame size
+	ErrFrameTooLarge = errors.New("Frame too large")
+	// ErrMalformedCommand is returned when a frame payload does not match its command type
+	ErrMalformedCommand = errors.New("Malformed command")
+	// ErrHandshakeRequired is returned when a peer sends commands before the handshake is done
+	ErrHandshakeRequired = errors.New("Handshake required")
+	// ErrUnsupportedVersion is returned when the peers have no protocol version in common
+	ErrUnsupportedVersion = errors.New("Unsupported protocol version")
+	// ErrInvalidRoomName is returned for empty room names and the ones longer than MaxRoomNameLength
+	ErrInvalidRoomName = errors.New("Invalid room name")
+	// ErrInvalidNick is returned for empty nicks, the ones longer than MaxNickLength and the ones with spaces or control characters
+	ErrInvalidNick = errors.New("Invalid nick")
+	// ErrAuthenticationRequired is returned when a client sends commands before authenticating to a server which requires it
+	ErrAuthenticationRequired = errors.New("Authentication required")
 )
 
 // CommandType is an enumator for command types
@@ -21,67 +40,562 @@ const (
 	CommandTypeSendMessage CommandType = 3
 	// CommandTypeMessageFromClient Command
 	CommandTypeMessageFromClient CommandType = 4
+	// CommandTypeHello Command
+	CommandTypeHello CommandType = 5
+	// CommandTypeWelcome Command
+	CommandTypeWelcome CommandType = 6
+	// CommandTypeError Command
+	CommandTypeError CommandType = 7
+	// CommandTypePing Command
+	CommandTypePing CommandType = 8
+	// CommandTypePong Command
+	CommandTypePong CommandType = 9
+	// CommandTypeGoAway Command
+	CommandTypeGoAway CommandType = 10
+	// CommandTypeJoinRoom Command
+	CommandTypeJoinRoom CommandType = 11
+	// CommandTypeLeaveRoom Command
+	CommandTypeLeaveRoom CommandType = 12
+	// CommandTypeListRooms Command
+	CommandTypeListRooms CommandType = 13
+	// CommandTypeRoomMessage Command
+	CommandTypeRoomMessage CommandType = 14
+	// CommandTypeBroadcast Command
+	CommandTypeBroadcast CommandType = 15
+	// CommandTypeSubscribe Command
+	CommandTypeSubscribe CommandType = 16
+	// CommandTypeUnsubscribe Command
+	CommandTypeUnsubscribe CommandType = 17
+	// CommandTypePublish Command
+	CommandTypePublish CommandType = 18
+	// CommandTypeTopicMessage Command
+	CommandTypeTopicMessage CommandType = 19
+	// CommandTypeSetNick Command
+	CommandTypeSetNick CommandType = 20
+	// CommandTypeLookup Command
+	CommandTypeLookup CommandType = 21
+	// CommandTypeNickChanged Command
+	CommandTypeNickChanged CommandType = 22
+	// CommandTypeListUsers Command
+	CommandTypeListUsers CommandType = 23
+	// CommandTypeMessageFromClientWithNick Command, a MessageFromClient carrying the nick of the sender
+	CommandTypeMessageFromClientWithNick CommandType = 24
+	// CommandTypePresence Command
+	CommandTypePresence CommandType = 25
+	// CommandTypeSendResult Command
+	CommandTypeSendResult CommandType = 26
+	// CommandTypeSendToNick Command
+	CommandTypeSendToNick CommandType = 27
+	// CommandTypeHistory Command
+	CommandTypeHistory CommandType = 28
+	// CommandTypeAuth Command
+	CommandTypeAuth CommandType = 29
 	// CommandTypeUnknown Command
 	CommandTypeUnknown CommandType = 0
 )
 
 const (
-	CommandLengthType             = 1
-	CommandLengthMessageLength    = 2
-	CommandLengthRecipientsLength = 2
-	CommandLengthClient           = 8
+	CommandLengthType                  = 1
+	CommandLengthMessageLength         = 2
+	CommandLengthExtendedMessageLength = 4
+	CommandLengthRecipientsLength      = 2
+	CommandLengthClient                = 8
+	CommandLengthVersion               = 2
+	CommandLengthCapabilities          = 4
+	CommandLengthErrorCode             = 2
+	CommandLengthRequestID             = 4
+	CommandLengthStringLength          = 2
 )
 
+// ErrorCode tells why the server rejected a command
+type ErrorCode uint16
+
+const (
+	// ErrorCodeUnknownCommand means the server does not know the command
+	ErrorCodeUnknownCommand ErrorCode = 1
+	// ErrorCodeMalformedCommand means the command could not be parsed
+	ErrorCodeMalformedCommand ErrorCode = 2
+	// ErrorCodeFrameTooLarge means the frame exceeds the max frame size of the server
+	ErrorCodeFrameTooLarge ErrorCode = 3
+	// ErrorCodeHandshakeRequired means a command was sent before the handshake
+	ErrorCodeHandshakeRequired ErrorCode = 4
+	// ErrorCodeUnsupportedVersion means the server does not speak the protocol version of the client
+	ErrorCodeUnsupportedVersion ErrorCode = 5
+	// ErrorCodeUnknownRecipient means some recipients of the message are not connected
+	ErrorCodeUnknownRecipient ErrorCode = 6
+	// ErrorCodeSlowConsumer means the client is disconnected since it does not read its messages fast enough
+	ErrorCodeSlowConsumer ErrorCode = 7
+	// ErrorCodeNotInRoom means the client is not a member of the room
+	ErrorCodeNotInRoom ErrorCode = 8
+	// ErrorCodeNotSubscribed means the client is not subscribed to the topic pattern
+	ErrorCodeNotSubscribed ErrorCode = 9
+	// ErrorCodeNickTaken means another client already uses the nick
+	ErrorCodeNickTaken ErrorCode = 10
+	// ErrorCodeNotFound means no connected client has the looked up nick or id
+	ErrorCodeNotFound ErrorCode = 11
+	// ErrorCodeNotDelivered means the recipient is offline and the message cannot be kept in its mailbox
+	ErrorCodeNotDelivered ErrorCode = 12
+	// ErrorCodeHistoryUnavailable means the server does not keep a history or cannot read it
+	ErrorCodeHistoryUnavailable ErrorCode = 13
+	// ErrorCodeAuthenticationRequired means a command was sent before authenticating
+	ErrorCodeAuthenticationRequired ErrorCode = 14
+	// ErrorCodeAuthenticationFailed means the credentials are not accepted, or the identity is already connected
+	ErrorCodeAuthenticationFailed ErrorCode = 15
+	// ErrorCodeNotAllowed means the client is not allowed to run the command
+	ErrorCodeNotAllowed ErrorCode = 16
+)
+
+const (
+	// ProtocolVersion is the latest protocol version implemented by this package
+	ProtocolVersion uint16 = 1
+	// MinProtocolVersion is the oldest protocol version still accepted
+	MinProtocolVersion uint16 = 1
+)
+
+// Capability is a bitmask of optional protocol features a peer supports
+type Capability uint32
+
+const (
+	// CapabilityExtendedFrames means the peer can read frames with 4 byte message length
+	CapabilityExtendedFrames Capability = 1 << 0
+	// CapabilityHeartbeat means the peer answers PingCommand with PongCommand
+	CapabilityHeartbeat Capability = 1 << 1
+	// CapabilityNicknames means the peer reads the nick of the sender in messages and the nick change notifications
+	CapabilityNicknames Capability = 1 << 2
+	// CapabilityPresence means the peer wants PresenceCommand when the other clients connect and disconnect
+	CapabilityPresence Capability = 1 << 3
+)
+
+// SupportedCapabilities are all the capabilities implemented by this package
+const SupportedCapabilities = CapabilityExtendedFrames | CapabilityHeartbeat | CapabilityNicknames | CapabilityPresence
+
+// AuthScheme tells how a client proves who it is in AuthCommand
+type AuthScheme uint8
+
+const (
+	// AuthSchemeToken authenticates with a token in the secret, the username is not used
+	AuthSchemeToken AuthScheme = 1
+	// AuthSchemePassword authenticates with a username and the password in the secret
+	AuthSchemePassword AuthScheme = 2
+)
+
+// PresenceEvent tells what happened to the client of a PresenceCommand
+type PresenceEvent uint8
+
+const (
+	// PresenceJoined means the client connected
+	PresenceJoined PresenceEvent = 1
+	// PresenceLeft means the client disconnected
+	PresenceLeft PresenceEvent = 2
+)
+
+const (
+	// FrameFlagExtended is set on the command type byte of frames with a 4 byte message length
+	FrameFlagExtended = 0x80
+	// FrameFlagRequestID is set on the command type byte of frames with a 4 byte request id after the message length
+	FrameFlagRequestID = 0x40
+	// frameFlags are all the flags which can be set on the command type byte
+	frameFlags = FrameFlagExtended | FrameFlagRequestID
+	// DefaultMaxFrameSize is the max frame size used when none is configured
+	DefaultMaxFrameSize = 16 * 1024 * 1024
+	// MaxRoomNameLength is the longest room name in bytes
+	MaxRoomNameLength = 255
+	// MaxNickLength is the longest nick in bytes
+	MaxNickLength = 32
+	// MaxHistoryLimit is the largest page of history the server returns
+	MaxHistoryLimit = 100
+)
+
+// ValidateRoomName returns ErrInvalidRoomName if the room name cannot be used
+func ValidateRoomName(room string) error {
+	if room == "" || len(room) > MaxRoomNameLength {
+		return ErrInvalidRoomName
+	}
+	return nil
+}
+
+// ValidateNick returns ErrInvalidNick if the nick cannot be used
+func ValidateNick(nick string) error {
+	if nick == "" || len(nick) > MaxNickLength {
+		return ErrInvalidNick
+	}
+	for _, r := range nick {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == utf8.RuneError {
+			return ErrInvalidNick
+		}
+	}
+	return nil
+}
+
+// ICorrelatedCommand is implemented by the commands which can carry the id of the request they belong to
+type ICorrelatedCommand interface {
+	CorrelationID() uint32
+}
+
 // QueryCommand is used to send query to server
 type QueryCommand struct {
+	RequestID uint32
 }
 
 // WhoAmICommand is used for getting client id
 type WhoAmICommand struct {
-	ClientID uint64
+	RequestID uint32
+	ClientID  uint64
 }
 
 // ListClientsCommand is used for getting all connected clients
 type ListClientsCommand struct {
+	RequestID        uint32
 	ConnectedClients []uint64
 }
 
 // SendMessageCommand is used for sending message to selected clients
 type SendMessageCommand struct {
+	RequestID  uint32
 	Recipients []uint64
 	Body       []byte
 }
 
-// MessageFromClient is used for getting sent message to client
+// MessageFromClient is used for getting sent message to client,
+// SenderNick is only set if the sender has a nick and the recipient supports CapabilityNicknames
 type MessageFromClient struct {
+	SenderID   uint64
+	SenderNick string
+	Body       []byte
+}
+
+// HelloCommand is sent by the client right after connecting to start the handshake
+type HelloCommand struct {
+	Version      uint16
+	Capabilities Capability
+}
+
+// WelcomeCommand is the answer of the server to HelloCommand with the negotiated version and capabilities
+type WelcomeCommand struct {
+	Version      uint16
+	Capabilities Capability
+}
+
+// ErrorCommand is sent by the server when it rejects a command of the client,
+// RequestID is the request id of the rejected command if it had one
+type ErrorCommand struct {
+	RequestID      uint32
+	Code           ErrorCode
+	RefCommandType CommandType
+	Message        string
+}
+
+// PingCommand is sent by both sides to check the connection is alive
+type PingCommand struct{}
+
+// PongCommand is the answer to PingCommand
+type PongCommand struct{}
+
+// GoAwayCommand is sent by the server before it shuts down, nothing comes after it on the connection
+type GoAwayCommand struct {
+	Reason string
+}
+
+// JoinRoomCommand is used for joining a room, the server answers with the same command
+type JoinRoomCommand struct {
+	RequestID uint32
+	Room      string
+}
+
+// LeaveRoomCommand is used for leaving a room, the server answers with the same command
+type LeaveRoomCommand struct {
+	RequestID uint32
+	Room      string
+}
+
+// ListRoomsCommand is used for getting the rooms which have members
+type ListRoomsCommand struct {
+	RequestID uint32
+	Rooms     []string
+}
+
+// RoomMessageCommand is used for sending a message to the members of a room,
+// SenderID is only set by the server when it passes the message to the members
+type RoomMessageCommand struct {
+	RequestID uint32
+	Room      string
+	SenderID  uint64
+	Body      []byte
+}
+
+// BroadcastCommand is used for sending a message to all the other connected clients,
+// they get it as MessageFromClient
+type BroadcastCommand struct {
+	RequestID uint32
+	Body      []byte
+}
+
+// SubscribeCommand is used for subscribing to the topics matching the pattern, the server answers with the same command
+type SubscribeCommand struct {
+	RequestID uint32
+	Pattern   string
+}
+
+// UnsubscribeCommand is used for removing a subscription, the server answers with the same command
+type UnsubscribeCommand struct {
+	RequestID uint32
+	Pattern   string
+}
+
+// PublishCommand is used for sending a message to the subscribers of a topic
+type PublishCommand struct {
+	RequestID uint32
+	Topic     string
+	Body      []byte
+}
+
+// TopicMessageCommand is sent by the server to the clients subscribed to the topic of a published message
+type TopicMessageCommand struct {
+	Topic    string
 	SenderID uint64
 	Body     []byte
 }
 
-// ToByteArray Converts WhoAmICommand to bytes
-func (t *WhoAmICommand) ToByteArray() []byte {
-	dataBytes := []byte{}
+// SetNickCommand is used for setting the nick of the client, the server answers with the same command
+type SetNickCommand struct {
+	RequestID uint32
+	Nick      string
+}
 
-	clientIDBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(clientIDBytes, t.ClientID)
-	dataBytes = append(dataBytes, clientIDBytes...)
+// LookupCommand is used for finding a client by nick or by id, only one of them is set in the query.
+// The server answers with the same command with both of them set.
+type LookupCommand struct {
+	RequestID uint32
+	ClientID  uint64
+	Nick      string
+}
 
-	// calculate command length (commandType + messageLength + clientID)
-	messageLength := CommandLengthType + CommandLengthMessageLength + 8
+// NickChangedCommand is sent by the server to the clients supporting CapabilityNicknames when a client changes its nick,
+// OldNick is empty if the client had no nick
+type NickChangedCommand struct {
+	ClientID uint64
+	OldNick  string
+	Nick     string
+}
 
-	// first byte is for command type
-	command := []byte{uint8(CommandTypeWhoAmI)}
+// PresenceCommand is sent by the server to the clients supporting CapabilityPresence when another client connects or disconnects
+type PresenceCommand struct {
+	Event    PresenceEvent
+	ClientID uint64
+}
 
-	// 2nd and 3rd bytes for messageLength
-	messageLengthBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(messageLengthBytes, uint16(messageLength))
-	command = append(command, messageLengthBytes...)
+// User is a connected client with its nick, Nick is empty if the client has not set one
+type User struct {
+	ID   uint64
+	Nick string
+}
 
-	// rest is data
-	if dataBytes != nil {
-		command = append(command, dataBytes...)
-	}
-	return command
+// ListUsersCommand is used for getting the other connected clients with their nicks
+type ListUsersCommand struct {
+	RequestID uint32
+	Users     []User
+}
+
+// SendResultCommand is the answer of the server to a SendMessageCommand with a request id. MessageID is the id the
+// server gave to the message, Delivered are the recipients the message is queued for and Failed are the unknown
+// recipients and the ones the message could not be queued for.
+type SendResultCommand struct {
+	RequestID uint32
+	MessageID uint64
+	Delivered []uint64
+	Failed    []uint64
+}
+
+// SendToNickCommand is used for sending a message to the client with the nick. If nobody has the nick,
+// the server keeps the message in the mailbox of the nick until a client takes the nick.
+type SendToNickCommand struct {
+	RequestID uint32
+	Nick      string
+	Body      []byte
+}
+
+// HistoryMessage is a message kept in the history of the server. ID is the position of the message in the history,
+// later messages have bigger ids. Room is empty for the messages sent to the clients directly.
+type HistoryMessage struct {
+	ID         uint64
+	Time       time.Time
+	SenderID   uint64
+	Recipients []uint64
+	Room       string
+	Body       []byte
+}
+
+// HistoryQuery selects the messages of a HistoryCommand. Without a peer or room it selects all the direct messages
+// the client sent or received, Peer selects the ones exchanged with the connected client of that id, or its identity,
+// and Room the ones sent to the room.
+// The direct messages of an authenticated client are the ones of its identity, a client without identity only sees
+// the ones of its connection.
+// Before is the cursor of the page, only the messages with smaller ids are returned, zero means the latest messages.
+// Limit is the page size, zero or anything above MaxHistoryLimit means MaxHistoryLimit.
+type HistoryQuery struct {
+	Peer   uint64
+	Room   string
+	Before uint64
+	Limit  uint16
+}
+
+// HistoryCommand is used for scrolling back the history, the server answers with the messages matching the query
+// newest first. Next is the cursor of the older messages, it is zero if there are none.
+type HistoryCommand struct {
+	RequestID uint32
+	Query     HistoryQuery
+	Messages  []HistoryMessage
+	Next      uint64
+}
+
+// AuthCommand is used for authenticating after the handshake to a server which requires it. The client sends
+// its credentials, the server answers with the identity it authenticated the client as and without the secret.
+type AuthCommand struct {
+	RequestID uint32
+	Scheme    AuthScheme
+	Username  string
+	Secret    string
+	Identity  string
+}
+
+// UnknownCommandError is returned by the parser for a complete frame of an unknown command type
+type UnknownCommandError struct {
+	RequestID   uint32
+	CommandType CommandType
+}
+
+// FrameError is returned by the parser for a frame it rejects with ErrFrameTooLarge or ErrMalformedCommand.
+// The frame is skipped so the stream stays usable, and the rejection can be answered to the request of the frame.
+type FrameError struct {
+	RequestID   uint32
+	CommandType CommandType
+	Err         error
+}
+
+// Error makes ErrorCommand usable as a go error
+func (t ErrorCommand) Error() string {
+	return fmt.Sprintf("server rejected command %d with code %d: %s", t.RefCommandType, t.Code, t.Message)
+}
+
+func (t UnknownCommandError) Error() string {
+	return fmt.Sprintf("Unknown command %d", t.CommandType)
+}
+
+func (t FrameError) Error() string {
+	return t.Err.Error()
+}
+
+// CorrelationID returns the request id of the query
+func (t QueryCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the response belongs to
+func (t WhoAmICommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the response belongs to
+func (t ListClientsCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message
+func (t SendMessageCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t JoinRoomCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t LeaveRoomCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the response belongs to
+func (t ListRoomsCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message
+func (t RoomMessageCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message
+func (t BroadcastCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t SubscribeCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t UnsubscribeCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message
+func (t PublishCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t SetNickCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the command belongs to
+func (t LookupCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id the response belongs to
+func (t ListUsersCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message the result belongs to
+func (t SendResultCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the message
+func (t SendToNickCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the query
+func (t HistoryCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the authentication
+func (t AuthCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// CorrelationID returns the request id of the rejected command
+func (t ErrorCommand) CorrelationID() uint32 {
+	return t.RequestID
+}
+
+// Has reports whether all the given capabilities are in the bitmask
+func (t Capability) Has(capability Capability) bool {
+	return t&capability == capability
+}
+
+// ToByteArray Converts WhoAmICommand to bytes
+func (t *WhoAmICommand) ToByteArray() []byte {
+	clientIDBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(clientIDBytes, t.ClientID)
+
+	return encodeFrame(CommandTypeWhoAmI, t.RequestID, clientIDBytes)
 }
 
 // ToByteArray Converts ListClientsCommand to bytes
@@ -96,21 +610,7 @@ func (t *ListClientsCommand) ToByteArray(clientID uint64) []byte {
 		}
 	}
 
-	// calculate command length (commandType + messageLength + (clientCount-1)*8)
-	messageLength := CommandLengthType + CommandLengthMessageLength + (8 * (len(t.ConnectedClients) - 1))
-	// first byte is for command type
-	command := []byte{uint8(CommandTypeListClients)}
-
-	// 2nd and 3rd bytes for messageLength
-	messageLengthBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(messageLengthBytes, uint16(messageLength))
-	command = append(command, messageLengthBytes...)
-
-	// rest is data
-	if dataBytes != nil {
-		command = append(command, dataBytes...)
-	}
-	return command
+	return encodeFrame(CommandTypeListClients, t.RequestID, dataBytes)
 }
 
 // ToByteArray Converts MessageFromClient to bytes
@@ -120,26 +620,18 @@ func (t *MessageFromClient) ToByteArray() []byte {
 	senderBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(senderBytes, t.SenderID)
 
-	bodyBytes := t.Body
-
 	dataBytes = append(dataBytes, senderBytes...)
-	dataBytes = append(dataBytes, bodyBytes...)
 
-	// calculate command length (commandType + messageLength + senderid + messagebody)
-	messageLength := CommandLengthType + CommandLengthMessageLength + CommandLengthClient + len(bodyBytes)
-	// first byte is for command type
-	command := []byte{uint8(CommandTypeMessageFromClient)}
+	// the nick has its own command type, so the clients not knowing about nicks can still read the messages without it
+	if t.SenderNick != "" {
+		dataBytes = append(dataBytes, encodeString(t.SenderNick)...)
+		dataBytes = append(dataBytes, t.Body...)
+		return encodeFrame(CommandTypeMessageFromClientWithNick, 0, dataBytes)
+	}
 
-	// 2nd and 3rd bytes for messageLength
-	messageLengthBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(messageLengthBytes, uint16(messageLength))
-	command = append(command, messageLengthBytes...)
+	dataBytes = append(dataBytes, t.Body...)
 
-	// rest is data
-	if dataBytes != nil {
-		command = append(command, dataBytes...)
-	}
-	return command
+	return encodeFrame(CommandTypeMessageFromClient, 0, dataBytes)
 }
 
 // ToByteArray Converts SendMessageCommand to bytes
@@ -147,7 +639,7 @@ func (t *SendMessageCommand) ToByteArray() []byte {
 
 	dataBytes := []byte{}
 
-	// we have a special case here, 4th and 5th bytes for recipient length, send them as data
+	// we have a special case here, first 2 bytes of the data for recipient length
 	recipientLengthBytes := make([]byte, 2)
 	binary.LittleEndian.PutUint16(recipientLengthBytes, uint16(len(t.Recipients)))
 	dataBytes = append(dataBytes, recipientLengthBytes...)
@@ -162,26 +654,306 @@ func (t *SendMessageCommand) ToByteArray() []byte {
 	// and finally add the message body
 	dataBytes = append(dataBytes, t.Body...)
 
-	// calculate message length
-	// commandType + messageLength + recipientsLength + recipients + messageBody
-	messageLength := CommandLengthType + CommandLengthMessageLength + CommandLengthRecipientsLength + (len(t.Recipients) * 8) + len(t.Body)
-	// first byte is for command type
-	command := []byte{uint8(CommandTypeSendMessage)}
+	return encodeFrame(CommandTypeSendMessage, t.RequestID, dataBytes)
+}
 
-	// 2nd and 3rd bytes for messageLength
-	messageLengthBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(messageLengthBytes, uint16(messageLength))
-	command = append(command, messageLengthBytes...)
+// ToByteArray Converts HelloCommand to bytes
+func (t *HelloCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeHello, 0, encodeHandshake(t.Version, t.Capabilities))
+}
 
-	// rest is data
-	if dataBytes != nil {
-		command = append(command, dataBytes...)
+// ToByteArray Converts WelcomeCommand to bytes
+func (t *WelcomeCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeWelcome, 0, encodeHandshake(t.Version, t.Capabilities))
+}
+
+// ToByteArray Converts ErrorCommand to bytes
+func (t *ErrorCommand) ToByteArray() []byte {
+	// error code (2 bytes) + referenced command type (1 byte) + message
+	dataBytes := make([]byte, CommandLengthErrorCode+CommandLengthType)
+	binary.LittleEndian.PutUint16(dataBytes[0:2], uint16(t.Code))
+	dataBytes[2] = uint8(t.RefCommandType)
+	dataBytes = append(dataBytes, t.Message...)
+
+	return encodeFrame(CommandTypeError, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts PingCommand to bytes
+func (t *PingCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypePing, 0, nil)
+}
+
+// ToByteArray Converts PongCommand to bytes
+func (t *PongCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypePong, 0, nil)
+}
+
+// ToByteArray Converts GoAwayCommand to bytes
+func (t *GoAwayCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeGoAway, 0, []byte(t.Reason))
+}
+
+// ToByteArray Converts JoinRoomCommand to bytes
+func (t *JoinRoomCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeJoinRoom, t.RequestID, encodeString(t.Room))
+}
+
+// ToByteArray Converts LeaveRoomCommand to bytes
+func (t *LeaveRoomCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeLeaveRoom, t.RequestID, encodeString(t.Room))
+}
+
+// ToByteArray Converts ListRoomsCommand to bytes
+func (t *ListRoomsCommand) ToByteArray() []byte {
+	dataBytes := []byte{}
+	for i := 0; i < len(t.Rooms); i++ {
+		dataBytes = append(dataBytes, encodeString(t.Rooms[i])...)
 	}
-	return command
+
+	return encodeFrame(CommandTypeListRooms, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts RoomMessageCommand to bytes
+func (t *RoomMessageCommand) ToByteArray() []byte {
+	// room + sender (8 bytes) + body
+	dataBytes := encodeString(t.Room)
+
+	senderBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(senderBytes, t.SenderID)
+	dataBytes = append(dataBytes, senderBytes...)
+	dataBytes = append(dataBytes, t.Body...)
+
+	return encodeFrame(CommandTypeRoomMessage, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts BroadcastCommand to bytes
+func (t *BroadcastCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeBroadcast, t.RequestID, t.Body)
+}
+
+// ToByteArray Converts SubscribeCommand to bytes
+func (t *SubscribeCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeSubscribe, t.RequestID, encodeString(t.Pattern))
+}
+
+// ToByteArray Converts UnsubscribeCommand to bytes
+func (t *UnsubscribeCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeUnsubscribe, t.RequestID, encodeString(t.Pattern))
+}
+
+// ToByteArray Converts PublishCommand to bytes
+func (t *PublishCommand) ToByteArray() []byte {
+	// topic + body
+	dataBytes := encodeString(t.Topic)
+	dataBytes = append(dataBytes, t.Body...)
+
+	return encodeFrame(CommandTypePublish, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts TopicMessageCommand to bytes
+func (t *TopicMessageCommand) ToByteArray() []byte {
+	// topic + sender (8 bytes) + body
+	dataBytes := encodeString(t.Topic)
+
+	senderBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(senderBytes, t.SenderID)
+	dataBytes = append(dataBytes, senderBytes...)
+	dataBytes = append(dataBytes, t.Body...)
+
+	return encodeFrame(CommandTypeTopicMessage, 0, dataBytes)
+}
+
+// ToByteArray Converts SetNickCommand to bytes
+func (t *SetNickCommand) ToByteArray() []byte {
+	return encodeFrame(CommandTypeSetNick, t.RequestID, encodeString(t.Nick))
+}
+
+// ToByteArray Converts LookupCommand to bytes
+func (t *LookupCommand) ToByteArray() []byte {
+	// client id (8 bytes) + nick
+	dataBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(dataBytes, t.ClientID)
+	dataBytes = append(dataBytes, encodeString(t.Nick)...)
+
+	return encodeFrame(CommandTypeLookup, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts NickChangedCommand to bytes
+func (t *NickChangedCommand) ToByteArray() []byte {
+	// client id (8 bytes) + old nick + nick
+	dataBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(dataBytes, t.ClientID)
+	dataBytes = append(dataBytes, encodeString(t.OldNick)...)
+	dataBytes = append(dataBytes, encodeString(t.Nick)...)
+
+	return encodeFrame(CommandTypeNickChanged, 0, dataBytes)
+}
+
+// ToByteArray Converts PresenceCommand to bytes
+func (t *PresenceCommand) ToByteArray() []byte {
+	// event (1 byte) + client id (8 bytes)
+	dataBytes := make([]byte, 1+CommandLengthClient)
+	dataBytes[0] = uint8(t.Event)
+	binary.LittleEndian.PutUint64(dataBytes[1:], t.ClientID)
+
+	return encodeFrame(CommandTypePresence, 0, dataBytes)
+}
+
+// ToByteArray Converts ListUsersCommand to bytes
+func (t *ListUsersCommand) ToByteArray() []byte {
+	// client id (8 bytes) + nick for every user
+	dataBytes := []byte{}
+	for _, user := range t.Users {
+		idBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(idBytes, user.ID)
+		dataBytes = append(dataBytes, idBytes...)
+		dataBytes = append(dataBytes, encodeString(user.Nick)...)
+	}
+
+	return encodeFrame(CommandTypeListUsers, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts SendResultCommand to bytes
+func (t *SendResultCommand) ToByteArray() []byte {
+	// message id (8 bytes) + delivered ids + failed ids
+	dataBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(dataBytes, t.MessageID)
+	dataBytes = append(dataBytes, encodeIDs(t.Delivered)...)
+	dataBytes = append(dataBytes, encodeIDs(t.Failed)...)
+
+	return encodeFrame(CommandTypeSendResult, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts SendToNickCommand to bytes
+func (t *SendToNickCommand) ToByteArray() []byte {
+	// nick + body
+	dataBytes := encodeString(t.Nick)
+	dataBytes = append(dataBytes, t.Body...)
+
+	return encodeFrame(CommandTypeSendToNick, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts HistoryCommand to bytes
+func (t *HistoryCommand) ToByteArray() []byte {
+	// peer (8 bytes) + room + before (8 bytes) + limit (2 bytes) + next (8 bytes) + message count (2 bytes) + messages
+	dataBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(dataBytes, t.Query.Peer)
+	dataBytes = append(dataBytes, encodeString(t.Query.Room)...)
+
+	pagingBytes := make([]byte, 8+2+8+2)
+	binary.LittleEndian.PutUint64(pagingBytes[0:8], t.Query.Before)
+	binary.LittleEndian.PutUint16(pagingBytes[8:10], t.Query.Limit)
+	binary.LittleEndian.PutUint64(pagingBytes[10:18], t.Next)
+	binary.LittleEndian.PutUint16(pagingBytes[18:20], uint16(len(t.Messages)))
+	dataBytes = append(dataBytes, pagingBytes...)
+
+	for _, message := range t.Messages {
+		dataBytes = append(dataBytes, encodeHistoryMessage(message)...)
+	}
+
+	return encodeFrame(CommandTypeHistory, t.RequestID, dataBytes)
+}
+
+// ToByteArray Converts AuthCommand to bytes
+func (t *AuthCommand) ToByteArray() []byte {
+	// scheme (1 byte) + username + secret + identity
+	dataBytes := []byte{uint8(t.Scheme)}
+	dataBytes = append(dataBytes, encodeString(t.Username)...)
+	dataBytes = append(dataBytes, encodeString(t.Secret)...)
+	dataBytes = append(dataBytes, encodeString(t.Identity)...)
+
+	return encodeFrame(CommandTypeAuth, t.RequestID, dataBytes)
+}
+
+// encodeHistoryMessage writes id (8 bytes) + time in unix nanoseconds (8 bytes) + sender (8 bytes) + recipient ids
+// + room + body length (4 bytes) + body
+func encodeHistoryMessage(message HistoryMessage) []byte {
+	dataBytes := make([]byte, 8+8+CommandLengthClient)
+	binary.LittleEndian.PutUint64(dataBytes[0:8], message.ID)
+	binary.LittleEndian.PutUint64(dataBytes[8:16], uint64(message.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(dataBytes[16:24], message.SenderID)
+	dataBytes = append(dataBytes, encodeIDs(message.Recipients)...)
+	dataBytes = append(dataBytes, encodeString(message.Room)...)
+
+	bodyLengthBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bodyLengthBytes, uint32(len(message.Body)))
+	dataBytes = append(dataBytes, bodyLengthBytes...)
+	return append(dataBytes, message.Body...)
+}
+
+// encodeIDs writes the number of the ids (2 bytes) and the ids (8 bytes each)
+func encodeIDs(ids []uint64) []byte {
+	dataBytes := make([]byte, CommandLengthRecipientsLength+len(ids)*8)
+	binary.LittleEndian.PutUint16(dataBytes, uint16(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(dataBytes[CommandLengthRecipientsLength+i*8:], id)
+	}
+	return dataBytes
+}
+
+// encodeString writes the length of the string (2 bytes) and the string
+func encodeString(value string) []byte {
+	dataBytes := make([]byte, CommandLengthStringLength, CommandLengthStringLength+len(value))
+	binary.LittleEndian.PutUint16(dataBytes, uint16(len(value)))
+	return append(dataBytes, value...)
+}
+
+// encodeHandshake writes version (2 bytes) and capabilities (4 bytes) of a handshake command
+func encodeHandshake(version uint16, capabilities Capability) []byte {
+	dataBytes := make([]byte, CommandLengthVersion+CommandLengthCapabilities)
+	binary.LittleEndian.PutUint16(dataBytes[0:2], version)
+	binary.LittleEndian.PutUint32(dataBytes[2:6], uint32(capabilities))
+	return dataBytes
+}
+
+// encodeFrame prepends the frame header (commandType + messageLength + requestID) to the data.
+// The request id is only written if it is not zero. Frames which do not fit into the legacy
+// 2 byte message length are written in the extended format with a 4 byte message length.
+func encodeFrame(commandType CommandType, requestID uint32, dataBytes []byte) []byte {
+	flags := uint8(0)
+	requestIDBytes := []byte{}
+	if requestID != 0 {
+		flags = flags | FrameFlagRequestID
+		requestIDBytes = make([]byte, 4)
+		binary.LittleEndian.PutUint32(requestIDBytes, requestID)
+	}
+
+	messageLength := CommandLengthType + CommandLengthMessageLength + len(requestIDBytes) + len(dataBytes)
+
+	var command []byte
+	if messageLength <= math.MaxUint16 {
+		// first byte is for command type
+		command = []byte{uint8(commandType) | flags}
+
+		// 2nd and 3rd bytes for messageLength
+		messageLengthBytes := make([]byte, 2)
+		binary.LittleEndian.PutUint16(messageLengthBytes, uint16(messageLength))
+		command = append(command, messageLengthBytes...)
+	} else {
+		messageLength = CommandLengthType + CommandLengthExtendedMessageLength + len(requestIDBytes) + len(dataBytes)
+
+		// first byte is for command type with the extended flag
+		command = []byte{uint8(commandType) | flags | FrameFlagExtended}
+
+		// 2nd to 5th bytes for messageLength
+		messageLengthBytes := make([]byte, 4)
+		binary.LittleEndian.PutUint32(messageLengthBytes, uint32(messageLength))
+		command = append(command, messageLengthBytes...)
+	}
+
+	// then the request id if there is one
+	command = append(command, requestIDBytes...)
+
+	// rest is data
+	return append(command, dataBytes...)
 }
 
 // CreateQueryCommand Creates a query command for client to send to server
 func (t *QueryCommand) CreateQueryCommand(commandType CommandType) []byte {
+	if t.RequestID != 0 {
+		return encodeFrame(commandType, t.RequestID, nil)
+	}
+
 	// first byte is for command type
 	command := []byte{uint8(commandType)}
 	// 2nd and 3rd bytes for messageLength
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidTopic is returned for topics which cannot be published to
+	ErrInvalidTopic = errors.New("Invalid topic")
+	// ErrInvalidTopicPattern is returned for patterns which cannot be subscribed to
+	ErrInvalidTopicPattern = errors.New("Invalid topic pattern")
+)
+
+const (
+	// MaxTopicLength is the longest topic or topic pattern in bytes
+	MaxTopicLength = 255
+	// TopicSeparator separates the levels of a topic, like alerts.disk.full
+	TopicSeparator = "."
+	// TopicWildcard matches exactly one level of a topic in a pattern, alerts.* matches alerts.disk
+	TopicWildcard = "*"
+	// TopicWildcardRest matches one or more levels at the end of a pattern, alerts.> matches alerts.disk.full
+	TopicWildcardRest = ">"
+)
+
+// ValidateTopic returns ErrInvalidTopic if messages cannot be published to the topic.
+// A topic has non empty levels and no wildcards.
+func ValidateTopic(topic string) error {
+	if topic == "" || len(topic) > MaxTopicLength {
+		return ErrInvalidTopic
+	}
+
+	for _, level := range strings.Split(topic, TopicSeparator) {
+		if level == "" || level == TopicWildcard || level == TopicWildcardRest {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// ValidateTopicPattern returns ErrInvalidTopicPattern if the pattern cannot be subscribed to.
+// A pattern is a topic where any level can be TopicWildcard and the last one can be TopicWildcardRest.
+func ValidateTopicPattern(pattern string) error {
+	if pattern == "" || len(pattern) > MaxTopicLength {
+		return ErrInvalidTopicPattern
+	}
+
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		if level == "" || (level == TopicWildcardRest && i != len(levels)-1) {
+			return ErrInvalidTopicPattern
+		}
+	}
+	return nil
+}
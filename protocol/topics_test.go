@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopicShouldRejectWildcardsAndEmptyLevels(t *testing.T) {
+	assert.Nil(t, ValidateTopic("alerts"))
+	assert.Nil(t, ValidateTopic("alerts.disk.full"))
+
+	for _, topic := range []string{"", "alerts.", ".alerts", "alerts..disk", "alerts.*", "alerts.>", string(make([]byte, MaxTopicLength+1))} {
+		assert.Equal(t, ErrInvalidTopic, ValidateTopic(topic), topic)
+	}
+}
+
+func TestValidateTopicPatternShouldAllowWildcards(t *testing.T) {
+	for _, pattern := range []string{"alerts", "alerts.*", "*.disk.*", "alerts.>", ">"} {
+		assert.Nil(t, ValidateTopicPattern(pattern), pattern)
+	}
+
+	for _, pattern := range []string{"", "alerts.", "alerts..disk", "alerts.>.disk", string(make([]byte, MaxTopicLength+1))} {
+		assert.Equal(t, ErrInvalidTopicPattern, ValidateTopicPattern(pattern), pattern)
+	}
+}
+
+func TestTopicCommandsShouldBeProduced(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	commands := []interface{}{
+		SubscribeCommand{RequestID: 1, Pattern: "alerts.*"},
+		UnsubscribeCommand{RequestID: 2, Pattern: "alerts.>"},
+		PublishCommand{RequestID: 3, Topic: "alerts.disk", Body: []byte("full")},
+		TopicMessageCommand{Topic: "alerts.disk", SenderID: 4, Body: []byte("full")},
+	}
+
+	for _, command := range commands {
+		var convertedBytes []byte
+		switch v := command.(type) {
+		case SubscribeCommand:
+			convertedBytes = v.ToByteArray()
+		case UnsubscribeCommand:
+			convertedBytes = v.ToByteArray()
+		case PublishCommand:
+			convertedBytes = v.ToByteArray()
+		case TopicMessageCommand:
+			convertedBytes = v.ToByteArray()
+		}
+
+		var resp interface{}
+		var err error
+		for i := 0; i < len(convertedBytes); i++ {
+			resp, err = protocolParser.ParseStreamedData(convertedBytes[i])
+		}
+		assert.Equal(t, command, resp)
+		assert.Nil(t, err)
+	}
+}
+
+func TestPublishCommandToPatternShouldBeMalformed(t *testing.T) {
+	producer := ProtocolParserProducer{}
+	protocolParser := producer.Produce()
+
+	command := PublishCommand{Topic: "alerts.*", Body: []byte("full")}
+	convertedBytes := command.ToByteArray()
+
+	var err error
+	for i := 0; i < len(convertedBytes); i++ {
+		_, err = protocolParser.ParseStreamedData(convertedBytes[i])
+	}
+	assert.Equal(t, FrameError{CommandType: CommandTypePublish, Err: ErrMalformedCommand}, err)
+}
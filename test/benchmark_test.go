@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Applifier/golang-backend-assignment/datastream"
 	"github.com/Applifier/golang-backend-assignment/internal/client"
 	"github.com/Applifier/golang-backend-assignment/internal/server"
 	"github.com/Applifier/golang-backend-assignment/protocol"
@@ -13,17 +14,20 @@ import (
 )
 
 const clientCount = 100
-const benchmarkServerPort = 50000
+
+// benchmarkServerPort only names the server on the memory network of the benchmark
+const benchmarkServerPort = 2525
 
 func TestBenchmark(t *testing.T) {
-	srv := server.New()
+	transport := &datastream.MemoryDataStreamProducer{Network: datastream.NewMemoryNetwork()}
+	srv := server.New(server.WithDataStreamerProducer(transport))
 	serverAddr := net.TCPAddr{Port: benchmarkServerPort}
 	require.NoError(t, srv.Start(&serverAddr))
 
 	var clients []*client.Client
 	var clientChs []chan protocol.MessageFromClient
 	for i := 0; i < clientCount; i++ {
-		cli := client.New()
+		cli := client.New(client.WithDataStreamerProducer(transport))
 		require.NoError(t, cli.Connect(&serverAddr))
 		clientCh := make(chan protocol.MessageFromClient)
 		go cli.HandleIncomingMessages(clientCh)
@@ -45,7 +49,7 @@ func TestBenchmark(t *testing.T) {
 		payload := []byte("FOOBAR")
 		result := testing.Benchmark(func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				assert.NoError(b, clients[0].Broadcast(payload))
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
@@ -58,7 +62,7 @@ func TestBenchmark(t *testing.T) {
 		payload := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit. Duis sed est id mi blandit fringilla vulputate nec urna. Duis non porttitor arcu. Mauris ac ullamcorper turpis, ac tincidunt risus. In rutrum efficitur porttitor. Cras scelerisque eu mi ut tristique. Phasellus enim elit, pretium ut mi vel, semper interdum nisl. Duis gravida blandit risus, a semper ipsum lacinia quis. Nam eros purus, congue in metus id, volutpat dapibus velit. Cras ut dictum libero, non placerat quam. Vivamus sem justo, varius at magna sed, blandit consequat mi. Cras viverra, orci nec feugiat ullamcorper, mauris erat tincidunt nisi, nec rutrum neque est a libero. Nullam pharetra dolor at erat elementum convallis. Phasellus dictum fermentum odio non eleifend. Etiam scelerisque, neque a fringilla molestie, purus turpis posuere erat, ut pulvinar nisl nisl nec nisl. In pellentesque risus sem, id pretium eros gravida sit amet. In vel massa justo. Fusce euismod mattis massa. Fusce at nibh in est condimentum luctus. Integer a molestie arcu. Suspendisse aliquam venenatis nisl, sit amet aliquam ante convallis quis. Praesent nec ipsum lectus. Ut elementum pretium mollis. ")
 		result := testing.Benchmark(func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				assert.NoError(b, clients[0].Broadcast(payload))
 				for j := 1; j < clientCount; j++ {
 					<-clientChs[j]
 				}
@@ -1,37 +1,62 @@
 package test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Applifier/golang-backend-assignment/auth"
+	"github.com/Applifier/golang-backend-assignment/datastream"
 	"github.com/Applifier/golang-backend-assignment/internal/client"
 	"github.com/Applifier/golang-backend-assignment/internal/server"
+	"github.com/Applifier/golang-backend-assignment/mailbox"
 	"github.com/Applifier/golang-backend-assignment/protocol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
-const serverPort = 50000
+// serverPort only names the servers on their memory networks, every test has a network of its own
+const serverPort = 2525
+
+// localAddr lets the system pick a free port for the servers which need a real one, the tests read it back from the server
+var localAddr = net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 
 func TestIntegration(t *testing.T) {
-	srv := server.New()
+	transport := newMemoryTransport()
+	srv := server.New(server.WithDataStreamerProducer(transport), server.WithMessageStore(server.NewMemoryMessageStore()))
 
 	serverAddr := net.TCPAddr{Port: serverPort}
 	require.NoError(t, srv.Start(&serverAddr))
 	defer assertDoesNotError(t, srv.Stop)
 
 	// Create clients
-	client1 := createClientAndFetchID(t, 1)
+	client1 := createClientAndFetchID(t, transport, 1)
 	defer assertDoesNotError(t, client1.Close)
 	client1Ch := make(chan protocol.MessageFromClient)
 	defer close(client1Ch)
 
-	client2 := createClientAndFetchID(t, 2)
+	client2 := createClientAndFetchID(t, transport, 2)
 	defer assertDoesNotError(t, client2.Close)
 	client2Ch := make(chan protocol.MessageFromClient)
 	defer close(client2Ch)
 
-	client3 := createClientAndFetchID(t, 3)
+	client3 := createClientAndFetchID(t, transport, 3)
 	defer assertDoesNotError(t, client3.Close)
 	client3Ch := make(chan protocol.MessageFromClient)
 	defer close(client3Ch)
@@ -50,6 +75,26 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, []uint64{1, 2}, ids)
 	})
 
+	t.Run("Concurrent requests from one client get their own responses", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				id, err := client1.WhoAmI()
+				assert.NoError(t, err)
+				assert.Equal(t, uint64(1), id)
+			}()
+			go func() {
+				defer wg.Done()
+				ids, err := client1.ListClientIDs()
+				assert.NoError(t, err)
+				assert.Equal(t, []uint64{2, 3}, ids)
+			}()
+		}
+		wg.Wait()
+	})
+
 	t.Run("Send message from the first client to the two other clients", func(t *testing.T) {
 		body := []byte("Hello world!")
 		assert.Equal(t, nil, client1.SendMsg([]uint64{2, 3}, body))
@@ -64,14 +109,580 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, body, incomingMessage.Body)
 		assert.Equal(t, uint64(1), incomingMessage.SenderID)
 	})
+
+	t.Run("Broadcast from the third client to the two other clients", func(t *testing.T) {
+		body := []byte("Hello everyone!")
+		assert.NoError(t, client3.Broadcast(body))
+
+		go client1.HandleIncomingMessages(client1Ch)
+		incomingMessage := <-client1Ch
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, uint64(3), incomingMessage.SenderID)
+
+		incomingMessage = <-client2Ch
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, uint64(3), incomingMessage.SenderID)
+	})
+
+	t.Run("Send room message from the first client to the other member", func(t *testing.T) {
+		assert.NoError(t, client1.JoinRoom("general"))
+		assert.NoError(t, client2.JoinRoom("general"))
+
+		rooms, err := client3.ListRooms()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"general"}, rooms)
+
+		body := []byte("Hello room!")
+		assert.NoError(t, client1.SendRoomMsg("general", body))
+
+		client2RoomCh := make(chan protocol.RoomMessageCommand)
+		go client2.HandleIncomingRoomMessages(client2RoomCh)
+		incomingMessage := <-client2RoomCh
+		assert.Equal(t, "general", incomingMessage.Room)
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, uint64(1), incomingMessage.SenderID)
+
+		assert.NoError(t, client2.LeaveRoom("general"))
+		assert.Error(t, client2.LeaveRoom("general"))
+	})
+
+	t.Run("Publish from the first client to the subscribers of the topic", func(t *testing.T) {
+		assert.NoError(t, client2.Subscribe("alerts.*"))
+		assert.NoError(t, client3.Subscribe("metrics.*"))
+
+		body := []byte("disk is full")
+		assert.NoError(t, client1.Publish("alerts.disk", body))
+
+		client2TopicCh := make(chan protocol.TopicMessageCommand)
+		go client2.HandleIncomingTopicMessages(client2TopicCh)
+		incomingMessage := <-client2TopicCh
+		assert.Equal(t, "alerts.disk", incomingMessage.Topic)
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, uint64(1), incomingMessage.SenderID)
+
+		assert.NoError(t, client2.Unsubscribe("alerts.*"))
+		assert.Error(t, client2.Unsubscribe("alerts.*"))
+	})
+
+	t.Run("Set nicks and find the clients by them", func(t *testing.T) {
+		assert.NoError(t, client1.SetNick("alice"))
+		assert.Error(t, client2.SetNick("alice"))
+
+		id, err := client3.LookupNick("alice")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), id)
+
+		nick, err := client3.LookupID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", nick)
+
+		users, err := client3.ListUsers()
+		assert.NoError(t, err)
+		assert.Equal(t, []protocol.User{{ID: 1, Nick: "alice"}, {ID: 2}}, users)
+
+		body := []byte("Hello from alice!")
+		assert.NoError(t, client1.SendMsg([]uint64{2}, body))
+		incomingMessage := <-client2Ch
+		assert.Equal(t, body, incomingMessage.Body)
+		assert.Equal(t, uint64(1), incomingMessage.SenderID)
+		assert.Equal(t, "alice", incomingMessage.SenderNick)
+	})
+
+	t.Run("Clients asking for presence see the others connect and disconnect", func(t *testing.T) {
+		events := make(chan protocol.PresenceCommand, 2)
+		watcher := client.New(client.WithDataStreamerProducer(transport), client.WithPresenceHandler(func(event protocol.PresenceCommand) {
+			events <- event
+		}))
+		require.NoError(t, watcher.Connect(&serverAddr))
+		defer assertDoesNotError(t, watcher.Close)
+
+		visitor := createClientAndFetchID(t, transport, 5)
+		assert.Equal(t, protocol.PresenceCommand{Event: protocol.PresenceJoined, ClientID: 5}, <-events)
+
+		assert.NoError(t, visitor.Close())
+		assert.Equal(t, protocol.PresenceCommand{Event: protocol.PresenceLeft, ClientID: 5}, <-events)
+	})
+
+	t.Run("Send message and get which recipients it is delivered to", func(t *testing.T) {
+		body := []byte("Did you get it?")
+		result, err := client1.SendMsgWithResult([]uint64{3, 42}, body)
+		assert.NoError(t, err)
+		assert.NotZero(t, result.MessageID)
+		assert.Equal(t, []uint64{3}, result.Delivered)
+		assert.Equal(t, []uint64{42}, result.Failed)
+
+		incomingMessage := <-client3Ch
+		assert.Equal(t, body, incomingMessage.Body)
+	})
+
+	t.Run("Scroll back the messages exchanged with the first client", func(t *testing.T) {
+		query := protocol.HistoryQuery{Peer: 1, Limit: 2}
+		messages, next, err := client3.History(query)
+		assert.NoError(t, err)
+		require.Len(t, messages, 2)
+		assert.Equal(t, []byte("Did you get it?"), messages[0].Body)
+		assert.Equal(t, []byte("Hello everyone!"), messages[1].Body)
+		assert.Equal(t, uint64(3), messages[1].SenderID)
+		assert.NotZero(t, next)
+
+		query.Before = next
+		messages, next, err = client3.History(query)
+		assert.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, []byte("Hello world!"), messages[0].Body)
+		assert.Equal(t, []uint64{2, 3}, messages[0].Recipients)
+		assert.Zero(t, next)
+	})
+}
+
+func TestIntegrationHistoryAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+	authenticator := auth.NewTokenAuthenticator(map[string]string{"alice-token": "alice", "bob-token": "bob", "carol-token": "carol"})
+
+	// run starts a server on the history file, sends what the test wants and stops the server
+	run := func(send func(transport datastream.IDataStreamerProducer), options ...server.Option) {
+		store, err := server.NewFileMessageStore(path)
+		require.NoError(t, err)
+		defer assertDoesNotError(t, store.Close)
+
+		transport := newMemoryTransport()
+		srv := server.New(append(options, server.WithDataStreamerProducer(transport), server.WithMessageStore(store))...)
+		serverAddr := net.TCPAddr{Port: serverPort}
+		require.NoError(t, srv.Start(&serverAddr))
+		defer assertDoesNotError(t, srv.Stop)
+		send(transport)
+	}
+	connect := func(transport datastream.IDataStreamerProducer, options ...client.Option) *client.Client {
+		cli := client.New(append(options, client.WithDataStreamerProducer(transport))...)
+		require.NoError(t, cli.Connect(&net.TCPAddr{Port: serverPort}))
+		go cli.HandleIncomingMessages(make(chan protocol.MessageFromClient, 1))
+		return cli
+	}
+
+	run(func(transport datastream.IDataStreamerProducer) {
+		first := connect(transport)
+		defer assertDoesNotError(t, first.Close)
+		second := connect(transport)
+		defer assertDoesNotError(t, second.Close)
+		require.NoError(t, first.SendMsg([]uint64{2}, []byte("secret for 2")))
+	})
+
+	// the ids start from one again, the new client 2 does not see the messages of the one before
+	run(func(transport datastream.IDataStreamerProducer) {
+		first := connect(transport)
+		defer assertDoesNotError(t, first.Close)
+		second := connect(transport)
+		defer assertDoesNotError(t, second.Close)
+
+		id, err := second.WhoAmI()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), id)
+		messages, _, err := second.History(protocol.HistoryQuery{})
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	})
+
+	// authenticated identities get their history back after a restart
+	run(func(transport datastream.IDataStreamerProducer) {
+		alice := connect(transport, client.WithToken("alice-token"))
+		defer assertDoesNotError(t, alice.Close)
+		bob := connect(transport, client.WithToken("bob-token"))
+		defer assertDoesNotError(t, bob.Close)
+		require.NoError(t, alice.SendMsgToNick("bob", []byte("secret for bob")))
+	}, server.WithAuthenticator(authenticator), server.WithIdentityNicks())
+
+	// carol gets the id alice had, the messages with the peer of that id are still the ones of alice
+	run(func(transport datastream.IDataStreamerProducer) {
+		carol := connect(transport, client.WithToken("carol-token"))
+		defer assertDoesNotError(t, carol.Close)
+		bob := connect(transport, client.WithToken("bob-token"))
+		defer assertDoesNotError(t, bob.Close)
+		messages, _, err := bob.History(protocol.HistoryQuery{})
+		assert.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, []byte("secret for bob"), messages[0].Body)
+
+		carolID, err := carol.WhoAmI()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), carolID)
+		messages, _, err = bob.History(protocol.HistoryQuery{Peer: carolID})
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+
+		alice := connect(transport, client.WithToken("alice-token"))
+		defer assertDoesNotError(t, alice.Close)
+		aliceID, err := alice.WhoAmI()
+		require.NoError(t, err)
+		messages, _, err = bob.History(protocol.HistoryQuery{Peer: aliceID})
+		assert.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, []byte("secret for bob"), messages[0].Body)
+
+		// the peer of an id nobody has cannot be told
+		_, _, err = bob.History(protocol.HistoryQuery{Peer: 42})
+		rejection, ok := err.(protocol.ErrorCommand)
+		require.True(t, ok, "unexpected error %v", err)
+		assert.Equal(t, protocol.ErrorCodeUnknownRecipient, rejection.Code)
+	}, server.WithAuthenticator(authenticator), server.WithIdentityNicks())
+}
+
+func TestIntegrationRejectedRequest(t *testing.T) {
+	transport := newMemoryTransport()
+	srv := server.New(server.WithDataStreamerProducer(transport), server.WithMaxFrameSize(1024))
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	cli := createClientAndFetchID(t, transport, 1)
+	defer assertDoesNotError(t, cli.Close)
+
+	// the rejection of the oversized frame is the response to the request
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := cli.SendMsgWithResultContext(ctx, []uint64{1}, make([]byte, 4096))
+	rejection, ok := err.(protocol.ErrorCommand)
+	require.True(t, ok, "unexpected error %v", err)
+	assert.Equal(t, protocol.ErrorCodeFrameTooLarge, rejection.Code)
+
+	// each send returns its own rejection, not the one of an earlier send
+	assert.Equal(t, client.UndeliveredError{MessageID: 1, Recipients: []uint64{99}}, cli.SendMsg([]uint64{99}, []byte("Anybody?")))
+	assert.Error(t, cli.SendRoomMsg("general", []byte("Anybody?")))
+	assert.NoError(t, cli.JoinRoom("general"))
+	assert.NoError(t, cli.SendRoomMsg("general", []byte("Anybody?")))
+}
+
+func TestIntegrationUnreadMessages(t *testing.T) {
+	transport := newMemoryTransport()
+	srv := server.New(server.WithDataStreamerProducer(transport))
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	sender := createClientAndFetchID(t, transport, 1)
+	defer assertDoesNotError(t, sender.Close)
+
+	dropped := make(chan interface{}, 100)
+	recipient := client.New(client.WithDataStreamerProducer(transport), client.WithDroppedMessageHandler(func(message interface{}) {
+		dropped <- message
+	}))
+	require.NoError(t, recipient.Connect(&serverAddr))
+	defer assertDoesNotError(t, recipient.Close)
+	require.NoError(t, sender.JoinRoom("general"))
+	require.NoError(t, recipient.JoinRoom("general"))
+
+	// the direct and room messages nobody reads do not hold up the responses to the recipient,
+	// the ones which do not fit in the delivery queues are reported
+	for i := 0; i < 50; i++ {
+		require.NoError(t, sender.SendMsg([]uint64{2}, []byte("Anybody?")))
+		require.NoError(t, sender.SendRoomMsg("general", []byte("Anybody?")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err := recipient.WhoAmIContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), id)
+	assert.Empty(t, dropped)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, sender.SendMsg([]uint64{2}, []byte("Anybody?")))
+	}
+	id, err = recipient.WhoAmIContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), id)
+	assert.Len(t, dropped, 6)
+}
+
+func TestIntegrationOfflineMailbox(t *testing.T) {
+	// only bob can take the nick bob, so nobody else can read his mailbox
+	authenticator := auth.NewTokenAuthenticator(map[string]string{"alice-token": "alice", "bob-token": "bob"})
+	transport := newMemoryTransport()
+	srv := server.New(
+		server.WithDataStreamerProducer(transport),
+		server.WithAuthenticator(authenticator),
+		server.WithIdentityNicks(),
+		server.WithMailbox(mailbox.NewMemoryMailbox(mailbox.Limits{})),
+	)
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	sender := client.New(client.WithDataStreamerProducer(transport), client.WithToken("alice-token"))
+	require.NoError(t, sender.Connect(&serverAddr))
+	defer assertDoesNotError(t, sender.Close)
+
+	body := []byte("See you later!")
+	assert.NoError(t, sender.SendMsgToNick("bob", body))
+	assert.Error(t, sender.SetNick("bob"))
+
+	recipientCh := make(chan protocol.MessageFromClient)
+	recipient := client.New(client.WithDataStreamerProducer(transport), client.WithToken("bob-token"))
+	go recipient.HandleIncomingMessages(recipientCh)
+	require.NoError(t, recipient.Connect(&serverAddr))
+	defer assertDoesNotError(t, recipient.Close)
+
+	incomingMessage := <-recipientCh
+	assert.Equal(t, body, incomingMessage.Body)
+	assert.Equal(t, "alice", incomingMessage.SenderNick)
+}
+
+func TestIntegrationAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	authenticator := auth.Schemes{
+		protocol.AuthSchemePassword: auth.NewPasswordAuthenticator(map[string][]byte{"alice": hash}),
+		protocol.AuthSchemeToken:    auth.NewTokenAuthenticator(map[string]string{"ci-token": "ci"}),
+	}
+	transport := newMemoryTransport()
+	srv := server.New(server.WithDataStreamerProducer(transport), server.WithAuthenticator(authenticator), server.WithIdentityNicks())
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	intruder := client.New(client.WithDataStreamerProducer(transport), client.WithPassword("alice", "guess"))
+	assert.Error(t, intruder.Connect(&serverAddr))
+
+	// the request of a client which did not authenticate gets the rejection
+	anonymous := client.New(client.WithDataStreamerProducer(transport))
+	require.NoError(t, anonymous.Connect(&serverAddr))
+	defer anonymous.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = anonymous.WhoAmIContext(ctx)
+	rejection, ok := err.(protocol.ErrorCommand)
+	require.True(t, ok, "unexpected error %v", err)
+	assert.Equal(t, protocol.ErrorCodeAuthenticationRequired, rejection.Code)
+
+	alice := client.New(client.WithDataStreamerProducer(transport), client.WithPassword("alice", "secret"))
+	require.NoError(t, alice.Connect(&serverAddr))
+	defer assertDoesNotError(t, alice.Close)
+	assert.Equal(t, "alice", alice.Identity())
+	aliceCh := make(chan protocol.MessageFromClient)
+	go alice.HandleIncomingMessages(aliceCh)
+
+	ci := client.New(client.WithDataStreamerProducer(transport), client.WithToken("ci-token"))
+	require.NoError(t, ci.Connect(&serverAddr))
+	defer assertDoesNotError(t, ci.Close)
+	assert.Equal(t, "ci", ci.Identity())
+
+	users, err := ci.ListUsers()
+	assert.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "alice", users[0].Nick)
+
+	body := []byte("build is green")
+	assert.NoError(t, ci.SendMsgToNick("alice", body))
+	incomingMessage := <-aliceCh
+	assert.Equal(t, body, incomingMessage.Body)
+	assert.Equal(t, "ci", incomingMessage.SenderNick)
+
+	// the identity cannot be connected twice
+	impostor := client.New(client.WithDataStreamerProducer(transport), client.WithToken("ci-token"))
+	assert.Error(t, impostor.Connect(&serverAddr))
+}
+
+func TestIntegrationMutualTLS(t *testing.T) {
+	ca, caKey := createCertificate(t, "chat CA", nil, nil)
+	serverCert, serverKey := createCertificate(t, "localhost", ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv := server.New(
+		server.WithDataStreamerProducer(&datastream.TlsDataStreamProducer{Config: serverConfig}),
+		server.WithAuthenticator(auth.NewTokenAuthenticator(nil)),
+		server.WithIdentityNicks(),
+	)
+
+	require.NoError(t, srv.Start(&localAddr))
+	defer assertDoesNotError(t, srv.Stop)
+	serverAddr := srv.Addr()
+
+	createTLSClient := func(identity string) *client.Client {
+		config := &tls.Config{ServerName: "localhost", RootCAs: roots}
+		if identity != "" {
+			cert, key := createCertificate(t, identity, ca, caKey)
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		return client.New(client.WithDataStreamerProducer(&datastream.TlsDataStreamProducer{Config: config}))
+	}
+
+	anonymous := createTLSClient("")
+	assert.Error(t, anonymous.Connect(serverAddr))
+
+	alice := createTLSClient("alice")
+	require.NoError(t, alice.Connect(serverAddr))
+	defer assertDoesNotError(t, alice.Close)
+	aliceCh := make(chan protocol.MessageFromClient)
+	go alice.HandleIncomingMessages(aliceCh)
+
+	bob := createTLSClient("bob")
+	require.NoError(t, bob.Connect(serverAddr))
+	defer assertDoesNotError(t, bob.Close)
+
+	aliceID, err := bob.LookupNick("alice")
+	require.NoError(t, err)
+
+	body := []byte("Hello over TLS!")
+	assert.NoError(t, bob.SendMsg([]uint64{aliceID}, body))
+	incomingMessage := <-aliceCh
+	assert.Equal(t, body, incomingMessage.Body)
+	assert.Equal(t, "bob", incomingMessage.SenderNick)
+}
+
+// createCertificate creates a certificate for the name signed by the parent, or a self signed CA if there is no parent
+func createCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate, key
 }
 
 func assertDoesNotError(tb testing.TB, fn func() error) {
 	assert.NoError(tb, fn())
 }
 
-func createClientAndFetchID(t *testing.T, expectedClientID uint64) *client.Client {
-	cli := client.New()
+func TestIntegrationUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverAddr, err := datastream.ParseEndpoint("unix://" + filepath.Join(dir, "chat.sock"))
+	require.NoError(t, err)
+	transport := &datastream.UnixDataStreamProducer{Mode: 0600}
+	srv := server.New(server.WithDataStreamerProducer(transport))
+	require.NoError(t, srv.Start(serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+
+	sender := client.New(client.WithDataStreamerProducer(transport))
+	require.NoError(t, sender.Connect(serverAddr))
+	defer assertDoesNotError(t, sender.Close)
+
+	recipient := client.New(client.WithDataStreamerProducer(transport))
+	require.NoError(t, recipient.Connect(serverAddr))
+	defer assertDoesNotError(t, recipient.Close)
+	recipientCh := make(chan protocol.MessageFromClient)
+	go recipient.HandleIncomingMessages(recipientCh)
+
+	recipientID, err := recipient.WhoAmI()
+	require.NoError(t, err)
+	body := []byte("Hello from the same host!")
+	require.NoError(t, sender.SendMsg([]uint64{recipientID}, body))
+
+	incomingMessage := <-recipientCh
+	assert.Equal(t, body, incomingMessage.Body)
+}
+
+func TestIntegrationWebSocketGateway(t *testing.T) {
+	transport := newMemoryTransport()
+	gateway := &datastream.WebSocketDataStreamProducer{Path: "/chat"}
+	srv := server.New(server.WithDataStreamerProducer(transport), server.WithGateway(&localAddr, gateway))
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+	gatewayAddr := srv.GatewayAddrs()[0]
+
+	tcpClient := client.New(client.WithDataStreamerProducer(transport))
+	require.NoError(t, tcpClient.Connect(&serverAddr))
+	defer assertDoesNotError(t, tcpClient.Close)
+	tcpClientCh := make(chan protocol.MessageFromClient)
+	go tcpClient.HandleIncomingMessages(tcpClientCh)
+
+	browser := client.New(client.WithDataStreamerProducer(gateway))
+	require.NoError(t, browser.Connect(gatewayAddr))
+	defer assertDoesNotError(t, browser.Close)
+	browserCh := make(chan protocol.MessageFromClient)
+	go browser.HandleIncomingMessages(browserCh)
+
+	tcpClientID, err := tcpClient.WhoAmI()
+	require.NoError(t, err)
+	browserID, err := browser.WhoAmI()
+	require.NoError(t, err)
+
+	ids, err := browser.ListClientIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{tcpClientID}, ids)
+
+	require.NoError(t, browser.SendMsg([]uint64{tcpClientID}, []byte("Hello from the browser!")))
+	incomingMessage := <-tcpClientCh
+	assert.Equal(t, "Hello from the browser!", string(incomingMessage.Body))
+	assert.Equal(t, browserID, incomingMessage.SenderID)
+
+	require.NoError(t, tcpClient.SendMsg([]uint64{browserID}, []byte("Hello from TCP!")))
+	incomingMessage = <-browserCh
+	assert.Equal(t, "Hello from TCP!", string(incomingMessage.Body))
+	assert.Equal(t, tcpClientID, incomingMessage.SenderID)
+}
+
+func TestIntegrationHTTPAPI(t *testing.T) {
+	transport := newMemoryTransport()
+	srv := server.New(server.WithDataStreamerProducer(transport), server.WithHTTPAPI(&localAddr))
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer assertDoesNotError(t, srv.Stop)
+	httpAddr := srv.HTTPAddr()
+
+	cli := createClientAndFetchID(t, transport, 1)
+	defer assertDoesNotError(t, cli.Close)
+	cliCh := make(chan protocol.MessageFromClient)
+	go cli.HandleIncomingMessages(cliCh)
+
+	response, err := http.Get("http://" + httpAddr.String() + "/clients")
+	require.NoError(t, err)
+	var clients struct{ Clients []uint64 }
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&clients))
+	response.Body.Close()
+	assert.Equal(t, []uint64{1}, clients.Clients)
+
+	response, err = http.Post("http://"+httpAddr.String()+"/messages", "application/json", strings.NewReader(`{"recipients": [1], "body": "Build passed!"}`))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	incomingMessage := <-cliCh
+	assert.Equal(t, "Build passed!", string(incomingMessage.Body))
+	assert.Equal(t, server.APISenderID, incomingMessage.SenderID)
+}
+
+// newMemoryTransport returns the transport connecting a server and its clients over a new memory network
+func newMemoryTransport() datastream.IDataStreamerProducer {
+	return &datastream.MemoryDataStreamProducer{Network: datastream.NewMemoryNetwork()}
+}
+
+func createClientAndFetchID(t *testing.T, transport datastream.IDataStreamerProducer, expectedClientID uint64) *client.Client {
+	cli := client.New(client.WithDataStreamerProducer(transport))
 	serverAddr := net.TCPAddr{Port: serverPort}
 	require.NoError(t, cli.Connect(&serverAddr))
 	id, err := cli.WhoAmI()